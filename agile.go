@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf16"
+
+	crand "crypto/rand"
+)
+
+// ECMA-376 Agile Encryption (MS-OFFCRYPTO 2.3.4.10) settings, as Excel
+// writes them
+const (
+	agileKeyBits      = 256
+	agileBlockSize    = aes.BlockSize
+	agileSaltSize     = 16
+	agileHashSize     = sha512.Size
+	agileSpinCount    = 100000
+	agileSegmentSize  = 4096
+	agilePasswordURI  = "http://schemas.microsoft.com/office/2006/keyEncryptor/password"
+	agileEncryptionNS = "http://schemas.microsoft.com/office/2006/encryption"
+)
+
+// block keys that derive separate keys and IVs from one password or salt
+var (
+	agileBlockVerifierInput = []byte{0xfe, 0xa7, 0xd2, 0x76, 0x3b, 0x4b, 0x9e, 0x79}
+	agileBlockVerifierValue = []byte{0xd7, 0xaa, 0x0f, 0x6d, 0x30, 0x61, 0x34, 0x4e}
+	agileBlockKeyValue      = []byte{0x14, 0x6e, 0x0b, 0xe7, 0xab, 0xac, 0xd0, 0xd6}
+	agileBlockHMACKey       = []byte{0x5f, 0xb2, 0xad, 0x01, 0x0c, 0xb9, 0xe1, 0xf6}
+	agileBlockHMACValue     = []byte{0xa0, 0x67, 0x7f, 0x02, 0xb2, 0x2c, 0x84, 0x33}
+)
+
+// version 4.4 of the EncryptionInfo stream, with the reserved flag Excel sets
+var agileVersion = []byte{0x04, 0x00, 0x04, 0x00, 0x40, 0x00, 0x00, 0x00}
+
+const agileEncryptionInfo = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<encryption xmlns="` + agileEncryptionNS + `" xmlns:p="` + agilePasswordURI + `">` +
+	`<keyData saltSize="%[1]d" blockSize="%[2]d" keyBits="%[3]d" hashSize="%[4]d" cipherAlgorithm="AES" cipherChaining="ChainingModeCBC" hashAlgorithm="SHA512" saltValue="%[5]s"/>` +
+	`<dataIntegrity encryptedHmacKey="%[6]s" encryptedHmacValue="%[7]s"/>` +
+	`<keyEncryptors><keyEncryptor uri="` + agilePasswordURI + `">` +
+	`<p:encryptedKey spinCount="%[8]d" saltSize="%[1]d" blockSize="%[2]d" keyBits="%[3]d" hashSize="%[4]d" cipherAlgorithm="AES" cipherChaining="ChainingModeCBC" hashAlgorithm="SHA512" saltValue="%[9]s" encryptedVerifierHashInput="%[10]s" encryptedVerifierHashValue="%[11]s" encryptedKeyValue="%[12]s"/>` +
+	`</keyEncryptor></keyEncryptors></encryption>`
+
+// Encrypt an xlsx package with a password, producing the compound file that
+// Excel opens as a password-protected workbook
+func encryptWorkbook(pkg []byte, password string) ([]byte, error) {
+	packageKey, err := randomBytes(agileKeyBits / 8)
+	if err != nil {
+		return nil, err
+	}
+	keyDataSalt, err := randomBytes(agileSaltSize)
+	if err != nil {
+		return nil, err
+	}
+	passwordSalt, err := randomBytes(agileSaltSize)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedPackage, err := agileEncryptPackage(packageKey, keyDataSalt, pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	// data integrity: an HMAC of the whole EncryptedPackage stream, with the
+	// HMAC key and value encrypted with the package key
+	hmacKey, err := randomBytes(agileHashSize)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha512.New, hmacKey)
+	mac.Write(encryptedPackage)
+	encryptedHMACKey, err := agileCBC(packageKey, agileIV(keyDataSalt, agileBlockHMACKey), hmacKey)
+	if err != nil {
+		return nil, err
+	}
+	encryptedHMACValue, err := agileCBC(packageKey, agileIV(keyDataSalt, agileBlockHMACValue), mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	// the password key encryptor: a verifier that lets readers check the
+	// password, and the package key encrypted with a key derived from it
+	verifierInput, err := randomBytes(agileSaltSize)
+	if err != nil {
+		return nil, err
+	}
+	passwordHash := agilePasswordHash(password, passwordSalt)
+	verifierHash := sha512.Sum512(verifierInput)
+	encrypted := map[string][]byte{}
+	for name, v := range map[string]struct {
+		blockKey, value []byte
+	}{
+		"verifierInput": {agileBlockVerifierInput, verifierInput},
+		"verifierValue": {agileBlockVerifierValue, verifierHash[:]},
+		"keyValue":      {agileBlockKeyValue, packageKey},
+	} {
+		encrypted[name], err = agileCBC(agileKey(passwordHash, v.blockKey), passwordSalt, v.value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b64 := base64.StdEncoding.EncodeToString
+	info := append(append([]byte{}, agileVersion...), fmt.Sprintf(agileEncryptionInfo,
+		agileSaltSize, agileBlockSize, agileKeyBits, agileHashSize, b64(keyDataSalt),
+		b64(encryptedHMACKey), b64(encryptedHMACValue),
+		agileSpinCount, b64(passwordSalt),
+		b64(encrypted["verifierInput"]), b64(encrypted["verifierValue"]), b64(encrypted["keyValue"]))...)
+
+	out := &bytes.Buffer{}
+	err = writeCompoundFile(out, []cfbStream{
+		{name: "EncryptionInfo", data: info},
+		{name: "EncryptedPackage", data: encryptedPackage},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Encrypt the package in 4096-byte segments, each with an IV derived from
+// its index. The stream starts with the package's size.
+func agileEncryptPackage(packageKey, keyDataSalt, pkg []byte) ([]byte, error) {
+	out := make([]byte, 8, 8+len(pkg)+agileBlockSize)
+	binary.LittleEndian.PutUint64(out, uint64(len(pkg)))
+	for i := 0; i*agileSegmentSize < len(pkg); i++ {
+		end := (i + 1) * agileSegmentSize
+		if end > len(pkg) {
+			end = len(pkg)
+		}
+		index := make([]byte, 4)
+		binary.LittleEndian.PutUint32(index, uint32(i))
+		segment, err := agileCBC(packageKey, agileIV(keyDataSalt, index), pkg[i*agileSegmentSize:end])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, segment...)
+	}
+	return out, nil
+}
+
+// Hash a password with its salt and spin count (MS-OFFCRYPTO 2.3.4.11)
+func agilePasswordHash(password string, salt []byte) []byte {
+	h := sha512.New()
+	h.Write(salt)
+	h.Write(utf16LE(password))
+	hash := h.Sum(nil)
+	iterator := make([]byte, 4)
+	for i := 0; i < agileSpinCount; i++ {
+		binary.LittleEndian.PutUint32(iterator, uint32(i))
+		h.Reset()
+		h.Write(iterator)
+		h.Write(hash)
+		hash = h.Sum(hash[:0])
+	}
+	return hash
+}
+
+// Derive the key for a block key from a password hash, cut to the key size
+func agileKey(passwordHash, blockKey []byte) []byte {
+	h := sha512.New()
+	h.Write(passwordHash)
+	h.Write(blockKey)
+	return h.Sum(nil)[:agileKeyBits/8]
+}
+
+// Derive an IV from a salt and a block key or segment index, cut to the
+// block size
+func agileIV(salt, blockKey []byte) []byte {
+	h := sha512.New()
+	h.Write(salt)
+	h.Write(blockKey)
+	return h.Sum(nil)[:agileBlockSize]
+}
+
+// Encrypt with AES-CBC, padding with zeros to the block size
+func agileCBC(key, iv, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padded := make([]byte, (len(data)+agileBlockSize-1)/agileBlockSize*agileBlockSize)
+	copy(padded, data)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+	return padded, nil
+}
+
+func utf16LE(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, len(units)*2)
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[i*2:], u)
+	}
+	return b
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(crand.Reader, b)
+	return b, err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/richardlehane/mscfb"
+	"github.com/xuri/excelize/v2"
+)
+
+func TestEncryptWorkbook(t *testing.T) {
+	f := excelize.NewFile()
+	f.SetCellValue("Sheet1", "A1", "secret")
+	// enough cells for several encryption segments
+	for i := 2; i < 2000; i++ {
+		f.SetCellValue("Sheet1", fmt.Sprintf("B%d", i), i*i)
+	}
+	pkg, err := f.WriteToBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	password := "päss wörd"
+	out, err := encryptWorkbook(pkg.Bytes(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := excelize.OpenReader(bytes.NewReader(out), excelize.Options{Password: password})
+	if err != nil {
+		t.Fatalf("Could not open the encrypted workbook: %s", err)
+	}
+	value, err := decrypted.GetCellValue("Sheet1", "A1")
+	if err != nil || value != "secret" {
+		t.Fatalf("Expected A1 to be secret; got %q, %v", value, err)
+	}
+	_, err = excelize.OpenReader(bytes.NewReader(out), excelize.Options{Password: "wrong"})
+	if err == nil {
+		t.Fatal("Expected the wrong password to fail")
+	}
+
+	// excelize does not check data integrity, but Excel does
+	streams := map[string][]byte{}
+	r, err := mscfb.New(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for f, err := r.Next(); err == nil; f, err = r.Next() {
+		streams[f.Name], _ = io.ReadAll(f)
+	}
+	if !bytes.Equal(streams["EncryptionInfo"][:8], agileVersion) {
+		t.Fatalf("Unexpected EncryptionInfo version %x", streams["EncryptionInfo"][:8])
+	}
+	var info struct {
+		KeyData struct {
+			SaltValue string `xml:"saltValue,attr"`
+		} `xml:"keyData"`
+		DataIntegrity struct {
+			EncryptedHmacKey   string `xml:"encryptedHmacKey,attr"`
+			EncryptedHmacValue string `xml:"encryptedHmacValue,attr"`
+		} `xml:"dataIntegrity"`
+		EncryptedKey struct {
+			SaltValue         string `xml:"saltValue,attr"`
+			EncryptedKeyValue string `xml:"encryptedKeyValue,attr"`
+		} `xml:"keyEncryptors>keyEncryptor>encryptedKey"`
+	}
+	err = xml.Unmarshal(streams["EncryptionInfo"][8:], &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := func(s string) []byte {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	decrypt := func(key, iv, data []byte) []byte {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain := make([]byte, len(data))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+		return plain
+	}
+	passwordSalt := b64(info.EncryptedKey.SaltValue)
+	keyDataSalt := b64(info.KeyData.SaltValue)
+	packageKey := decrypt(agileKey(agilePasswordHash(password, passwordSalt), agileBlockKeyValue), passwordSalt, b64(info.EncryptedKey.EncryptedKeyValue))
+	hmacKey := decrypt(packageKey, agileIV(keyDataSalt, agileBlockHMACKey), b64(info.DataIntegrity.EncryptedHmacKey))
+	hmacValue := decrypt(packageKey, agileIV(keyDataSalt, agileBlockHMACValue), b64(info.DataIntegrity.EncryptedHmacValue))
+	mac := hmac.New(sha512.New, hmacKey)
+	mac.Write(streams["EncryptedPackage"])
+	if !hmac.Equal(mac.Sum(nil), hmacValue) {
+		t.Fatal("The data integrity HMAC does not match the EncryptedPackage stream")
+	}
+}
@@ -3,20 +3,28 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/xuri/excelize/v2"
 )
 
 const (
-	region          string = "us-east-1"
-	localS3Filename        = "s3File.xlsx"
+	region            string = "us-east-1"
+	localS3Filename          = "s3File.xlsx"
+	maxUploadAttempts        = 3
 )
 
 func createS3Client(region string) (*s3.Client, error) {
@@ -33,8 +41,50 @@ type S3ClientAPI interface {
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFins ...func(*s3.Options)) (*s3.PutObjectOutput, error)
 }
 
+// workbookVersion is the version of the workbook in S3 that a local copy
+// was last downloaded from or uploaded as.
+type workbookVersion struct {
+	ETag        string
+	Cells       map[string][][]rawCell // sheet -> rows
+	KeyHeadings []string               // headings of the columns that identify each row, such as user names
+}
+
+var (
+	workbookVersionsMu sync.Mutex
+	workbookVersions   = map[string]*workbookVersion{} // local path -> version
+)
+
+func setWorkbookVersion(f *excelize.File, etag string, keyHeadings []string) error {
+	cells, err := getAllCells(f)
+	if err != nil {
+		return err
+	}
+	workbookVersionsMu.Lock()
+	defer workbookVersionsMu.Unlock()
+	workbookVersions[f.Path] = &workbookVersion{ETag: etag, Cells: cells, KeyHeadings: keyHeadings}
+	return nil
+}
+
+func getWorkbookVersion(f *excelize.File) *workbookVersion {
+	workbookVersionsMu.Lock()
+	defer workbookVersionsMu.Unlock()
+	return workbookVersions[f.Path]
+}
+
+// Remove the local copy of a downloaded workbook
+func closeWorkbook(f *excelize.File) {
+	workbookVersionsMu.Lock()
+	delete(workbookVersions, f.Path)
+	workbookVersionsMu.Unlock()
+	os.RemoveAll(filepath.Dir(f.Path))
+}
+
+func s3URI(bucket, key string) string {
+	return "s3://" + bucket + "/" + key
+}
+
 func downloadFile(input *Input, client S3ClientAPI) (*excelize.File, error) {
-	obj, err := downloadS3Object(input.Bucket, input.Key, client)
+	obj, etag, err := downloadS3ObjectVersion(input.Bucket, input.Key, client)
 	if err != nil {
 		return nil, fmt.Errorf("Error downloading file: %s", err)
 	}
@@ -54,36 +104,258 @@ func downloadFile(input *Input, client S3ClientAPI) (*excelize.File, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Error saving file to %s after downloading it: %s", filename, err)
 	}
+
+	keyHeadings := []string{input.UsernameHeader, input.AutomatedSheetColNameToHeading[ColUser]}
+	err = setWorkbookVersion(f, etag, keyHeadings)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading file %s after downloading it: %s", filename, err)
+	}
 	return f, nil
 }
 
 func downloadS3Object(bucket, key string, client S3ClientAPI) ([]byte, error) {
+	obj, _, err := downloadS3ObjectVersion(bucket, key, client)
+	return obj, err
+}
+
+// Download an object and its ETag
+func downloadS3ObjectVersion(bucket, key string, client S3ClientAPI) ([]byte, string, error) {
 	resp, err := client.GetObject(context.Background(), &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	defer resp.Body.Close()
-	return io.ReadAll(resp.Body)
+	obj, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return obj, aws.StringValue(resp.ETag), nil
 }
 
+// Upload the workbook if the copy in S3 has not changed since it was
+// downloaded or last uploaded. If it has changed, merge those changes into
+// the local copy and try again.
 func uploadFile(f *excelize.File, bucket, key string, s3Client S3ClientAPI) error {
+	version := getWorkbookVersion(f)
+	for attempt := 0; attempt < maxUploadAttempts; attempt++ {
+		etag := ""
+		if version != nil {
+			etag = version.ETag
+		}
+
+		newETag, err := putFile(f, bucket, key, s3Client, etag)
+		if err == nil {
+			if version != nil {
+				return setWorkbookVersion(f, newETag, version.KeyHeadings)
+			}
+			return nil
+		}
+		if version == nil || !isPreconditionFailed(err) {
+			return fmt.Errorf("Error uploading file to s3: %s", err)
+		}
+
+		logger.Info("workbook changed since it was downloaded; merging changes", Fields{"file": s3URI(bucket, key)})
+		err = mergeRemoteChanges(f, bucket, key, s3Client, version)
+		if err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("Error uploading file to s3://%s/%s: file changed during each of %d attempts", bucket, key, maxUploadAttempts)
+}
+
+// Put the workbook, only replacing the object with the given ETag if it is
+// not empty. Returns the ETag of the new object.
+func putFile(f *excelize.File, bucket, key string, s3Client S3ClientAPI, etag string) (string, error) {
 	fp, err := os.Open(f.Path)
 	if err != nil {
-		return fmt.Errorf("Error opening file: %s", err)
+		return "", fmt.Errorf("Error opening file: %s", err)
 	}
 	defer fp.Close()
 
-	_, err = s3Client.PutObject(context.Background(), &s3.PutObjectInput{
+	optFns := []func(*s3.Options){}
+	if etag != "" {
+		optFns = append(optFns, func(o *s3.Options) {
+			o.APIOptions = append(o.APIOptions, smithyhttp.AddHeaderValue("If-Match", etag))
+		})
+	}
+
+	resp, err := s3Client.PutObject(context.Background(), &s3.PutObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 		Body:   fp,
-	})
+	}, optFns...)
 	if err != nil {
-		return fmt.Errorf("Error uploading file to s3: %s", err)
+		return "", err
+	}
+	if resp == nil {
+		return "", nil
+	}
+	return aws.StringValue(resp.ETag), nil
+}
+
+// Report whether a conditional put failed because the object has changed
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return true
+		}
 	}
+	return false
+}
+
+// Merge changes made to the workbook in S3 since version into the local
+// copy, cell by cell, keeping each cell's type and formula. Cells changed only
+// in S3 take the value from S3. Cells changed both locally and in S3 to
+// different values are conflicts, as are sheets changed in S3 whose rows were
+// added, deleted or reordered in either copy, since their cells no longer
+// line up; conflicts are reported and nothing is merged.
+func mergeRemoteChanges(f *excelize.File, bucket, key string, client S3ClientAPI, version *workbookVersion) error {
+	obj, etag, err := downloadS3ObjectVersion(bucket, key, client)
+	if err != nil {
+		return fmt.Errorf("Error downloading s3://%s/%s to merge changes: %s", bucket, key, err)
+	}
+	remote, err := excelize.OpenReader(bytes.NewReader(obj))
+	if err != nil {
+		return fmt.Errorf("Error opening s3://%s/%s to merge changes: %s", bucket, key, err)
+	}
+	remoteCells, err := getAllCells(remote)
+	if err != nil {
+		return err
+	}
+	localCells, err := getAllCells(f)
+	if err != nil {
+		return err
+	}
+
+	type cellChange struct {
+		sheet, cell string
+		value       rawCell
+	}
+	changes := []cellChange{}
+	conflicts := []string{}
+	newSheets := []string{}
+	deletedSheets := []string{}
+
+	for _, sheet := range remote.GetSheetList() {
+		theirs := remoteCells[sheet]
+		base, inBase := version.Cells[sheet]
+		ours, ok := localCells[sheet]
+		if !ok && !inBase {
+			// added in S3
+			newSheets = append(newSheets, sheet)
+		} else if reflect.DeepEqual(base, theirs) {
+			// not changed in S3
+			continue
+		} else if !ok {
+			conflicts = append(conflicts, sheet+" (deleted locally)")
+			continue
+		} else if moved := rowsMoved(base, theirs, version.KeyHeadings); moved != "" {
+			conflicts = append(conflicts, sheet+" ("+moved+" in S3)")
+			continue
+		} else if moved := rowsMoved(base, ours, version.KeyHeadings); moved != "" {
+			conflicts = append(conflicts, sheet+" ("+moved+" locally)")
+			continue
+		}
+
+		numRows := maxLen(len(base), len(ours), len(theirs))
+		for y := 0; y < numRows; y++ {
+			numCols := maxLen(rawRowLen(base, y), rawRowLen(ours, y), rawRowLen(theirs, y))
+			for x := 0; x < numCols; x++ {
+				b, o, t := rawCellAt(base, x, y), rawCellAt(ours, x, y), rawCellAt(theirs, x, y)
+				if t == b || t == o {
+					continue
+				}
+				cell, err := excelize.CoordinatesToCellName(toSheetCoord(x), toSheetCoord(y))
+				if err != nil {
+					return err
+				}
+				if o != b {
+					conflicts = append(conflicts, sheet+"!"+cell)
+					continue
+				}
+				changes = append(changes, cellChange{sheet, cell, t})
+			}
+		}
+	}
+	for sheet, ours := range localCells {
+		if _, ok := remoteCells[sheet]; ok {
+			continue
+		}
+		if base, ok := version.Cells[sheet]; ok {
+			// deleted in S3
+			if reflect.DeepEqual(base, ours) {
+				deletedSheets = append(deletedSheets, sheet)
+			} else {
+				conflicts = append(conflicts, sheet)
+			}
+		}
+	}
+
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf("Error merging changes to s3://%s/%s: changed both locally and in S3: %s",
+			bucket, key, strings.Join(conflicts, ", "))
+	}
+
+	for _, sheet := range newSheets {
+		f.NewSheet(sheet)
+	}
+	for _, sheet := range deletedSheets {
+		f.DeleteSheet(sheet)
+	}
+	for _, c := range changes {
+		err = setRawCell(f, c.sheet, c.cell, c.value)
+		if err != nil {
+			return fmt.Errorf("Error merging %s!%s from s3://%s/%s: %s", c.sheet, c.cell, bucket, key, err)
+		}
+	}
+	err = f.Save()
+	if err != nil {
+		return fmt.Errorf("Error saving file %s after merging changes: %s", f.Path, err)
+	}
+
+	logger.Info("merged changed cells", Fields{"cells": len(changes), "file": s3URI(bucket, key)})
+
+	version.ETag = etag
+	version.Cells = remoteCells
 	return nil
 }
+
+// Describe how the rows of a sheet moved between two copies, or return an
+// empty string if they line up: the same number of rows, with the same value
+// in each row of the columns under keyHeadings
+func rowsMoved(from, to [][]rawCell, keyHeadings []string) string {
+	if len(from) != len(to) {
+		return fmt.Sprintf("%d rows became %d", len(from), len(to))
+	}
+	if len(from) == 0 {
+		return ""
+	}
+	for x, heading := range from[0] {
+		if heading.Value == "" || !contains(keyHeadings, heading.Value) {
+			continue
+		}
+		for y := 1; y < len(from); y++ {
+			if rawCellAt(from, x, y).Value != rawCellAt(to, x, y).Value {
+				return fmt.Sprintf("rows reordered at row %d", toSheetCoord(y))
+			}
+		}
+	}
+	return ""
+}
+
+func maxLen(lengths ...int) int {
+	m := 0
+	for _, l := range lengths {
+		if l > m {
+			m = l
+		}
+	}
+	return m
+}
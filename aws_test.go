@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/xuri/excelize/v2"
+)
+
+// MemS3Client keeps objects in memory and honors If-Match on PutObject.
+type MemS3Client struct {
+	Objects map[string][]byte
+}
+
+func etagOf(b []byte) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(b)))
+}
+
+func (c *MemS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	obj, ok := c.Objects[aws.StringValue(params.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader(obj)),
+		ETag: aws.String(etagOf(obj)),
+	}, nil
+}
+
+func (c *MemS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	header, err := requestHeader(optFns...)
+	if err != nil {
+		return nil, err
+	}
+	key := aws.StringValue(params.Key)
+	if ifMatch := header.Get("If-Match"); ifMatch != "" && ifMatch != etagOf(c.Objects[key]) {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+
+	obj, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.Objects[key] = obj
+	return &s3.PutObjectOutput{ETag: aws.String(etagOf(obj))}, nil
+}
+
+// Get the HTTP headers that the API options in optFns add to a request
+func requestHeader(optFns ...func(*s3.Options)) (http.Header, error) {
+	var opts s3.Options
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+	stack := middleware.NewStack("test", smithyhttp.NewStackRequest)
+	for _, fn := range opts.APIOptions {
+		err := fn(stack)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var header http.Header
+	handler := middleware.HandlerFunc(func(ctx context.Context, in interface{}) (interface{}, middleware.Metadata, error) {
+		header = in.(*smithyhttp.Request).Header
+		return nil, middleware.Metadata{}, nil
+	})
+	_, _, err := middleware.DecorateHandler(handler, stack).Handle(context.Background(), nil)
+	return header, err
+}
+
+// a formula, for editObject
+type formula string
+
+// Apply changes to a workbook held by c, as if someone had edited it. A
+// value of type formula sets the cell's formula.
+func editObject(t *testing.T, c *MemS3Client, key string, cells map[string]interface{}) {
+	f, err := excelize.OpenReader(bytes.NewReader(c.Objects[key]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cell, value := range cells {
+		if v, ok := value.(formula); ok {
+			err = f.SetCellFormula("Testing", cell, string(v))
+		} else {
+			err = f.SetCellValue("Testing", cell, value)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Objects[key] = buf.Bytes()
+}
+
+func rawCellOf(t *testing.T, c *MemS3Client, key, cell string) rawCell {
+	f, err := excelize.OpenReader(bytes.NewReader(c.Objects[key]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells, err := getAllCells(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y, err := excelize.CellNameToCoordinates(cell)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rawCellAt(cells["Testing"], x-1, y-1)
+}
+
+func cellValue(t *testing.T, c *MemS3Client, key, cell string) string {
+	f, err := excelize.OpenReader(bytes.NewReader(c.Objects[key]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := f.GetCellValue("Testing", cell)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// Put a workbook with users ben and chris in a client and download it
+func downloadTestingWorkbook(t *testing.T) (*MemS3Client, *excelize.File) {
+	f := excelize.NewFile()
+	f.SetSheetName("Sheet1", "Testing")
+	for i, row := range [][]string{{headingMACFinUsername, headingMACFinPassword}, {"ben"}, {"chris"}} {
+		row := row
+		err := f.SetSheetRow("Testing", fmt.Sprintf("A%d", i+1), &row)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &MemS3Client{Objects: map[string][]byte{inputKey: buf.Bytes()}}
+	input := &Input{Bucket: inputBucket, Key: inputKey, UsernameHeader: headingMACFinUsername}
+	local, err := downloadFile(input, client)
+	if err != nil {
+		t.Fatalf("Error downloading file: %s", err)
+	}
+	t.Cleanup(func() { closeWorkbook(local) })
+	return client, local
+}
+
+func TestUploadMergesConcurrentChanges(t *testing.T) {
+	client, local := downloadTestingWorkbook(t)
+
+	// no one else has changed the workbook
+	err := writeCell(local, "Testing", 1, 1, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = uploadFile(local, inputBucket, inputKey, client)
+	if err != nil {
+		t.Fatalf("Error uploading file: %s", err)
+	}
+	if got := cellValue(t, client, inputKey, "B2"); got != "x" {
+		t.Fatalf("Expected B2=x in S3; got %q", got)
+	}
+
+	// a tester edits other cells while the workbook is being changed
+	editObject(t, client, inputKey, map[string]interface{}{"B3": "foo", "C3": 42, "D3": formula("C3*2"), "E2": true})
+	err = writeCell(local, "Testing", 1, 1, "y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = uploadFile(local, inputBucket, inputKey, client)
+	if err != nil {
+		t.Fatalf("Error uploading file after a concurrent edit: %s", err)
+	}
+	for cell, expected := range map[string]rawCell{
+		"B2": {Type: "s", Value: "y"},
+		"B3": {Type: "s", Value: "foo"},
+		"C3": {Type: "n", Value: "42"},
+		"D3": {Type: "n", Formula: "C3*2"},
+		"E2": {Type: "b", Value: "1"},
+	} {
+		got := rawCellOf(t, client, inputKey, cell)
+		if got.Type != expected.Type || got.Value != expected.Value || got.Formula != expected.Formula {
+			t.Fatalf("Expected %s=%+v in S3 after merging; got %+v", cell, expected, got)
+		}
+	}
+	if got, _ := local.GetCellValue("Testing", "B3"); got != "foo" {
+		t.Fatalf("Expected B3=foo in the local file after merging; got %q", got)
+	}
+
+	// a tester edits the same cell
+	editObject(t, client, inputKey, map[string]interface{}{"B2": "theirs"})
+	err = writeCell(local, "Testing", 1, 1, "ours")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = uploadFile(local, inputBucket, inputKey, client)
+	if err == nil || !strings.Contains(err.Error(), "Testing!B2") {
+		t.Fatalf("Expected a merge conflict on Testing!B2; got %v", err)
+	}
+	if got := cellValue(t, client, inputKey, "B2"); got != "theirs" {
+		t.Fatalf("Conflicting cell was overwritten in S3: B2=%q", got)
+	}
+}
+
+func TestUploadReportsMovedRows(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		edit     func(f *excelize.File) error
+		conflict string
+	}{
+		{"inserted", func(f *excelize.File) error { return f.InsertRow("Testing", 2) }, "Testing (3 rows became 4 in S3)"},
+		{"deleted", func(f *excelize.File) error { return f.RemoveRow("Testing", 2) }, "Testing (3 rows became 2 in S3)"},
+		{"reordered", func(f *excelize.File) error {
+			err := f.SetCellValue("Testing", "A2", "chris")
+			if err != nil {
+				return err
+			}
+			return f.SetCellValue("Testing", "A3", "ben")
+		}, "Testing (rows reordered at row 2 in S3)"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, local := downloadTestingWorkbook(t)
+			remote, err := excelize.OpenReader(bytes.NewReader(client.Objects[inputKey]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tc.edit(remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := remote.WriteToBuffer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Objects[inputKey] = buf.Bytes()
+
+			// the cell a tester's row would shift onto
+			err = writeCell(local, "Testing", 1, 2, "x")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = uploadFile(local, inputBucket, inputKey, client)
+			if err == nil || !strings.Contains(err.Error(), tc.conflict) {
+				t.Fatalf("Expected a merge conflict %q; got %v", tc.conflict, err)
+			}
+			if !bytes.Equal(client.Objects[inputKey], buf.Bytes()) {
+				t.Fatal("Workbook in S3 was overwritten after a conflict")
+			}
+		})
+	}
+}
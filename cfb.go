@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// Compound File Binary (MS-CFB) version 3 constants
+const (
+	cfbSectorSize     = 512
+	cfbMiniSectorSize = 64
+	cfbMiniCutoff     = 4096 // smaller streams are stored in the mini stream
+	cfbDirEntrySize   = 128
+	cfbHeaderDIFAT    = 109 // FAT sector locations held in the header
+	cfbEntriesPerSect = cfbSectorSize / 4
+	cfbMaxNameLength  = 31
+
+	cfbFreeSect   uint32 = 0xFFFFFFFF
+	cfbEndOfChain uint32 = 0xFFFFFFFE
+	cfbFATSect    uint32 = 0xFFFFFFFD
+	cfbDIFSect    uint32 = 0xFFFFFFFC
+	cfbNoStream   uint32 = 0xFFFFFFFF
+
+	cfbTypeStream = 2
+	cfbTypeRoot   = 5
+	cfbBlack      = 1
+)
+
+var cfbSignature = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+// cfbStream is a stream in the root storage of a compound file.
+type cfbStream struct {
+	name string
+	data []byte
+}
+
+// cfbEntry is a directory entry being laid out.
+type cfbEntry struct {
+	name        string
+	typ         byte
+	left, right uint32
+	child       uint32
+	start       uint32
+	size        uint64
+}
+
+// Compare directory entry names as MS-CFB orders siblings: shorter names
+// first, then by upper case
+func cfbLess(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	if len(ua) != len(ub) {
+		return len(ua) < len(ub)
+	}
+	return strings.ToUpper(a) < strings.ToUpper(b)
+}
+
+// Write a compound file holding streams in its root storage. Streams smaller
+// than the mini stream cutoff are stored in the mini stream, as readers
+// expect.
+func writeCompoundFile(w io.Writer, streams []cfbStream) error {
+	streams = append([]cfbStream{}, streams...)
+	sort.Slice(streams, func(i, j int) bool { return cfbLess(streams[i].name, streams[j].name) })
+	for i, s := range streams {
+		if n := len(utf16.Encode([]rune(s.name))); n == 0 || n > cfbMaxNameLength {
+			return fmt.Errorf("invalid compound file stream name %q", s.name)
+		}
+		if i > 0 && strings.EqualFold(streams[i-1].name, s.name) {
+			return fmt.Errorf("duplicate compound file stream name %q", s.name)
+		}
+	}
+
+	fat := []uint32{}
+	// allocate a chain of n sectors and return its first sector
+	chain := func(n int) uint32 {
+		if n == 0 {
+			return cfbEndOfChain
+		}
+		first := uint32(len(fat))
+		for i := 1; i < n; i++ {
+			fat = append(fat, first+uint32(i))
+		}
+		fat = append(fat, cfbEndOfChain)
+		return first
+	}
+	sectors := func(size int, sectorSize int) int {
+		return (size + sectorSize - 1) / sectorSize
+	}
+
+	// the mini stream and the mini FAT
+	entries := []cfbEntry{{name: "Root Entry", typ: cfbTypeRoot, left: cfbNoStream, right: cfbNoStream, child: cfbNoStream, start: cfbEndOfChain}}
+	miniFAT := []uint32{}
+	miniStream := &bytes.Buffer{}
+	for _, s := range streams {
+		e := cfbEntry{name: s.name, typ: cfbTypeStream, left: cfbNoStream, right: cfbNoStream, child: cfbNoStream, start: cfbEndOfChain, size: uint64(len(s.data))}
+		if len(s.data) > 0 && len(s.data) < cfbMiniCutoff {
+			n := sectors(len(s.data), cfbMiniSectorSize)
+			e.start = uint32(len(miniFAT))
+			for i := 1; i < n; i++ {
+				miniFAT = append(miniFAT, e.start+uint32(i))
+			}
+			miniFAT = append(miniFAT, cfbEndOfChain)
+			miniStream.Write(s.data)
+			miniStream.Write(make([]byte, n*cfbMiniSectorSize-len(s.data)))
+		}
+		entries = append(entries, e)
+	}
+
+	// sectors: mini stream, large streams, mini FAT, directory, then FAT and DIFAT
+	body := &bytes.Buffer{}
+	pad := func() {
+		if rem := body.Len() % cfbSectorSize; rem != 0 {
+			body.Write(make([]byte, cfbSectorSize-rem))
+		}
+	}
+
+	if miniStream.Len() > 0 {
+		entries[0].start = chain(sectors(miniStream.Len(), cfbSectorSize))
+		entries[0].size = uint64(miniStream.Len())
+		body.Write(miniStream.Bytes())
+		pad()
+	}
+	for i, s := range streams {
+		if len(s.data) < cfbMiniCutoff {
+			continue
+		}
+		entries[i+1].start = chain(sectors(len(s.data), cfbSectorSize))
+		body.Write(s.data)
+		pad()
+	}
+
+	miniFATStart, numMiniFAT := cfbEndOfChain, 0
+	if len(miniFAT) > 0 {
+		numMiniFAT = sectors(len(miniFAT), cfbEntriesPerSect)
+		miniFATStart = chain(numMiniFAT)
+		for len(miniFAT) < numMiniFAT*cfbEntriesPerSect {
+			miniFAT = append(miniFAT, cfbFreeSect)
+		}
+		binary.Write(body, binary.LittleEndian, miniFAT)
+	}
+
+	// the streams are siblings in a balanced tree under the root; every
+	// node is black, which keeps the tree valid
+	var link func(lo, hi int) uint32
+	link = func(lo, hi int) uint32 {
+		if lo > hi {
+			return cfbNoStream
+		}
+		mid := (lo + hi) / 2
+		entries[mid+1].left = link(lo, mid-1)
+		entries[mid+1].right = link(mid+1, hi)
+		return uint32(mid + 1)
+	}
+	entries[0].child = link(0, len(streams)-1)
+
+	numDir := sectors(len(entries)*cfbDirEntrySize, cfbSectorSize)
+	dirStart := chain(numDir)
+	for _, e := range entries {
+		writeCFBEntry(body, e)
+	}
+	for i := len(entries); i < numDir*cfbSectorSize/cfbDirEntrySize; i++ {
+		writeCFBEntry(body, cfbEntry{left: cfbNoStream, right: cfbNoStream, child: cfbNoStream})
+	}
+
+	// the FAT covers every sector, including its own and the DIFAT's
+	numFAT, numDIFAT := 0, 0
+	for {
+		fatNeeded := sectors(len(fat)+numFAT+numDIFAT, cfbEntriesPerSect)
+		difatNeeded := 0
+		if fatNeeded > cfbHeaderDIFAT {
+			difatNeeded = sectors(fatNeeded-cfbHeaderDIFAT, cfbEntriesPerSect-1)
+		}
+		if fatNeeded == numFAT && difatNeeded == numDIFAT {
+			break
+		}
+		numFAT, numDIFAT = fatNeeded, difatNeeded
+	}
+	fatStart := uint32(len(fat))
+	for i := 0; i < numFAT; i++ {
+		fat = append(fat, cfbFATSect)
+	}
+	difatStart := uint32(len(fat))
+	for i := 0; i < numDIFAT; i++ {
+		fat = append(fat, cfbDIFSect)
+	}
+	for len(fat) < numFAT*cfbEntriesPerSect {
+		fat = append(fat, cfbFreeSect)
+	}
+	binary.Write(body, binary.LittleEndian, fat)
+
+	// FAT sector locations: the first 109 in the header, the rest in DIFAT
+	// sectors that each end with the location of the next
+	difat := make([]uint32, 0, numFAT)
+	for i := 0; i < numFAT; i++ {
+		difat = append(difat, fatStart+uint32(i))
+	}
+	for i := 0; i < numDIFAT; i++ {
+		sector := make([]uint32, cfbEntriesPerSect)
+		for j := range sector {
+			sector[j] = cfbFreeSect
+		}
+		copy(sector, difat[cfbHeaderDIFAT+i*(cfbEntriesPerSect-1):minInt(len(difat), cfbHeaderDIFAT+(i+1)*(cfbEntriesPerSect-1))])
+		sector[cfbEntriesPerSect-1] = cfbEndOfChain
+		if i < numDIFAT-1 {
+			sector[cfbEntriesPerSect-1] = difatStart + uint32(i+1)
+		}
+		binary.Write(body, binary.LittleEndian, sector)
+	}
+
+	header := &bytes.Buffer{}
+	header.Write(cfbSignature)
+	header.Write(make([]byte, 16)) // CLSID
+	firstDIFAT := cfbEndOfChain
+	if numDIFAT > 0 {
+		firstDIFAT = difatStart
+	}
+	binary.Write(header, binary.LittleEndian, struct {
+		MinorVersion, MajorVersion, ByteOrder, SectorShift, MiniSectorShift uint16
+		Reserved                                                            [6]byte
+		NumDirSectors, NumFATSectors, FirstDirSector, TransactionSignature  uint32
+		MiniStreamCutoff, FirstMiniFATSector, NumMiniFATSectors             uint32
+		FirstDIFATSector, NumDIFATSectors                                   uint32
+	}{
+		MinorVersion: 0x003E, MajorVersion: 3, ByteOrder: 0xFFFE, SectorShift: 9, MiniSectorShift: 6,
+		NumFATSectors: uint32(numFAT), FirstDirSector: dirStart,
+		MiniStreamCutoff: cfbMiniCutoff, FirstMiniFATSector: miniFATStart, NumMiniFATSectors: uint32(numMiniFAT),
+		FirstDIFATSector: firstDIFAT, NumDIFATSectors: uint32(numDIFAT),
+	})
+	for i := 0; i < cfbHeaderDIFAT; i++ {
+		loc := cfbFreeSect
+		if i < len(difat) {
+			loc = difat[i]
+		}
+		binary.Write(header, binary.LittleEndian, loc)
+	}
+
+	_, err := w.Write(header.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body.Bytes())
+	return err
+}
+
+func writeCFBEntry(buf *bytes.Buffer, e cfbEntry) {
+	var name [32]uint16
+	nameLength := 0
+	if e.name != "" {
+		nameLength = (copy(name[:], utf16.Encode([]rune(e.name))) + 1) * 2 // including the terminator
+	}
+	color := byte(0)
+	if e.typ != 0 {
+		color = cfbBlack
+	}
+	binary.Write(buf, binary.LittleEndian, struct {
+		Name               [32]uint16
+		NameLength         uint16
+		Type, Color        byte
+		Left, Right, Child uint32
+		CLSID              [16]byte
+		StateBits          uint32
+		Created, Modified  uint64
+		StartSector        uint32
+		Size               uint64
+	}{
+		Name: name, NameLength: uint16(nameLength), Type: e.typ, Color: color,
+		Left: e.left, Right: e.right, Child: e.child,
+		StartSector: e.start, Size: e.size,
+	})
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/richardlehane/mscfb"
+)
+
+func TestWriteCompoundFile(t *testing.T) {
+	streams := []cfbStream{
+		{name: "Empty", data: []byte{}},
+		{name: "AtCutoff", data: bytes.Repeat([]byte{'c'}, cfbMiniCutoff)},
+		// large enough to need FAT sector locations beyond the header
+		{name: "Large", data: bytes.Repeat([]byte("0123456789abcdef"), 8<<20/16)},
+	}
+	for i := 0; i < 40; i++ {
+		streams = append(streams, cfbStream{name: fmt.Sprintf("Small%d", i), data: bytes.Repeat([]byte{byte(i)}, i*37+1)})
+	}
+
+	out := &bytes.Buffer{}
+	err := writeCompoundFile(out, streams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Len()%cfbSectorSize != 0 {
+		t.Fatalf("Expected whole sectors; got %d bytes", out.Len())
+	}
+
+	r, err := mscfb.New(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := map[string][]byte{}
+	for f, err := r.Next(); err == nil; f, err = r.Next() {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("Reading %s: %s", f.Name, err)
+		}
+		read[f.Name] = data
+	}
+	if len(read) != len(streams) {
+		t.Fatalf("Expected %d streams; got %d", len(streams), len(read))
+	}
+	for _, s := range streams {
+		if !bytes.Equal(read[s.name], s.data) {
+			t.Fatalf("Stream %s: expected %d bytes; got %d that differ", s.name, len(s.data), len(read[s.name]))
+		}
+	}
+
+	for _, invalid := range [][]cfbStream{
+		{{name: ""}},
+		{{name: "abcdefghijklmnopqrstuvwxyz012345"}},
+		{{name: "Dup"}, {name: "DUP"}},
+	} {
+		if err := writeCompoundFile(io.Discard, invalid); err == nil {
+			t.Fatalf("Expected an error writing %+v", invalid)
+		}
+	}
+}
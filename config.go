@@ -0,0 +1,739 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultEnvironments = "dev,val,prod"
+
+// concurrency defaults
+const (
+	defaultWorkers           = 4
+	defaultRequestsPerSecond = 10
+)
+
+var environmentNamePattern = regexp.MustCompile(`^[a-z0-9]+$`)
+
+var mailGroupNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// Config is everything a run needs. It is read from an optional YAML or JSON
+// file; environment variables override the file.
+type Config struct {
+	Bucket                 string                    `yaml:"bucket" json:"bucket"`
+	Key                    string                    `yaml:"key" json:"key"`
+	UsernameHeader         string                    `yaml:"usernameHeader" json:"usernameHeader"`
+	PasswordHeader         string                    `yaml:"passwordHeader" json:"passwordHeader"`
+	AutomatedSheetPassword string                    `yaml:"automatedSheetPassword" json:"automatedSheetPassword"`
+	WorkbookPassword       string                    `yaml:"workbookPassword" json:"workbookPassword"`
+	Rotation               RotationConfig            `yaml:"rotation" json:"rotation"`
+	PasswordPolicies       map[string]PasswordPolicy `yaml:"passwordPolicies" json:"passwordPolicies"` // added to the built-in policies
+	Mail                   MailConfig                `yaml:"mail" json:"mail"`
+	Webhooks               []WebhookConfig           `yaml:"webhooks" json:"webhooks"`
+	Concurrency            ConcurrencyConfig         `yaml:"concurrency" json:"concurrency"`
+	ReportPrefix           string                    `yaml:"reportPrefix" json:"reportPrefix"`         // key prefix of run reports in the bucket
+	MetricsNamespace       string                    `yaml:"metricsNamespace" json:"metricsNamespace"` // CloudWatch namespace of the metrics written to stdout
+	Environments           []EnvironmentConfig       `yaml:"environments" json:"environments"`
+}
+
+// RotationConfig is the default rotation policy, which the optional policy
+// columns override per user.
+type RotationConfig struct {
+	MaxPasswordAgeDays int    `yaml:"maxPasswordAgeDays" json:"maxPasswordAgeDays"`
+	PasswordPolicy     string `yaml:"passwordPolicy" json:"passwordPolicy"`   // name of a password policy
+	PasswordLength     int    `yaml:"passwordLength" json:"passwordLength"`   // overrides the policy's length
+	ExcludeChars       string `yaml:"excludeChars" json:"excludeChars"`       // added to the policy's exclusions
+	HeartbeatDays      int    `yaml:"heartbeatDays" json:"heartbeatDays"`     // log in without rotating after this many days without a login; settingDisabled for never
+	QuarantineAfter    int    `yaml:"quarantineAfter" json:"quarantineAfter"` // stop logging in as a user after this many consecutive failed logins; settingDisabled for never
+}
+
+// settingDisabled turns off heartbeats or quarantine. An environment's 0
+// means unset, inheriting the top-level setting, so an environment disables
+// them with settingDisabled; at the top level 0 also means never.
+const settingDisabled = -1
+
+type MailConfig struct {
+	Enabled            bool        `yaml:"enabled" json:"enabled"`
+	Notify             string      `yaml:"notify" json:"notify"` // always, on-change, on-failure or never
+	SMTPHost           string      `yaml:"smtpHost" json:"smtpHost"`
+	SMTPPort           int         `yaml:"smtpPort" json:"smtpPort"`
+	SMTPAuth           string      `yaml:"smtpAuth" json:"smtpAuth"` // none, plain, login or cram-md5
+	SMTPUsername       string      `yaml:"smtpUsername" json:"smtpUsername"`
+	SMTPPassword       string      `yaml:"smtpPassword" json:"smtpPassword"`
+	SMTPTLS            string      `yaml:"smtpTLS" json:"smtpTLS"`       // opportunistic, starttls or implicit
+	SMTPCAFile         string      `yaml:"smtpCAFile" json:"smtpCAFile"` // PEM bundle trusted besides the system roots
+	SMTPSkipVerify     bool        `yaml:"smtpSkipVerify" json:"smtpSkipVerify"`
+	SMTPConnectTimeout string      `yaml:"smtpConnectTimeout" json:"smtpConnectTimeout"`
+	SubjectTemplate    string      `yaml:"subjectTemplate" json:"subjectTemplate"` // text/template, local or s3://bucket/key
+	TextTemplate       string      `yaml:"textTemplate" json:"textTemplate"`       // text/template, local or s3://bucket/key
+	HTMLTemplate       string      `yaml:"htmlTemplate" json:"htmlTemplate"`       // html/template, local or s3://bucket/key
+	FromAddress        string      `yaml:"fromAddress" json:"fromAddress"`
+	SenderName         string      `yaml:"senderName" json:"senderName"`
+	ToAddresses        []string    `yaml:"toAddresses" json:"toAddresses"` // receive the whole workbook
+	Groups             []MailGroup `yaml:"groups" json:"groups"`
+}
+
+// MailGroup is a set of recipients who receive a copy of the workbook with
+// only the sheets of their environments and any sheets listed by name.
+type MailGroup struct {
+	Name                string        `yaml:"name" json:"name"`
+	ToAddresses         []string      `yaml:"toAddresses" json:"toAddresses"`
+	Environments        []Environment `yaml:"environments" json:"environments"` // portal, testing and automated sheets
+	Sheets              []string      `yaml:"sheets" json:"sheets"`
+	OmitAutomatedSheets bool          `yaml:"omitAutomatedSheets" json:"omitAutomatedSheets"` // leave out the PasswordManager sheets
+}
+
+// WebhookConfig is a JSON webhook, such as a Slack or Teams incoming webhook,
+// that is told how a run went in some environments. Its payload never holds
+// passwords.
+type WebhookConfig struct {
+	Name            string        `yaml:"name" json:"name"`
+	URL             string        `yaml:"url" json:"url"`
+	Secret          string        `yaml:"secret" json:"secret"`                   // HMAC-SHA256 key that signs each payload
+	SignatureHeader string        `yaml:"signatureHeader" json:"signatureHeader"` // header holding sha256=<hex signature>
+	Notify          string        `yaml:"notify" json:"notify"`                   // always, on-change, on-failure or never
+	Environments    []Environment `yaml:"environments" json:"environments"`       // all if empty
+	PayloadTemplate string        `yaml:"payloadTemplate" json:"payloadTemplate"` // text/template, local or s3://bucket/key
+	Timeout         string        `yaml:"timeout" json:"timeout"`
+}
+
+// ConcurrencyConfig controls how many users are rotated at once and how
+// often the workbook is uploaded.
+type ConcurrencyConfig struct {
+	Workers           int     `yaml:"workers" json:"workers"`                     // users rotated at once in each environment
+	UploadBatchSize   int     `yaml:"uploadBatchSize" json:"uploadBatchSize"`     // failed rotations per workbook upload; a new password is uploaded at once
+	UploadInterval    string  `yaml:"uploadInterval" json:"uploadInterval"`       // longest wait before uploading a partial batch, such as 10s
+	RequestsPerSecond float64 `yaml:"requestsPerSecond" json:"requestsPerSecond"` // requests to each portal
+}
+
+// EnvironmentConfig declares a portal environment: the portal whose
+// passwords are rotated and the sheets that hold its users.
+type EnvironmentConfig struct {
+	Name           Environment `yaml:"name" json:"name"`
+	PortalHostname string      `yaml:"portalHostname" json:"portalHostname"`
+	IDMHostname    string      `yaml:"idmHostname" json:"idmHostname"`
+	PortalSheet    string      `yaml:"portalSheet" json:"portalSheet"`
+	AutomatedSheet string      `yaml:"automatedSheet" json:"automatedSheet"`
+	TestingSheets  []string    `yaml:"testingSheets" json:"testingSheets"`
+
+	// fields left empty take the top-level settings
+	Rotation          RotationConfig `yaml:"rotation" json:"rotation"`
+	RequestsPerSecond float64        `yaml:"requestsPerSecond" json:"requestsPerSecond"`
+}
+
+// ConfigError lists every problem found in a configuration.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+func (e *ConfigError) add(format string, a ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, a...))
+}
+
+// Load the configuration from path, which is a local file, an s3://bucket/key
+// URI or empty, apply environment variable overrides and validate it.
+func loadConfig(path string, client S3ClientAPI) (*Config, error) {
+	c := &Config{}
+	if path != "" {
+		b, err := readFileOrS3(path, client)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading configuration from %s: %s", path, err)
+		}
+
+		err = parseConfig(path, b, c)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing configuration from %s: %s", path, err)
+		}
+	}
+
+	problems := &ConfigError{}
+	c.applyEnv(problems)
+	c.applyDefaults()
+	c.validate(problems)
+	if len(problems.Problems) > 0 {
+		return nil, problems
+	}
+	return c, nil
+}
+
+// Read a local file or an s3://bucket/key URI
+func readFileOrS3(path string, client S3ClientAPI) ([]byte, error) {
+	if !strings.HasPrefix(path, "s3://") {
+		return os.ReadFile(path)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid S3 URI %s", path)
+	}
+	return downloadS3Object(parts[0], parts[1], client)
+}
+
+// Unknown fields are errors so that a misspelled field is not silently empty.
+func parseConfig(path string, b []byte, c *Config) error {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		return dec.Decode(c)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	return dec.Decode(c)
+}
+
+func overrideString(field *string, name string) {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		*field = v
+	}
+}
+
+func overrideList(field *[]string, name string) {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		*field = splitList(v)
+	}
+}
+
+func overrideInt(field *int, name string, problems *ConfigError) {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			problems.add("%s: %q is not a number", name, v)
+			return
+		}
+		*field = n
+	}
+}
+
+func overrideFloat(field *float64, name string, problems *ConfigError) {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			problems.add("%s: %q is not a number", name, v)
+			return
+		}
+		*field = n
+	}
+}
+
+func overrideBool(field *bool, name string, problems *ConfigError) {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			problems.add("%s: %q is not true or false", name, v)
+			return
+		}
+		*field = b
+	}
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Apply environment variables on top of the configuration file. ENVIRONMENTS
+// selects the environments to rotate, which need not appear in the file.
+// Each environment is overridden by variables named after it in upper case:
+//
+//	PORTALHOSTNAME<NAME>        portal hostname
+//	IDMHOSTNAME<NAME>           IDM hostname
+//	PORTALSHEETNAME<NAME>       portal sheet
+//	AUTOMATEDSHEETNAME<NAME>    automated sheet (PasswordManager-<NAME> if unset)
+//	<NAME>PORTALTESTINGSHEETNAMES  comma-separated testing sheets
+//	REQUESTSPERSECOND<NAME>     requests per second to the portal
+func (c *Config) applyEnv(problems *ConfigError) {
+	overrideString(&c.Bucket, "BUCKET")
+	overrideString(&c.Key, "KEY")
+	overrideString(&c.UsernameHeader, "USERNAMEHEADER")
+	overrideString(&c.PasswordHeader, "PASSWORDHEADER")
+	overrideString(&c.AutomatedSheetPassword, "AUTOMATEDSHEETPASSWORD")
+	overrideString(&c.WorkbookPassword, "WORKBOOKPASSWORD")
+	c.Rotation.applyEnv("", problems)
+
+	overrideBool(&c.Mail.Enabled, "MAILENABLED", problems)
+	overrideString(&c.Mail.Notify, "MAILNOTIFY")
+	overrideString(&c.Mail.SMTPHost, "MAILSMTPHOST")
+	overrideInt(&c.Mail.SMTPPort, "MAILSMTPPORT", problems)
+	overrideString(&c.Mail.SMTPAuth, "MAILSMTPAUTH")
+	overrideString(&c.Mail.SMTPUsername, "MAILSMTPUSERNAME")
+	overrideString(&c.Mail.SMTPPassword, "MAILSMTPPASSWORD")
+	overrideString(&c.Mail.SMTPTLS, "MAILSMTPTLS")
+	overrideString(&c.Mail.SMTPCAFile, "MAILSMTPCAFILE")
+	overrideBool(&c.Mail.SMTPSkipVerify, "MAILSMTPSKIPVERIFY", problems)
+	overrideString(&c.Mail.SMTPConnectTimeout, "MAILSMTPCONNECTTIMEOUT")
+	overrideString(&c.Mail.SubjectTemplate, "MAILSUBJECTTEMPLATE")
+	overrideString(&c.Mail.TextTemplate, "MAILTEXTTEMPLATE")
+	overrideString(&c.Mail.HTMLTemplate, "MAILHTMLTEMPLATE")
+	overrideString(&c.Mail.FromAddress, "MAILFROMADDRESS")
+	overrideString(&c.Mail.SenderName, "MAILSENDERNAME")
+	overrideList(&c.Mail.ToAddresses, "MAILTOADDRESSES")
+
+	for i := range c.Webhooks {
+		hook := &c.Webhooks[i]
+		suffix := strings.ToUpper(hook.Name)
+		overrideString(&hook.URL, "WEBHOOKURL"+suffix)
+		overrideString(&hook.Secret, "WEBHOOKSECRET"+suffix)
+	}
+
+	overrideInt(&c.Concurrency.Workers, "ROTATIONWORKERS", problems)
+	overrideInt(&c.Concurrency.UploadBatchSize, "UPLOADBATCHSIZE", problems)
+	overrideString(&c.Concurrency.UploadInterval, "UPLOADINTERVAL")
+	overrideFloat(&c.Concurrency.RequestsPerSecond, "REQUESTSPERSECOND", problems)
+	overrideString(&c.ReportPrefix, "REPORTPREFIX")
+	overrideString(&c.MetricsNamespace, "METRICSNAMESPACE")
+
+	names := []string{}
+	if v := os.Getenv("ENVIRONMENTS"); strings.TrimSpace(v) != "" {
+		names = strings.Split(v, ",")
+	} else if len(c.Environments) == 0 {
+		names = strings.Split(defaultEnvironments, ",")
+	}
+	if len(names) > 0 {
+		// the list in ENVIRONMENTS replaces the file's list
+		fromFile := map[Environment]EnvironmentConfig{}
+		for _, env := range c.Environments {
+			fromFile[env.Name] = env
+		}
+		envs := []EnvironmentConfig{}
+		for _, n := range names {
+			name := Environment(strings.ToLower(strings.TrimSpace(n)))
+			if name == "" {
+				continue
+			}
+			env, ok := fromFile[name]
+			if !ok {
+				env = EnvironmentConfig{Name: name}
+			}
+			envs = append(envs, env)
+		}
+		c.Environments = envs
+	}
+
+	for i := range c.Environments {
+		env := &c.Environments[i]
+		suffix := strings.ToUpper(env.Name.String())
+		overrideString(&env.PortalHostname, "PORTALHOSTNAME"+suffix)
+		overrideString(&env.IDMHostname, "IDMHOSTNAME"+suffix)
+		overrideString(&env.PortalSheet, "PORTALSHEETNAME"+suffix)
+		overrideString(&env.AutomatedSheet, "AUTOMATEDSHEETNAME"+suffix)
+		overrideList(&env.TestingSheets, suffix+"PORTALTESTINGSHEETNAMES")
+		env.Rotation.applyEnv(suffix, problems)
+		overrideFloat(&env.RequestsPerSecond, "REQUESTSPERSECOND"+suffix, problems)
+	}
+}
+
+// Rotation settings are overridden by MAXPASSWORDAGEDAYS, PASSWORDPOLICY,
+// PASSWORDLENGTH and EXCLUDECHARS, followed by suffix.
+func (r *RotationConfig) applyEnv(suffix string, problems *ConfigError) {
+	overrideInt(&r.MaxPasswordAgeDays, "MAXPASSWORDAGEDAYS"+suffix, problems)
+	overrideString(&r.PasswordPolicy, "PASSWORDPOLICY"+suffix)
+	overrideInt(&r.PasswordLength, "PASSWORDLENGTH"+suffix, problems)
+	overrideString(&r.ExcludeChars, "EXCLUDECHARS"+suffix)
+	overrideInt(&r.HeartbeatDays, "HEARTBEATDAYS"+suffix, problems)
+	overrideInt(&r.QuarantineAfter, "QUARANTINEAFTER"+suffix, problems)
+}
+
+func (r *RotationConfig) validate(prefix, suffix string, policies map[string]PasswordPolicy, problems *ConfigError) {
+	if r.MaxPasswordAgeDays < 1 {
+		problems.add("%srotation.maxPasswordAgeDays (MAXPASSWORDAGEDAYS%s) must be at least 1", prefix, suffix)
+	}
+	if r.HeartbeatDays < settingDisabled {
+		problems.add("%srotation.heartbeatDays (HEARTBEATDAYS%s) must be %d to disable heartbeats or more", prefix, suffix, settingDisabled)
+	}
+	if r.QuarantineAfter < settingDisabled {
+		problems.add("%srotation.quarantineAfter (QUARANTINEAFTER%s) must be %d to disable quarantine or more", prefix, suffix, settingDisabled)
+	}
+	policy, ok := r.passwordPolicy(policies)
+	if !ok {
+		problems.add("%srotation.passwordPolicy (PASSWORDPOLICY%s) %q is not one of %s", prefix, suffix, r.PasswordPolicy, strings.Join(policyNames(policies), ", "))
+		return
+	}
+	err := policy.check()
+	if err != nil {
+		problems.add("%spassword policy %s with rotation.passwordLength (PASSWORDLENGTH%s) and rotation.excludeChars (EXCLUDECHARS%s): %s", prefix, r.PasswordPolicy, suffix, suffix, err)
+	}
+}
+
+// Get the named password policy with the length and exclusions applied
+func (r *RotationConfig) passwordPolicy(policies map[string]PasswordPolicy) (PasswordPolicy, bool) {
+	policy, ok := policies[r.PasswordPolicy]
+	if !ok {
+		return PasswordPolicy{}, false
+	}
+	return policy.withOverrides(r.PasswordLength, r.ExcludeChars), true
+}
+
+// Get the built-in password policies and those in the configuration file
+func (c *Config) passwordPolicies() map[string]PasswordPolicy {
+	policies := map[string]PasswordPolicy{}
+	for name, policy := range passwordPolicies {
+		policies[name] = policy
+	}
+	for name, policy := range c.PasswordPolicies {
+		policies[name] = policy
+	}
+	return policies
+}
+
+func (c *Config) applyDefaults() {
+	if c.Rotation.MaxPasswordAgeDays == 0 {
+		c.Rotation.MaxPasswordAgeDays = maxPasswordAgeDays
+	}
+	if c.Rotation.PasswordPolicy == "" {
+		c.Rotation.PasswordPolicy = defaultPasswordPolicy
+	}
+	if c.Mail.SMTPPort == 0 {
+		c.Mail.SMTPPort = 25
+	}
+	if c.Mail.Notify == "" {
+		c.Mail.Notify = notifyAlways
+	}
+	if c.Mail.SMTPAuth == "" {
+		c.Mail.SMTPAuth = smtpAuthNone
+	}
+	if c.Mail.SMTPTLS == "" {
+		c.Mail.SMTPTLS = smtpTLSOpportunistic
+	}
+	if c.Mail.SMTPConnectTimeout == "" {
+		c.Mail.SMTPConnectTimeout = defaultSMTPConnectTimeout.String()
+	}
+	for i := range c.Webhooks {
+		hook := &c.Webhooks[i]
+		if hook.SignatureHeader == "" {
+			hook.SignatureHeader = defaultWebhookSignatureHeader
+		}
+		if hook.Notify == "" {
+			hook.Notify = notifyAlways
+		}
+		if hook.Timeout == "" {
+			hook.Timeout = defaultWebhookTimeout.String()
+		}
+	}
+	if c.Concurrency.Workers == 0 {
+		c.Concurrency.Workers = defaultWorkers
+	}
+	if c.Concurrency.UploadBatchSize == 0 {
+		c.Concurrency.UploadBatchSize = 1
+	}
+	if c.Concurrency.UploadInterval == "" {
+		c.Concurrency.UploadInterval = defaultUploadInterval.String()
+	}
+	if c.Concurrency.RequestsPerSecond == 0 {
+		c.Concurrency.RequestsPerSecond = defaultRequestsPerSecond
+	}
+	if c.ReportPrefix == "" {
+		c.ReportPrefix = defaultReportPrefix
+	}
+	if c.MetricsNamespace == "" {
+		c.MetricsNamespace = defaultMetricsNamespace
+	}
+	for i := range c.Environments {
+		env := &c.Environments[i]
+		if env.AutomatedSheet == "" {
+			env.AutomatedSheet = "PasswordManager-" + strings.ToUpper(env.Name.String())
+		}
+		if env.Rotation.MaxPasswordAgeDays == 0 {
+			env.Rotation.MaxPasswordAgeDays = c.Rotation.MaxPasswordAgeDays
+		}
+		if env.Rotation.PasswordPolicy == "" {
+			env.Rotation.PasswordPolicy = c.Rotation.PasswordPolicy
+		}
+		if env.Rotation.PasswordLength == 0 {
+			env.Rotation.PasswordLength = c.Rotation.PasswordLength
+		}
+		if env.Rotation.ExcludeChars == "" {
+			env.Rotation.ExcludeChars = c.Rotation.ExcludeChars
+		}
+		// settingDisabled overrides the top level
+		if env.Rotation.HeartbeatDays == 0 {
+			env.Rotation.HeartbeatDays = c.Rotation.HeartbeatDays
+		}
+		if env.Rotation.QuarantineAfter == 0 {
+			env.Rotation.QuarantineAfter = c.Rotation.QuarantineAfter
+		}
+		if env.RequestsPerSecond == 0 {
+			env.RequestsPerSecond = c.Concurrency.RequestsPerSecond
+		}
+	}
+}
+
+func (c *Config) validate(problems *ConfigError) {
+	required := []struct {
+		value string
+		field string
+		env   string
+	}{
+		{c.Bucket, "bucket", "BUCKET"},
+		{c.Key, "key", "KEY"},
+		{c.UsernameHeader, "usernameHeader", "USERNAMEHEADER"},
+		{c.PasswordHeader, "passwordHeader", "PASSWORDHEADER"},
+		{c.AutomatedSheetPassword, "automatedSheetPassword", "AUTOMATEDSHEETPASSWORD"},
+	}
+	for _, r := range required {
+		if r.value == "" {
+			problems.add("%s (%s) is required", r.field, r.env)
+		}
+	}
+	policies := c.passwordPolicies()
+	c.Rotation.validate("", "", policies, problems)
+
+	if strings.HasPrefix(c.ReportPrefix, "/") {
+		problems.add("reportPrefix (REPORTPREFIX) %q must not start with /", c.ReportPrefix)
+	}
+
+	if c.Mail.Enabled {
+		if c.Mail.SMTPHost == "" {
+			problems.add("mail.smtpHost (MAILSMTPHOST) is required when mail is enabled")
+		}
+		if c.Mail.SMTPPort < 1 || c.Mail.SMTPPort > 65535 {
+			problems.add("mail.smtpPort (MAILSMTPPORT) %d is not a valid port", c.Mail.SMTPPort)
+		}
+		if !contains(notifyPolicies, c.Mail.Notify) {
+			problems.add("mail.notify (MAILNOTIFY) %q is not one of %s", c.Mail.Notify, strings.Join(notifyPolicies, ", "))
+		}
+		if !contains(smtpAuthMechanisms, c.Mail.SMTPAuth) {
+			problems.add("mail.smtpAuth (MAILSMTPAUTH) %q is not one of %s", c.Mail.SMTPAuth, strings.Join(smtpAuthMechanisms, ", "))
+		} else if c.Mail.SMTPAuth != smtpAuthNone && (c.Mail.SMTPUsername == "" || c.Mail.SMTPPassword == "") {
+			problems.add("mail.smtpUsername (MAILSMTPUSERNAME) and mail.smtpPassword (MAILSMTPPASSWORD) are required for mail.smtpAuth %s", c.Mail.SMTPAuth)
+		}
+		if !contains(smtpTLSModes, c.Mail.SMTPTLS) {
+			problems.add("mail.smtpTLS (MAILSMTPTLS) %q is not one of %s", c.Mail.SMTPTLS, strings.Join(smtpTLSModes, ", "))
+		}
+		if c.Mail.SMTPCAFile != "" {
+			if _, err := smtpTLSConfig(c.Mail); err != nil {
+				problems.add("mail.smtpCAFile (MAILSMTPCAFILE): %s", err)
+			}
+		}
+		if d, err := time.ParseDuration(c.Mail.SMTPConnectTimeout); err != nil || d <= 0 {
+			problems.add("mail.smtpConnectTimeout (MAILSMTPCONNECTTIMEOUT) %q is not a positive duration such as 30s", c.Mail.SMTPConnectTimeout)
+		}
+		if c.Mail.SenderName == "" {
+			problems.add("mail.senderName (MAILSENDERNAME) is required when mail is enabled")
+		}
+		if _, err := mail.ParseAddress(c.Mail.FromAddress); err != nil {
+			problems.add("mail.fromAddress (MAILFROMADDRESS) %q is not a valid address", c.Mail.FromAddress)
+		}
+		if len(c.Mail.ToAddresses) == 0 && len(c.Mail.Groups) == 0 {
+			problems.add("mail.toAddresses (MAILTOADDRESSES) or mail.groups is required when mail is enabled")
+		}
+		for _, addr := range c.Mail.ToAddresses {
+			if _, err := mail.ParseAddress(addr); err != nil {
+				problems.add("mail.toAddresses (MAILTOADDRESSES) %q is not a valid address", addr)
+			}
+		}
+		groups := map[string]bool{}
+		for _, g := range c.Mail.Groups {
+			if !mailGroupNamePattern.MatchString(g.Name) {
+				problems.add("mail group name %q must be lower case letters, digits and dashes", g.Name)
+				continue
+			}
+			if groups[g.Name] {
+				problems.add("mail group %s is listed more than once", g.Name)
+				continue
+			}
+			groups[g.Name] = true
+			if len(g.ToAddresses) == 0 {
+				problems.add("mail group %s: toAddresses is required", g.Name)
+			}
+			for _, addr := range g.ToAddresses {
+				if _, err := mail.ParseAddress(addr); err != nil {
+					problems.add("mail group %s: toAddresses %q is not a valid address", g.Name, addr)
+				}
+			}
+			if len(g.Environments) == 0 && len(g.Sheets) == 0 {
+				problems.add("mail group %s: environments or sheets is required", g.Name)
+			}
+			for _, env := range g.Environments {
+				if !environmentNamePattern.MatchString(env.String()) {
+					problems.add("mail group %s: environment name %q must be lower case letters and digits", g.Name, env)
+				}
+			}
+		}
+	}
+
+	hooks := map[string]bool{}
+	for _, hook := range c.Webhooks {
+		if !environmentNamePattern.MatchString(hook.Name) {
+			problems.add("webhook name %q must be lower case letters and digits", hook.Name)
+			continue
+		}
+		if hooks[hook.Name] {
+			problems.add("webhook %s is listed more than once", hook.Name)
+			continue
+		}
+		hooks[hook.Name] = true
+		suffix := strings.ToUpper(hook.Name)
+		if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			problems.add("webhook %s: url (WEBHOOKURL%s) is not an http or https URL", hook.Name, suffix)
+		}
+		if !headerNamePattern.MatchString(hook.SignatureHeader) {
+			problems.add("webhook %s: signatureHeader %q is not a header name", hook.Name, hook.SignatureHeader)
+		}
+		if !contains(notifyPolicies, hook.Notify) {
+			problems.add("webhook %s: notify %q is not one of %s", hook.Name, hook.Notify, strings.Join(notifyPolicies, ", "))
+		}
+		for _, env := range hook.Environments {
+			if !environmentNamePattern.MatchString(env.String()) {
+				problems.add("webhook %s: environment name %q must be lower case letters and digits", hook.Name, env)
+			}
+		}
+		if d, err := time.ParseDuration(hook.Timeout); err != nil || d <= 0 {
+			problems.add("webhook %s: timeout %q is not a positive duration such as 10s", hook.Name, hook.Timeout)
+		}
+	}
+
+	if c.Concurrency.Workers < 1 {
+		problems.add("concurrency.workers (ROTATIONWORKERS) must be at least 1")
+	}
+	if c.Concurrency.UploadBatchSize < 1 {
+		problems.add("concurrency.uploadBatchSize (UPLOADBATCHSIZE) must be at least 1")
+	}
+	if d, err := time.ParseDuration(c.Concurrency.UploadInterval); err != nil || d <= 0 {
+		problems.add("concurrency.uploadInterval (UPLOADINTERVAL) %q is not a positive duration such as 10s", c.Concurrency.UploadInterval)
+	}
+
+	if len(c.Environments) == 0 {
+		problems.add("environments (ENVIRONMENTS) lists no environments")
+	}
+	seen := map[Environment]bool{}
+	automatedSheets := map[string]Environment{}
+	for _, env := range c.Environments {
+		if !environmentNamePattern.MatchString(env.Name.String()) {
+			problems.add("environment name %q must be lower case letters and digits", env.Name)
+			continue
+		}
+		if seen[env.Name] {
+			problems.add("environment %s is listed more than once", env.Name)
+			continue
+		}
+		seen[env.Name] = true
+
+		suffix := strings.ToUpper(env.Name.String())
+		if env.PortalHostname == "" {
+			problems.add("environment %s: portalHostname (PORTALHOSTNAME%s) is required", env.Name, suffix)
+		}
+		if env.IDMHostname == "" {
+			problems.add("environment %s: idmHostname (IDMHOSTNAME%s) is required", env.Name, suffix)
+		}
+		if env.PortalSheet == "" {
+			problems.add("environment %s: portalSheet (PORTALSHEETNAME%s) is required", env.Name, suffix)
+		}
+		env.Rotation.validate(fmt.Sprintf("environment %s: ", env.Name), suffix, policies, problems)
+		if env.RequestsPerSecond <= 0 {
+			problems.add("environment %s: requestsPerSecond (REQUESTSPERSECOND%s) must be more than 0", env.Name, suffix)
+		}
+		if other, ok := automatedSheets[env.AutomatedSheet]; ok {
+			problems.add("environment %s: automatedSheet %s is also used by environment %s", env.Name, env.AutomatedSheet, other)
+		}
+		automatedSheets[env.AutomatedSheet] = env.Name
+	}
+}
+
+// Build the run's input and the portal for each environment.
+func (c *Config) input() (*Input, map[Environment]*Portal) {
+	envToPortal := make(map[Environment]*Portal, len(c.Environments))
+	sheetGroups := make(map[Environment]SheetGroup, len(c.Environments))
+	policies := make(map[Environment]UserPolicy, len(c.Environments))
+	passwordPolicies := c.passwordPolicies()
+	for _, env := range c.Environments {
+		envToPortal[env.Name] = &Portal{
+			Hostname:    env.PortalHostname,
+			IDMHostname: env.IDMHostname,
+			Scheme:      "https://",
+			env:         env.Name,
+			limiter:     newRateLimiter(env.RequestsPerSecond),
+		}
+		testingSheets := env.TestingSheets
+		if testingSheets == nil {
+			testingSheets = []string{}
+		}
+		sheetGroups[env.Name] = SheetGroup{
+			AutomatedSheetName: env.AutomatedSheet,
+			PortalSheetName:    env.PortalSheet,
+			TestingSheetNames:  testingSheets,
+		}
+		passwordPolicy, _ := env.Rotation.passwordPolicy(passwordPolicies)
+		policies[env.Name] = UserPolicy{
+			MaxAgeDays:    env.Rotation.MaxPasswordAgeDays,
+			Password:      passwordPolicy,
+			HeartbeatDays: env.Rotation.HeartbeatDays,
+
+			QuarantineAfter: env.Rotation.QuarantineAfter,
+		}
+	}
+
+	registerSecret(c.AutomatedSheetPassword, c.WorkbookPassword, c.Mail.SMTPPassword)
+	for _, hook := range c.Webhooks {
+		// a chat webhook's URL is as good as a password
+		registerSecret(hook.URL, hook.Secret)
+	}
+
+	// checked by validate
+	uploadInterval, _ := time.ParseDuration(c.Concurrency.UploadInterval)
+
+	input := &Input{
+		UsernameHeader:         c.UsernameHeader,
+		PasswordHeader:         c.PasswordHeader,
+		Bucket:                 c.Bucket,
+		Key:                    c.Key,
+		AutomatedSheetPassword: c.AutomatedSheetPassword,
+		WorkbookPassword:       c.WorkbookPassword,
+		Policies:               policies,
+		Mail:                   c.Mail,
+		Webhooks:               c.Webhooks,
+		Workers:                c.Concurrency.Workers,
+		UploadBatchSize:        c.Concurrency.UploadBatchSize,
+		UploadInterval:         uploadInterval,
+		ReportPrefix:           c.ReportPrefix,
+		MetricsNamespace:       c.MetricsNamespace,
+		AutomatedSheetColNameToIndex: map[Column]int{
+			ColUser: 0, ColPassword: 1, ColPrevious: 2, ColTimestamp: 3},
+		AutomatedSheetColNameToHeading: map[Column]string{
+			ColUser: ColUserHeading, ColPassword: ColPasswordHeading,
+			ColPrevious: ColPreviousHeading, ColTimestamp: ColTimestampHeading},
+		RowOffset:   1,
+		SheetGroups: sheetGroups,
+	}
+	return input, envToPortal
+}
+
+func sortedEnvironments(envToPortal map[Environment]*Portal) []Environment {
+	envs := make([]Environment, 0, len(envToPortal))
+	for env := range envToPortal {
+		envs = append(envs, env)
+	}
+	sort.Slice(envs, func(i, j int) bool { return envs[i] < envs[j] })
+	return envs
+}
+
+func sortedSheetGroups(input *Input) []Environment {
+	envs := make([]Environment, 0, len(input.SheetGroups))
+	for env := range input.SheetGroups {
+		envs = append(envs, env)
+	}
+	sort.Slice(envs, func(i, j int) bool { return envs[i] < envs[j] })
+	return envs
+}
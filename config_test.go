@@ -0,0 +1,391 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setenv(t *testing.T, vars map[string]string) {
+	for k, v := range vars {
+		old, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+		k := k
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(k, old)
+			} else {
+				os.Unsetenv(k)
+			}
+		})
+	}
+}
+
+const yamlConfig = `
+bucket: test-bucket
+key: accounts.xlsx
+usernameHeader: Username
+passwordHeader: Password
+automatedSheetPassword: secret
+rotation:
+  maxPasswordAgeDays: 14
+passwordPolicies:
+  long:
+    minLength: 20
+    maxLength: 24
+    requiredClasses: [digit, upper, lower]
+    specials: "!@#"
+mail:
+  enabled: true
+  smtpHost: smtp.example.com
+  fromAddress: rotation@example.com
+  senderName: Password Rotation
+  toAddresses: [testers@example.com]
+webhooks:
+  - name: ops
+    url: https://hooks.example.com/services/T0/B0/x
+    environments: [impl]
+    notify: on-failure
+concurrency:
+  workers: 8
+  uploadInterval: 30s
+environments:
+  - name: dev
+    portalHostname: portaldev.example.com
+    idmHostname: idmdev.example.com
+    portalSheet: Portal-DEV
+    testingSheets: [DEV, TEST]
+  - name: impl
+    portalHostname: portalimpl.example.com
+    idmHostname: idmimpl.example.com
+    portalSheet: Portal-IMPL
+    automatedSheet: Managed-IMPL
+    requestsPerSecond: 2.5
+    rotation:
+      passwordPolicy: long
+      excludeChars: O0lI1
+`
+
+const jsonConfig = `{
+	"bucket": "test-bucket",
+	"key": "accounts.xlsx",
+	"usernameHeader": "Username",
+	"passwordHeader": "Password",
+	"automatedSheetPassword": "secret",
+	"rotation": {"maxPasswordAgeDays": 14},
+	"passwordPolicies": {
+		"long": {
+			"minLength": 20,
+			"maxLength": 24,
+			"requiredClasses": ["digit", "upper", "lower"],
+			"specials": "!@#"
+		}
+	},
+	"mail": {
+		"enabled": true,
+		"smtpHost": "smtp.example.com",
+		"fromAddress": "rotation@example.com",
+		"senderName": "Password Rotation",
+		"toAddresses": ["testers@example.com"]
+	},
+	"webhooks": [
+		{
+			"name": "ops",
+			"url": "https://hooks.example.com/services/T0/B0/x",
+			"environments": ["impl"],
+			"notify": "on-failure"
+		}
+	],
+	"concurrency": {"workers": 8, "uploadInterval": "30s"},
+	"environments": [
+		{
+			"name": "dev",
+			"portalHostname": "portaldev.example.com",
+			"idmHostname": "idmdev.example.com",
+			"portalSheet": "Portal-DEV",
+			"testingSheets": ["DEV", "TEST"]
+		},
+		{
+			"name": "impl",
+			"portalHostname": "portalimpl.example.com",
+			"idmHostname": "idmimpl.example.com",
+			"portalSheet": "Portal-IMPL",
+			"automatedSheet": "Managed-IMPL",
+			"requestsPerSecond": 2.5,
+			"rotation": {"passwordPolicy": "long", "excludeChars": "O0lI1"}
+		}
+	]
+}`
+
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	expected := &Config{
+		Bucket:                 "test-bucket",
+		Key:                    "accounts.xlsx",
+		UsernameHeader:         "Username",
+		PasswordHeader:         "Password",
+		AutomatedSheetPassword: "secret",
+		Rotation:               RotationConfig{MaxPasswordAgeDays: 14, PasswordPolicy: "default"},
+		PasswordPolicies: map[string]PasswordPolicy{
+			"long": {
+				MinLength:       20,
+				MaxLength:       24,
+				RequiredClasses: []string{ClassDigit, ClassUpper, ClassLower},
+				Specials:        "!@#",
+			},
+		},
+		Mail: MailConfig{
+			Enabled:            true,
+			SMTPHost:           "smtp.example.com",
+			Notify:             "always",
+			SMTPPort:           25,
+			SMTPAuth:           "none",
+			SMTPTLS:            "opportunistic",
+			SMTPConnectTimeout: "30s",
+			FromAddress:        "rotation@example.com",
+			SenderName:         "Password Rotation",
+			ToAddresses:        []string{"testers@example.com"},
+		},
+		Webhooks: []WebhookConfig{
+			{
+				Name:            "ops",
+				URL:             "https://hooks.example.com/services/T0/B0/x",
+				SignatureHeader: "X-Signature-256",
+				Notify:          "on-failure",
+				Environments:    []Environment{"impl"},
+				Timeout:         "10s",
+			},
+		},
+		Concurrency: ConcurrencyConfig{
+			Workers:           8,
+			UploadBatchSize:   1,
+			UploadInterval:    "30s",
+			RequestsPerSecond: 10,
+		},
+		ReportPrefix:     "reports/",
+		MetricsNamespace: "portal-test-user-manager",
+		Environments: []EnvironmentConfig{
+			{
+				Name:              "dev",
+				PortalHostname:    "portaldev.example.com",
+				IDMHostname:       "idmdev.example.com",
+				PortalSheet:       "Portal-DEV",
+				AutomatedSheet:    "PasswordManager-DEV",
+				TestingSheets:     []string{"DEV", "TEST"},
+				Rotation:          RotationConfig{MaxPasswordAgeDays: 14, PasswordPolicy: "default"},
+				RequestsPerSecond: 10,
+			},
+			{
+				Name:              "impl",
+				PortalHostname:    "portalimpl.example.com",
+				IDMHostname:       "idmimpl.example.com",
+				PortalSheet:       "Portal-IMPL",
+				AutomatedSheet:    "Managed-IMPL",
+				Rotation:          RotationConfig{MaxPasswordAgeDays: 14, PasswordPolicy: "long", ExcludeChars: "O0lI1"},
+				RequestsPerSecond: 2.5,
+			},
+		},
+	}
+
+	s3Client := &MemS3Client{Objects: map[string][]byte{"config.yaml": []byte(yamlConfig)}}
+	for _, path := range []string{
+		writeConfig(t, "config.yaml", yamlConfig),
+		writeConfig(t, "config.json", jsonConfig),
+		"s3://" + inputBucket + "/config.yaml",
+	} {
+		c, err := loadConfig(path, s3Client)
+		if err != nil {
+			t.Fatalf("Error loading %s: %s", path, err)
+		}
+		if !reflect.DeepEqual(c, expected) {
+			t.Fatalf("Loading %s:\nexpected %+v\ngot      %+v", path, expected, c)
+		}
+	}
+
+	// environment variables override the file
+	setenv(t, map[string]string{
+		"ENVIRONMENTS":               "impl,val",
+		"MAILSMTPPORT":               "587",
+		"PORTALHOSTNAMEIMPL":         "other.example.com",
+		"PORTALHOSTNAMEVAL":          "portalval.example.com",
+		"IDMHOSTNAMEVAL":             "idmval.example.com",
+		"PORTALSHEETNAMEVAL":         "Portal-VAL",
+		"VALPORTALTESTINGSHEETNAMES": "TRAINING, IMPLP",
+		"MAXPASSWORDAGEDAYSVAL":      "30",
+		"PASSWORDPOLICYVAL":          "strict",
+		"PASSWORDLENGTHVAL":          "18",
+		"HEARTBEATDAYSVAL":           "14",
+		"QUARANTINEAFTERVAL":         "3",
+		"REQUESTSPERSECONDVAL":       "5",
+		"UPLOADBATCHSIZE":            "3",
+		"REPORTPREFIX":               "audit/rotation/",
+		"WEBHOOKSECRETOPS":           "signing-key",
+	})
+	c, err := loadConfig(writeConfig(t, "config.yaml", yamlConfig), s3Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Mail.SMTPPort != 587 {
+		t.Fatalf("Expected MAILSMTPPORT to override the port; got %d", c.Mail.SMTPPort)
+	}
+	if c.Concurrency.UploadBatchSize != 3 || c.Concurrency.Workers != 8 {
+		t.Fatalf("Expected UPLOADBATCHSIZE to override the batch size; got %+v", c.Concurrency)
+	}
+	if c.Webhooks[0].Secret != "signing-key" {
+		t.Fatalf("Expected WEBHOOKSECRETOPS to set the webhook secret; got %+v", c.Webhooks[0])
+	}
+	if c.ReportPrefix != "audit/rotation/" {
+		t.Fatalf("Expected REPORTPREFIX to override the report prefix; got %q", c.ReportPrefix)
+	}
+	expectedEnvs := []EnvironmentConfig{
+		{
+			Name:              "impl",
+			PortalHostname:    "other.example.com",
+			IDMHostname:       "idmimpl.example.com",
+			PortalSheet:       "Portal-IMPL",
+			AutomatedSheet:    "Managed-IMPL",
+			Rotation:          RotationConfig{MaxPasswordAgeDays: 14, PasswordPolicy: "long", ExcludeChars: "O0lI1"},
+			RequestsPerSecond: 2.5,
+		},
+		{
+			Name:              "val",
+			PortalHostname:    "portalval.example.com",
+			IDMHostname:       "idmval.example.com",
+			PortalSheet:       "Portal-VAL",
+			AutomatedSheet:    "PasswordManager-VAL",
+			TestingSheets:     []string{"TRAINING", "IMPLP"},
+			Rotation:          RotationConfig{MaxPasswordAgeDays: 30, PasswordPolicy: "strict", PasswordLength: 18, HeartbeatDays: 14, QuarantineAfter: 3},
+			RequestsPerSecond: 5,
+		},
+	}
+	if !reflect.DeepEqual(c.Environments, expectedEnvs) {
+		t.Fatalf("Expected environments %+v; got %+v", expectedEnvs, c.Environments)
+	}
+
+	input, envToPortal := c.input()
+	if len(envToPortal) != 2 || envToPortal["val"].Hostname != "portalval.example.com" {
+		t.Fatalf("Unexpected portals %+v", envToPortal)
+	}
+	if input.SheetGroups["impl"].AutomatedSheetName != "Managed-IMPL" || input.Policies["impl"].MaxAgeDays != 14 ||
+		input.UploadInterval != 30*time.Second || envToPortal["impl"].limiter.interval != 400*time.Millisecond {
+		t.Fatalf("Unexpected input %+v", input)
+	}
+	if p := input.Policies["impl"].Password; p.MinLength != 20 || p.Exclude != "O0lI1" {
+		t.Fatalf("Expected policy long excluding O0lI1 for impl; got %+v", p)
+	}
+	if input.Policies["val"].HeartbeatDays != 14 || input.Policies["impl"].HeartbeatDays != 0 {
+		t.Fatalf("Expected heartbeats every 14 days in val only; got %+v", input.Policies)
+	}
+	if input.Policies["val"].QuarantineAfter != 3 || input.Policies["impl"].QuarantineAfter != 0 {
+		t.Fatalf("Expected quarantine after 3 failed logins in val only; got %+v", input.Policies)
+	}
+	if p := input.Policies["val"].Password; p.MinLength != 18 || p.MaxLength != 18 || !p.NoRepeats {
+		t.Fatalf("Expected policy strict with length 18 for val; got %+v", p)
+	}
+}
+
+func TestLoadConfigDisabledSettings(t *testing.T) {
+	// val turns off the heartbeats and quarantine that impl inherits
+	setenv(t, map[string]string{
+		"ENVIRONMENTS":       "impl,val",
+		"HEARTBEATDAYS":      "7",
+		"QUARANTINEAFTER":    "5",
+		"HEARTBEATDAYSVAL":   "-1",
+		"QUARANTINEAFTERVAL": "-1",
+		"PORTALHOSTNAMEVAL":  "portalval.example.com",
+		"IDMHOSTNAMEVAL":     "idmval.example.com",
+		"PORTALSHEETNAMEVAL": "Portal-VAL",
+	})
+	c, err := loadConfig(writeConfig(t, "config.yaml", yamlConfig), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, _ := c.input()
+	if p := input.Policies["impl"]; p.HeartbeatDays != 7 || p.QuarantineAfter != 5 {
+		t.Fatalf("Expected impl to inherit heartbeats and quarantine; got %+v", p)
+	}
+	if p := input.Policies["val"]; heartbeatDue("", format(-1000*Day), time.Now(), p.HeartbeatDays) ||
+		!loginAllowed(lockoutState{failedLogins: 1000}, 1, p.QuarantineAfter) {
+		t.Fatalf("Expected no heartbeats or quarantine in val; got %+v", p)
+	}
+
+	setenv(t, map[string]string{"HEARTBEATDAYSVAL": "-2"})
+	_, err = loadConfig(writeConfig(t, "config.yaml", yamlConfig), nil)
+	if err == nil || !strings.Contains(err.Error(), "environment val: rotation.heartbeatDays (HEARTBEATDAYSVAL) must be -1 to disable heartbeats or more") {
+		t.Fatalf("Expected an error for HEARTBEATDAYSVAL=-2; got %v", err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	// every problem is reported at once
+	setenv(t, map[string]string{"PASSWORDLENGTHVAL": "4", "PASSWORDPOLICYPROD": "missing", "UPLOADINTERVAL": "soon", "REQUESTSPERSECONDDEV": "-1", "REPORTPREFIX": "/reports", "MAILSMTPAUTH": "login", "MAILSMTPTLS": "ssl", "MAILNOTIFY": "sometimes", "HEARTBEATDAYS": "-2", "QUARANTINEAFTER": "-2"})
+	_, err := loadConfig(writeConfig(t, "config.yaml", "mail:\n  enabled: true\n  fromAddress: nobody\n  groups:\n    - name: VAL\n    - name: val\n      toAddresses: [nobody]\n    - name: val\nwebhooks:\n  - name: ops\n    url: hooks.example.com\n    signatureHeader: X Signature\n    notify: sometimes\n    environments: [Prod]\n  - name: ops\n"), nil)
+	if err == nil {
+		t.Fatal("Expected an error for an incomplete configuration")
+	}
+	for _, problem := range []string{
+		"bucket (BUCKET) is required",
+		"key (KEY) is required",
+		"automatedSheetPassword (AUTOMATEDSHEETPASSWORD) is required",
+		"mail.smtpHost (MAILSMTPHOST) is required",
+		`mail.fromAddress (MAILFROMADDRESS) "nobody" is not a valid address`,
+		"environment dev: portalHostname (PORTALHOSTNAMEDEV) is required",
+		"environment prod: portalSheet (PORTALSHEETNAMEPROD) is required",
+		"environment val: password policy default with rotation.passwordLength (PASSWORDLENGTHVAL) and rotation.excludeChars (EXCLUDECHARSVAL): password length 4 to 4 is not between 8 and 64",
+		`environment prod: rotation.passwordPolicy (PASSWORDPOLICYPROD) "missing" is not one of default, strict`,
+		`concurrency.uploadInterval (UPLOADINTERVAL) "soon" is not a positive duration such as 10s`,
+		"environment dev: requestsPerSecond (REQUESTSPERSECONDDEV) must be more than 0",
+		`reportPrefix (REPORTPREFIX) "/reports" must not start with /`,
+		`mail group name "VAL" must be lower case letters, digits and dashes`,
+		`mail group val: toAddresses "nobody" is not a valid address`,
+		"mail group val: environments or sheets is required",
+		"mail group val is listed more than once",
+		"mail.smtpUsername (MAILSMTPUSERNAME) and mail.smtpPassword (MAILSMTPPASSWORD) are required for mail.smtpAuth login",
+		`mail.smtpTLS (MAILSMTPTLS) "ssl" is not one of opportunistic, starttls, implicit`,
+		`mail.notify (MAILNOTIFY) "sometimes" is not one of always, on-change, on-failure, never`,
+		"rotation.heartbeatDays (HEARTBEATDAYS) must be -1 to disable heartbeats or more",
+		"rotation.quarantineAfter (QUARANTINEAFTER) must be -1 to disable quarantine or more",
+		"webhook ops: url (WEBHOOKURLOPS) is not an http or https URL",
+		`webhook ops: signatureHeader "X Signature" is not a header name`,
+		`webhook ops: notify "sometimes" is not one of always, on-change, on-failure, never`,
+		`webhook ops: environment name "Prod" must be lower case letters and digits`,
+		"webhook ops is listed more than once",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("Expected %q in error:\n%s", problem, err)
+		}
+	}
+
+	// misspelled fields are rejected
+	for name, content := range map[string]string{
+		"config.yaml": "bucket: b\nbuckett: b\n",
+		"config.json": `{"bucket": "b", "buckett": "b"}`,
+	} {
+		_, err = loadConfig(writeConfig(t, name, content), nil)
+		if err == nil || !strings.Contains(err.Error(), "buckett") {
+			t.Fatalf("Expected an error for an unknown field in %s; got %v", name, err)
+		}
+	}
+
+	for names, problem := range map[string]string{
+		"dev,dev":   "environment dev is listed more than once",
+		"dev,val-2": `environment name "val-2" must be lower case letters and digits`,
+	} {
+		setenv(t, map[string]string{"ENVIRONMENTS": names, "MAILSMTPPORT": "smtp"})
+		_, err = loadConfig("", nil)
+		if err == nil || !strings.Contains(err.Error(), problem) || !strings.Contains(err.Error(), `MAILSMTPPORT: "smtp" is not a number`) {
+			t.Fatalf("Expected errors for ENVIRONMENTS=%q and MAILSMTPPORT=smtp; got %v", names, err)
+		}
+	}
+}
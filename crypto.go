@@ -1,11 +1,18 @@
 package main
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"math/big"
 	"math/rand"
 
 	crand "crypto/rand"
+
+	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
@@ -14,12 +21,16 @@ const (
 	lowers         = "abcdefghijklmnopqrstuvwxyz"
 	specials       = "~=+%^*[]{}!@#$|" // must exclude ?<>()/\& space ' "
 	all            = digits + uppers + lowers + specials
-	passwordLength = 12
+	passwordLength = 12 // default
+
+	minPasswordLength = 8
+	maxPasswordLength = 64
 )
 
 type cryptoSource struct{}
 
 var ErrCryptoSourceFailure = fmt.Errorf("error generating crpyto random source")
+var ErrSecretTooShort = fmt.Errorf("encrypted secret is too short")
 var src cryptoSource
 var rnd = rand.New(src)
 
@@ -33,29 +44,66 @@ func (s cryptoSource) Int63() int64 {
 	return bigInt.Int64()
 }
 
-func getRandomPassword() (passwd string, err error) {
-	defer func() (string, error) {
-		if rerr := recover(); rerr != nil && fmt.Sprint(rerr) == ErrCryptoSourceFailure.Error() {
-			return "", ErrCryptoSourceFailure
-		} else if rerr != nil {
-			panic(rerr)
-		}
-		return passwd, nil
-	}()
-
-	buf := make([]byte, passwordLength)
-	buf[0] = digits[rnd.Intn(len(digits))]
-	buf[1] = specials[rnd.Intn(len(specials))]
-	buf[2] = uppers[rnd.Intn(len(uppers))]
-	buf[3] = lowers[rnd.Intn(len(lowers))]
-	for i := 4; i < passwordLength; i++ {
-		buf[i] = all[rnd.Intn(len(all))]
-	}
-
-	rnd.Shuffle(len(buf), func(i, j int) {
-		buf[i], buf[j] = buf[j], buf[i]
-	})
-
-	passwd = string(buf)
-	return passwd, nil
+const (
+	secretSaltLength    = 16
+	secretKeyIterations = 100000
+)
+
+// Encrypt a secret with AES-256-GCM using a key derived from password. The
+// result is base64 and carries its own salt and nonce.
+func encryptSecret(password, plaintext string) (string, error) {
+	salt := make([]byte, secretSaltLength)
+	_, err := io.ReadFull(crand.Reader, salt)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := secretCipher(password, salt)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(crand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	out := append(salt, nonce...)
+	out = gcm.Seal(out, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+func decryptSecret(password, ciphertext string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < secretSaltLength {
+		return "", ErrSecretTooShort
+	}
+
+	gcm, err := secretCipher(password, data[:secretSaltLength])
+	if err != nil {
+		return "", err
+	}
+	data = data[secretSaltLength:]
+	if len(data) < gcm.NonceSize() {
+		return "", ErrSecretTooShort
+	}
+
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func secretCipher(password string, salt []byte) (cipher.AEAD, error) {
+	key := pbkdf2.Key([]byte(password), salt, secretKeyIterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// classifications of a failed portal request
+var (
+	ErrInvalidCredentials     = errors.New("invalid credentials")
+	ErrAccountLocked          = errors.New("account locked")
+	ErrPasswordPolicyRejected = errors.New("password rejected by policy")
+	ErrPasswordExpired        = errors.New("password expired")
+	ErrMFARequired            = errors.New("MFA required")
+	ErrTransient              = errors.New("transient error")
+	ErrUnexpected             = errors.New("unexpected response")
+)
+
+// portal request settings; variables so that tests can shorten them
+var (
+	requestTimeout     = 30 * time.Second
+	maxRequestAttempts = 4
+	retryBaseDelay     = 500 * time.Millisecond
+	retryMaxDelay      = 8 * time.Second
+)
+
+// IDM (Okta) error codes that identify a failure
+var (
+	lockedCodes = []string{"E0000069", "E0000119"}
+	policyCodes = []string{"E0000080", "E0000014"}
+	mfaCodes    = []string{"E0000068", "E0000082"}
+)
+
+// idmError is the JSON body of an IDM (Okta) error response.
+type idmError struct {
+	ErrorCode string `json:"errorCode"`
+	Status    string `json:"status"`
+}
+
+// PortalError is a failed portal request, classified by Kind so that callers
+// can test it with errors.Is.
+type PortalError struct {
+	Kind       error // one of the Err* classifications
+	StatusCode int   // 0 if no response was received
+	Body       string
+	Code       string // the IDM error code or authentication status, such as E0000069 or LOCKED_OUT; empty if IDM gave none
+	Err        error  // the transport error if no response was received
+}
+
+func (e *PortalError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s: %s", e.Kind, redact(e.Err.Error()))
+	}
+	return fmt.Sprintf("got HTTP status code %d with body: %s", e.StatusCode, sanitizeBody(e.Body))
+}
+
+func (e *PortalError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *PortalError) Unwrap() error {
+	return e.Err
+}
+
+// Classify a response with a status code outside 2xx. Only the error code or
+// status of an IDM JSON body identifies a locked account, a rejected password
+// or a rejected TOTP code; other bodies, such as a CDN's HTML error page, are
+// classified by status code alone.
+func classifyResponse(statusCode int, body string) *PortalError {
+	e := &PortalError{StatusCode: statusCode, Body: body, Kind: ErrUnexpected}
+	idm := idmError{}
+	if json.Unmarshal([]byte(body), &idm) == nil {
+		e.Code = idm.ErrorCode
+		if e.Code == "" {
+			e.Code = idm.Status
+		}
+	}
+	switch {
+	case statusCode == http.StatusTooManyRequests || statusCode == http.StatusBadGateway ||
+		statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout:
+		e.Kind = ErrTransient
+	case contains(lockedCodes, idm.ErrorCode) || idm.Status == "LOCKED_OUT":
+		e.Kind = ErrAccountLocked
+	case contains(policyCodes, idm.ErrorCode):
+		e.Kind = ErrPasswordPolicyRejected
+	case contains(mfaCodes, idm.ErrorCode):
+		// a rejected TOTP code; the password was accepted
+		e.Kind = ErrMFARequired
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		e.Kind = ErrInvalidCredentials
+	}
+	return e
+}
+
+// Classify an error from sending a request. Everything but cancellation of
+// the run is assumed to be a network problem worth retrying.
+func classifyTransportError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return &PortalError{Kind: ErrTransient, Err: err}
+}
+
+// Whether a failed request can be sent again. A POST that timed out may have
+// been processed, so it is only retried if the server refused it.
+func retryable(method string, err error) bool {
+	if !errors.Is(err, ErrTransient) {
+		return false
+	}
+	if method == http.MethodGet {
+		return true
+	}
+	var portalErr *PortalError
+	return errors.As(err, &portalErr) &&
+		(portalErr.StatusCode == http.StatusTooManyRequests || portalErr.StatusCode == http.StatusServiceUnavailable)
+}
+
+// The wait before retry attempt (counting from 1): exponential backoff with
+// full jitter
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt-1)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// A short name for the classification of err, for the run summary
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidCredentials):
+		return "invalid credentials"
+	case errors.Is(err, ErrAccountLocked):
+		return "account locked"
+	case errors.Is(err, ErrPasswordPolicyRejected):
+		return "policy rejected"
+	case errors.Is(err, ErrPasswordExpired):
+		return "password expired"
+	case errors.Is(err, ErrMFARequired):
+		return "mfa required"
+	case errors.Is(err, ErrTransient):
+		return "transient"
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return "cancelled"
+	}
+	return "other"
+}
@@ -3,11 +3,10 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/xuri/excelize/v2"
@@ -55,9 +54,16 @@ func validateSheetCols(f *excelize.File, input *Input, group SheetGroup, sheetNa
 			return err
 		}
 		header := rows[0]
-		// check number of cols
-		if len(header) != len(input.AutomatedSheetColNameToIndex) {
-			return fmt.Errorf("Expected sheet %s to have %d cols; it has %d cols", sheetName, len(input.AutomatedSheetColNameToIndex), len(header))
+		// check number of cols, not counting optional policy, last login,
+		// status, lockout and TOTP secret cols
+		numCols := 0
+		for _, heading := range header {
+			if !contains(policyHeadings, heading) && !contains(trackingHeadings, heading) && heading != ColTOTPSecretHeading {
+				numCols++
+			}
+		}
+		if numCols != len(input.AutomatedSheetColNameToIndex) {
+			return fmt.Errorf("Expected sheet %s to have %d cols; it has %d cols", sheetName, len(input.AutomatedSheetColNameToIndex), numCols)
 		}
 		// check col headings and indexes
 		for col, index := range input.AutomatedSheetColNameToIndex {
@@ -71,16 +77,7 @@ func validateSheetCols(f *excelize.File, input *Input, group SheetGroup, sheetNa
 	return nil
 }
 
-func getTestingSheets(envVar string) []string {
-	sheets := os.Getenv(envVar)
-	if sheets == "" {
-		return []string{}
-	}
-
-	return strings.Split(sheets, ",")
-}
-
-func updateTestingSheets(f *excelize.File, input *Input, env Environment, client S3ClientAPI) error {
+func updateTestingSheets(f *excelize.File, input *Input, env Environment, client S3ClientAPI, report *RunReport) error {
 	sheetList := f.GetSheetList()
 	if group, ok := input.SheetGroups[env]; ok {
 		usernameToPasswordRow, err := getMACFinUsers(f, input, env)
@@ -92,11 +89,11 @@ func updateTestingSheets(f *excelize.File, input *Input, env Environment, client
 
 			// if sheet is not in file, continue
 			if !contains(sheetList, sheet) {
-				log.Printf("Info: sheet %q not found in file s3://%s/%s", sheet, input.Bucket, input.Key)
+				logger.Warn("testing sheet not found", nil, Fields{"sheet": sheet, "file": s3URI(input.Bucket, input.Key)})
 				continue
 			}
 
-			rows, err := f.GetRows(sheet)
+			rows, userX, passwordX, err := getTestingSheetRows(f, input, sheet)
 			if err != nil {
 				return err
 			}
@@ -106,20 +103,6 @@ func updateTestingSheets(f *excelize.File, input *Input, env Environment, client
 				continue
 			}
 
-			// if headers are invalid, return error
-			header := rows[0]
-			// check for username header
-			if !contains(header, input.UsernameHeader) {
-				return fmt.Errorf("sheet %s in file s3://%s/%s does not contain header %s in top row", sheet, input.Bucket, input.Key, input.UsernameHeader)
-			}
-			// check for password header
-			if !contains(header, input.PasswordHeader) {
-				return fmt.Errorf("sheet %s in file s3://%s/%s does not contain header %s in top row", sheet, input.Bucket, input.Key, input.PasswordHeader)
-			}
-
-			headerToXCoord := getHeaderToXCoord(header)
-			userX := headerToXCoord[input.UsernameHeader]
-			passwordX := headerToXCoord[input.PasswordHeader]
 			sheetIsUpdated := false
 			for i, row := range rows[input.RowOffset:] {
 				if len(row) < userX+1 {
@@ -141,13 +124,14 @@ func updateTestingSheets(f *excelize.File, input *Input, env Environment, client
 						if err != nil {
 							return fmt.Errorf("Error writing new password to %s sheet, row %d in file s3://%s/%s", sheet, toSheetCoord(i+input.RowOffset), input.Bucket, input.Key)
 						}
+						report.testingSheetUpdated(env, username, sheet)
 						sheetIsUpdated = true
 					}
 				}
 			}
 
 			if sheetIsUpdated {
-				log.Printf("successfully updated sheet %s in file s3://%s/%s", sheet, input.Bucket, input.Key)
+				logger.Info("updated testing sheet", Fields{"sheet": sheet, "file": s3URI(input.Bucket, input.Key)})
 
 				// upload file after every sheet
 				err = uploadFile(f, input.Bucket, input.Key, client)
@@ -155,7 +139,7 @@ func updateTestingSheets(f *excelize.File, input *Input, env Environment, client
 					return fmt.Errorf("Error uploading file to s3://%s/%s after updating sheet %s: %s", input.Bucket, input.Key, sheet, err)
 				}
 
-				log.Printf("successfully uploaded file to s3://%s/%s after updating sheet %s", input.Bucket, input.Key, sheet)
+				logger.Info("uploaded workbook", Fields{"step": stepUpload, "outcome": outcomeSuccess, "sheet": sheet, "file": s3URI(input.Bucket, input.Key)})
 			}
 		}
 	}
@@ -163,9 +147,37 @@ func updateTestingSheets(f *excelize.File, input *Input, env Environment, client
 	return nil
 }
 
+// Get the rows of a testing sheet and the x coordinates of its username and
+// password columns. An empty sheet returns no rows.
+func getTestingSheetRows(f *excelize.File, input *Input, sheet string) (rows [][]string, userX, passwordX int, err error) {
+	rows, err = f.GetRows(sheet)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	if len(rows) == 0 {
+		return rows, 0, 0, nil
+	}
+
+	// if headers are invalid, return error
+	header := rows[0]
+	// check for username header
+	if !contains(header, input.UsernameHeader) {
+		return nil, 0, 0, fmt.Errorf("sheet %s in file s3://%s/%s does not contain header %s in top row", sheet, input.Bucket, input.Key, input.UsernameHeader)
+	}
+	// check for password header
+	if !contains(header, input.PasswordHeader) {
+		return nil, 0, 0, fmt.Errorf("sheet %s in file s3://%s/%s does not contain header %s in top row", sheet, input.Bucket, input.Key, input.PasswordHeader)
+	}
+
+	headerToXCoord := getHeaderToXCoord(header)
+	return rows, headerToXCoord[input.UsernameHeader], headerToXCoord[input.PasswordHeader], nil
+}
+
 func validateSheets(f *excelize.File, input *Input) error {
 	sheetList := f.GetSheetList()
-	for _, group := range input.SheetGroups {
+	for _, env := range sortedSheetGroups(input) {
+		group := input.SheetGroups[env]
 		sheets := []string{group.PortalSheetName, group.AutomatedSheetName}
 		for _, sheet := range sheets {
 			// check that sheet exists
@@ -257,7 +269,7 @@ func removeMACFinUserDups(f *excelize.File, input *Input, env Environment) error
 	for idx := len(rows) - 1; idx >= rowOffset; idx-- {
 		err := validateRow(f, sheetName, idx, usernameXCoord, passwordXCoord)
 		if err != nil {
-			log.Printf("Info: validating sheet %s, row %d: %s", sheetName, toSheetCoord(idx), err)
+			logger.Warn("skipping invalid row", err, Fields{"sheet": sheetName, "row": toSheetCoord(idx)})
 			continue
 		}
 		if _, ok := users[strings.ToLower(rows[idx][usernameXCoord])]; ok {
@@ -273,14 +285,14 @@ func removeMACFinUserDups(f *excelize.File, input *Input, env Environment) error
 		if err != nil {
 			return fmt.Errorf("Error deleting duplicate users from sheet %s in file s3://%s/%s:%s", sheetName, input.Bucket, input.Key, err)
 		}
-		log.Printf("successfully deleted all duplicate users (%d) from %s in file s3://%s/%s", len(rowsToDelete), sheetName, input.Bucket, input.Key)
+		logger.Info("deleted duplicate users", Fields{"count": len(rowsToDelete), "sheet": sheetName, "file": s3URI(input.Bucket, input.Key)})
 	}
 
 	return nil
 }
 
 func removeDupsFromMACFinSheets(f *excelize.File, input *Input) error {
-	for env := range input.SheetGroups {
+	for _, env := range sortedSheetGroups(input) {
 		err := removeMACFinUserDups(f, input, env)
 		if err != nil {
 			return err
@@ -306,7 +318,7 @@ func getMACFinUsers(f *excelize.File, input *Input, env Environment) (map[string
 	for i, row := range rows[rowOffset:] {
 		err := validateRow(f, sheetName, i+rowOffset, usernameXCoord, passwordXCoord)
 		if err != nil {
-			log.Printf("Info: validating sheet %s, row %d: %s", sheetName, toSheetCoord(i+rowOffset), err)
+			logger.Warn("skipping invalid row", err, Fields{"sheet": sheetName, "row": toSheetCoord(i + rowOffset)})
 			continue
 		}
 		users[strings.ToLower(row[usernameXCoord])] = PasswordRow{row[passwordXCoord], i + rowOffset}
@@ -337,6 +349,94 @@ func getManagedUsers(f *excelize.File, input *Input, env Environment) (map[strin
 	return userToPasswordRow, nil
 }
 
+var policyHeadings = []string{ColMaxAgeDaysHeading, ColPasswordLengthHeading, ColExcludeCharsHeading}
+
+// Get each user's rotation policy. A value in an optional policy column of the
+// automated sheet takes precedence over one in the portal sheet; users with
+// neither get the environment default. Invalid values are logged and ignored.
+func getUserPolicies(f *excelize.File, input *Input, env Environment) (map[string]UserPolicy, error) {
+	group := input.SheetGroups[env]
+	colUser := input.AutomatedSheetColNameToIndex[ColUser]
+
+	// user -> heading -> value
+	userToValues := map[string]map[string]string{}
+	// portal sheet first, so that the automated sheet overrides it
+	for _, sheet := range []string{group.PortalSheetName, group.AutomatedSheetName} {
+		rows, err := f.GetRows(sheet)
+		if err != nil {
+			return nil, fmt.Errorf("failed getting rows from %s in s3://%s/%s: %s", sheet, input.Bucket, input.Key, err)
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		header := getHeaderToXCoord(rows[0])
+		userX := header[input.UsernameHeader]
+		if sheet == group.AutomatedSheetName {
+			userX = colUser
+		}
+
+		for _, row := range rows[input.RowOffset:] {
+			if len(row) <= userX || row[userX] == "" {
+				continue
+			}
+			username := strings.ToLower(row[userX])
+			for _, heading := range policyHeadings {
+				x, ok := header[heading]
+				if !ok || len(row) <= x || strings.TrimSpace(row[x]) == "" {
+					continue
+				}
+				if userToValues[username] == nil {
+					userToValues[username] = map[string]string{}
+				}
+				userToValues[username][heading] = strings.TrimSpace(row[x])
+			}
+		}
+	}
+
+	policies := map[string]UserPolicy{}
+	for username, values := range userToValues {
+		p := input.policy(env)
+		invalid := func(heading string, err error) {
+			logger.Error("ignoring invalid policy column", err, Fields{"column": heading, "value": values[heading], "user": username, "env": env})
+		}
+
+		if v, ok := values[ColMaxAgeDaysHeading]; ok {
+			days, err := strconv.Atoi(v)
+			if err == nil && days < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+			if err != nil {
+				invalid(ColMaxAgeDaysHeading, err)
+			} else {
+				p.MaxAgeDays = days
+			}
+		}
+		if v, ok := values[ColPasswordLengthHeading]; ok {
+			n, err := strconv.Atoi(v)
+			password := p.Password.withOverrides(n, "")
+			if err == nil {
+				err = password.check()
+			}
+			if err != nil {
+				invalid(ColPasswordLengthHeading, err)
+			} else {
+				p.Password = password
+			}
+		}
+		if v, ok := values[ColExcludeCharsHeading]; ok {
+			password := p.Password.withOverrides(0, v)
+			err := password.check()
+			if err != nil {
+				invalid(ColExcludeCharsHeading, err)
+			} else {
+				p.Password = password
+			}
+		}
+		policies[username] = p
+	}
+	return policies, nil
+}
+
 // Sync PasswordManager usernames with MACFin users
 func syncPasswordManagerUsersToMACFinUsers(f *excelize.File, input *Input, client S3ClientAPI, env Environment) error {
 	macFinUsersToPasswordRow, err := getMACFinUsers(f, input, env)
@@ -407,7 +507,7 @@ func syncPasswordManagerUsersToMACFinUsers(f *excelize.File, input *Input, clien
 	if err != nil {
 		return fmt.Errorf("Error uploading file after synchronizing: %s", err)
 	}
-	log.Printf("successfully uploaded file to s3://%s/%s after syncrhonization", input.Bucket, input.Key)
+	logger.Info("uploaded workbook after synchronization", Fields{"step": stepUpload, "outcome": outcomeSuccess, "env": env, "file": s3URI(input.Bucket, input.Key)})
 
 	return nil
 }
@@ -479,8 +579,18 @@ func sortRows(f *excelize.File, input *Input, sheetname string) error {
 		return rows[input.RowOffset+i][colUser] < rows[input.RowOffset+j][colUser]
 	})
 
-	// write sorted rows to automatedSheet
+	// write sorted rows to automatedSheet, padding short rows so that no
+	// trailing cells are left over from the row previously in their place
+	numCols := 0
+	for _, r := range rows {
+		if len(r) > numCols {
+			numCols = len(r)
+		}
+	}
 	for idx, r := range rows[input.RowOffset:] {
+		for len(r) < numCols {
+			r = append(r, "")
+		}
 		cellName := fmt.Sprintf("A%d", 2+idx)
 		err = f.SetSheetRow(sheetname, cellName, &r)
 		if err != nil {
@@ -516,7 +626,7 @@ func updateMACFinUsers(f *excelize.File, input *Input, client S3ClientAPI, env E
 	for i, row := range rows[rowOffset:] {
 		err := validateRow(f, sheetName, i+rowOffset, userX, passwordX)
 		if err != nil {
-			log.Printf("Info: validating sheet %s, row %d: %s", sheetName, toSheetCoord(i+rowOffset), err)
+			logger.Warn("skipping invalid row", err, Fields{"sheet": sheetName, "row": toSheetCoord(i + rowOffset)})
 			continue
 		}
 
@@ -538,43 +648,30 @@ func updateMACFinUsers(f *excelize.File, input *Input, client S3ClientAPI, env E
 	if err != nil {
 		return fmt.Errorf("Error uploading file: %s", err)
 	}
-	log.Printf("successfully uploaded file to s3://%s/%s after processing sheet %s", input.Bucket, input.Key, sheetName)
+	logger.Info("uploaded workbook", Fields{"step": stepUpload, "outcome": outcomeSuccess, "sheet": sheetName, "file": s3URI(input.Bucket, input.Key)})
 
 	return nil
 }
 
-// password-protect excel file
-func protectExcelWorkbook(filename string) (string, error) {
-	dir := filepath.Dir(filename)
-	outFilename := filepath.Join(dir, "protected-"+filepath.Base(filename))
+// Write an encrypted copy of the workbook that opens with password, next to
+// the workbook's local file
+func protectExcelWorkbook(f *excelize.File, password string) (string, error) {
+	outFilename := filepath.Join(filepath.Dir(f.Path), "protected-"+filepath.Base(f.Path))
 
-	cmdPath, err := exec.LookPath("secure-spreadsheet")
+	buf, err := f.WriteToBuffer()
 	if err != nil {
-		return "", fmt.Errorf("Error resolving command name: %s", err)
+		return "", fmt.Errorf("Error writing workbook %s: %s", f.Path, err)
 	}
-	secureSpreadsheet := exec.Command(cmdPath, "--password", os.Getenv("WORKBOOKPASSWORD"), "--input-format", "xlsx")
-
-	inFile, err := os.Open(filename)
+	encrypted, err := encryptWorkbook(buf.Bytes(), password)
 	if err != nil {
-		return "", fmt.Errorf("Error opening excel file: %s err: %s", filename, err)
+		return "", fmt.Errorf("Error encrypting workbook %s: %s", f.Path, err)
 	}
-	defer inFile.Close()
-
-	outFile, err := os.Create(outFilename)
+	err = os.WriteFile(outFilename, encrypted, 0600)
 	if err != nil {
 		return "", fmt.Errorf("Error creating output excel file: %s err: %s", outFilename, err)
 	}
-	defer outFile.Close()
 
-	secureSpreadsheet.Stdin = inFile
-	secureSpreadsheet.Stdout = outFile
-
-	if err := secureSpreadsheet.Run(); err != nil {
-		return "", fmt.Errorf("Error starting secure-spreadsheet command: %s", err)
-	}
-
-	log.Printf("Successfully protected workbook file: %s", outFilename)
+	logger.Info("protected workbook", Fields{"file": outFilename})
 
 	return outFilename, nil
-
 }
@@ -8,5 +8,9 @@ require (
 	github.com/aws/aws-sdk-go-v2/internal/configsources v1.1.4 // indirect
 	github.com/aws/aws-sdk-go-v2/internal/endpoints/v2 v2.2.0 // indirect
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.22.0
+	github.com/aws/smithy-go v1.10.0
+	github.com/richardlehane/mscfb v1.0.3
 	github.com/xuri/excelize/v2 v2.4.1
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+	gopkg.in/yaml.v3 v3.0.1
 )
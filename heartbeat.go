@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// heartbeatJob is a user who is not due for rotation but has not logged in
+// for long enough that IDM might deactivate the account.
+type heartbeatJob struct {
+	row        int // row in the automated sheet
+	name       string
+	password   string
+	timestamp  string
+	policy     UserPolicy
+	lockout    lockoutState
+	totpSecret string // empty unless the user answers MFA challenges
+}
+
+// heartbeatResult is whether the portal accepted a user's login.
+type heartbeatResult struct {
+	job heartbeatJob
+	err error
+	at  time.Time
+}
+
+// heartbeatDue reports whether a user who last logged in at lastLogin, or was
+// last rotated at timestamp if that is later or no login is recorded, needs a
+// heartbeat at now.
+func heartbeatDue(lastLogin, timestamp string, now time.Time, heartbeatDays int) bool {
+	if heartbeatDays < 1 {
+		return false
+	}
+	var last time.Time
+	for _, ts := range []string{lastLogin, timestamp} {
+		t, err := time.Parse(time.UnixDate, ts)
+		if err == nil && t.After(last) {
+			last = t
+		}
+	}
+	if last.IsZero() {
+		return true
+	}
+
+	// by year, month and day only, like rotationDue
+	refDate := time.Date(last.Year(), last.Month(), last.Day(), 0, 0, 0, 0, time.UTC)
+	return !now.Before(refDate.AddDate(0, 0, heartbeatDays))
+}
+
+// Get an optional column of the automated sheet, adding the heading after
+// the last column if the sheet has none
+func optionalCol(f *excelize.File, input *Input, env Environment, heading string) (int, error) {
+	automatedSheet := input.SheetGroups[env].AutomatedSheetName
+	rows, err := f.GetRows(automatedSheet)
+	if err != nil {
+		return 0, err
+	}
+	header := []string{}
+	if len(rows) > 0 {
+		header = rows[0]
+	}
+	if x, ok := getHeaderToXCoord(header)[heading]; ok {
+		return x, nil
+	}
+	x := len(header)
+	err = writeCell(f, automatedSheet, x, 0, heading)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add column %s to sheet %s: %s", heading, automatedSheet, err)
+	}
+	return x, nil
+}
+
+// Record a user's successful login in the automated sheet, clearing the
+// user's failed logins. A sheet with a Status column, which verify adds, also
+// gets the status ok.
+func recordLogin(f *excelize.File, input *Input, env Environment, name string, row int, at time.Time) error {
+	automatedSheet := input.SheetGroups[env].AutomatedSheetName
+	x, err := optionalCol(f, input, env, ColLastLoginHeading)
+	if err != nil {
+		return err
+	}
+	ts := at.Format(time.UnixDate)
+	err = writeCell(f, automatedSheet, x, row, ts)
+	if err != nil {
+		return fmt.Errorf("failed to write last login %s to sheet %s in row %d for user %s: %s", ts,
+			automatedSheet, toSheetCoord(row), name, err)
+	}
+
+	rows, err := f.GetRows(automatedSheet)
+	if err != nil {
+		return err
+	}
+	header := getHeaderToXCoord(rows[0])
+	if x, ok := header[ColFailedLoginsHeading]; ok {
+		// the login ends the user's run of failures
+		err = writeCell(f, automatedSheet, x, row, "")
+		if err != nil {
+			return fmt.Errorf("failed to clear failed logins in sheet %s in row %d for user %s: %s",
+				automatedSheet, toSheetCoord(row), name, err)
+		}
+	}
+	if _, ok := header[ColStatusHeading]; ok {
+		return recordStatus(f, input, env, name, row, statusOK)
+	}
+	return nil
+}
+
+// Log in and out as each user, with a pool of workers, so that IDM does not
+// deactivate accounts whose passwords are not yet due for rotation. The
+// logins, and failed logins counting toward a quarantine, are recorded in the
+// automated sheet, which is uploaded once at the end since no password
+// changes. Users whose logins IDM refused for an expired password are
+// returned to be rotated.
+func heartbeatUsers(ctx context.Context, f *excelize.File, input *Input, portal *Portal, s3Client S3ClientAPI, env Environment, jobs []heartbeatJob) (rotationStats, []heartbeatJob, error) {
+	stats := rotationStats{causes: map[string]int{}}
+	expired := []heartbeatJob{}
+	if len(jobs) == 0 {
+		return stats, expired, nil
+	}
+
+	changed := false
+	runErr := loginUsers(ctx, input, portal, env, jobs, func(res heartbeatResult) error {
+		if errors.Is(res.err, ErrPasswordExpired) {
+			envLogger(input, env).Info("password expired; rotating", Fields{"user": res.job.name})
+			expired = append(expired, res.job)
+			return nil
+		}
+		if res.err == nil || isFailedLogin(res.err) && recordsFailedLogins(1, res.job.policy.QuarantineAfter) {
+			changed = true
+		}
+		return applyHeartbeat(f, input, env, res, &stats)
+	})
+	if runErr != nil || !changed {
+		return stats, expired, runErr
+	}
+
+	err := uploadFile(f, input.Bucket, input.Key, s3Client)
+	if err != nil {
+		return stats, expired, fmt.Errorf("Error uploading file after heartbeats: %s", err)
+	}
+	envLogger(input, env).Info("uploaded workbook", Fields{"step": stepUpload, "outcome": outcomeSuccess, "heartbeats": stats.success})
+	return stats, expired, nil
+}
+
+// Log in and out as each user with a pool of workers, passing each result to
+// apply. Results after the first error from apply are dropped.
+func loginUsers(ctx context.Context, input *Input, portal *Portal, env Environment, jobs []heartbeatJob, apply func(heartbeatResult) error) error {
+	jobCh := make(chan heartbeatJob)
+	results := make(chan heartbeatResult)
+	go func() {
+		defer close(jobCh)
+		for _, job := range jobs {
+			select {
+			case jobCh <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < input.workers() && w < len(jobs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobCh {
+				results <- heartbeatUser(ctx, portal, env, job)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var err error
+	for res := range results {
+		if err != nil {
+			continue
+		}
+		err = apply(res)
+	}
+	return err
+}
+
+// Log in and out as a user with a fresh session
+func heartbeatUser(ctx context.Context, portal *Portal, env Environment, job heartbeatJob) heartbeatResult {
+	client := portalClient(portal)
+	stepLog := logger.With(Fields{"env": env, "user": job.name, "portal": portal.Hostname})
+	err := timedStep(stepLog, stepLogin, func() error {
+		return loginStep(ctx, client, portal, job.name, job.password, job.totpSecret)
+	})
+	// log out even after a failed login, to end a partial session; a
+	// failed logout does not undo the login IDM counts
+	timedStep(stepLog, stepLogout, func() error {
+		return logoutStep(ctx, client, portal)
+	})
+
+	res := heartbeatResult{job: job, at: time.Now().UTC()}
+	if err != nil {
+		res.err = &LoginError{err}
+	}
+	return res
+}
+
+// Write a heartbeat result to the workbook
+func applyHeartbeat(f *excelize.File, input *Input, env Environment, res heartbeatResult, stats *rotationStats) error {
+	envLog := envLogger(input, env)
+	job := res.job
+	rec := ReportRecord{Environment: env, User: job.name, OldTimestamp: job.timestamp}
+	if res.err != nil {
+		stats.fail++
+		stats.causes[errorClass(res.err)]++
+		rec.Action = actionHeartbeatFailed
+		rec.ErrorClass = errorClass(res.err)
+		err := recordHeartbeatFailure(f, input, env, res, &rec)
+		if err != nil {
+			return err
+		}
+		stats.records = append(stats.records, rec)
+		envLog.Error("heartbeat failed", res.err, Fields{"user": job.name, "outcome": outcomeFail, "error_class": errorClass(res.err)})
+		return nil
+	}
+
+	err := recordLogin(f, input, env, job.name, job.row, res.at)
+	if err != nil {
+		return err
+	}
+	stats.success++
+	rec.Action = actionHeartbeat
+	stats.records = append(stats.records, rec)
+	envLog.Info("heartbeat complete", Fields{"user": job.name, "outcome": outcomeSuccess})
+	return nil
+}
+
+// Record a failed login of a heartbeat or verification toward the user's
+// quarantine, noting any quarantine in rec
+func recordHeartbeatFailure(f *excelize.File, input *Input, env Environment, res heartbeatResult, rec *ReportRecord) error {
+	if !isFailedLogin(res.err) {
+		return nil
+	}
+	job := res.job
+	reason, err := recordFailedLogins(f, input, env, job.name, job.row, job.lockout, 1, job.policy.QuarantineAfter, res.err, res.at)
+	if err != nil {
+		return err
+	}
+	rec.Quarantined = reason
+	return nil
+}
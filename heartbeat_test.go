@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatDue(t *testing.T) {
+	at := func(days int) string {
+		return now.AddDate(0, 0, days).Format(time.UnixDate)
+	}
+	for _, tc := range []struct {
+		name                 string
+		lastLogin, timestamp string
+		days                 int
+		due                  bool
+	}{
+		{"disabled", at(-100), at(-100), 0, false},
+		{"recent login", at(-2), at(-20), 7, false},
+		{"old login", at(-7), at(-20), 7, true},
+		{"rotated since the last login", at(-20), at(-3), 7, false},
+		{"no login recorded", "", at(-10), 7, true},
+		{"no login recorded, recently rotated", "", at(-1), 7, false},
+		{"unreadable dates", "yesterday", "Rotate Now", 7, true},
+	} {
+		if due := heartbeatDue(tc.lastLogin, tc.timestamp, now, tc.days); due != tc.due {
+			t.Errorf("%s: expected heartbeatDue %v; got %v", tc.name, tc.due, due)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/xuri/excelize/v2"
+)
+
+const journalSuffix = ".journal"
+
+// JournalEntry records a new password before it is sent to the portal. The
+// entry is committed once the workbook holding the password is uploaded.
+type JournalEntry struct {
+	Environment Environment `json:"environment"`
+	Username    string      `json:"username"`
+	Password    string      `json:"password"` // encrypted with encryptSecret
+	Created     time.Time   `json:"created"`
+	Committed   bool        `json:"committed"`
+}
+
+// Journal is a write-ahead log of password changes, stored in S3 next to the
+// workbook, so that a run that dies between changing a password in the
+// portal and uploading the workbook does not lose the new password.
+//
+// Entries are encrypted with the automated sheet password; the journal holds
+// nothing that the workbook does not.
+type Journal struct {
+	Entries []JournalEntry `json:"entries"`
+
+	mu       sync.Mutex // held while entries change and the journal is uploaded
+	bucket   string
+	key      string
+	password string
+	client   S3ClientAPI
+}
+
+func journalKey(key string) string {
+	return key + journalSuffix
+}
+
+func loadJournal(input *Input, client S3ClientAPI) (*Journal, error) {
+	j := &Journal{
+		bucket:   input.Bucket,
+		key:      journalKey(input.Key),
+		password: input.AutomatedSheetPassword,
+		client:   client,
+	}
+
+	obj, err := downloadS3Object(j.bucket, j.key, client)
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return j, nil
+		}
+		return nil, fmt.Errorf("Error downloading journal s3://%s/%s: %s", j.bucket, j.key, err)
+	}
+
+	err = json.Unmarshal(obj, j)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing journal s3://%s/%s: %s", j.bucket, j.key, err)
+	}
+	return j, nil
+}
+
+func (j *Journal) save() error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("Error marshalling journal: %s", err)
+	}
+
+	_, err = j.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(j.bucket),
+		Key:    aws.String(j.key),
+		Body:   bytes.NewReader(b),
+	})
+	if err != nil {
+		return fmt.Errorf("Error uploading journal to s3://%s/%s: %s", j.bucket, j.key, err)
+	}
+	return nil
+}
+
+func (j *Journal) find(env Environment, username string) int {
+	for idx, entry := range j.Entries {
+		if entry.Environment == env && entry.Username == username && !entry.Committed {
+			return idx
+		}
+	}
+	return -1
+}
+
+// Record the password a user is about to be given. The journal is uploaded
+// before returning.
+func (j *Journal) record(env Environment, username, password string) error {
+	encrypted, err := encryptSecret(j.password, password)
+	if err != nil {
+		return fmt.Errorf("Error encrypting journal entry for user %s: %s", username, err)
+	}
+
+	entry := JournalEntry{
+		Environment: env,
+		Username:    username,
+		Password:    encrypted,
+		Created:     time.Now().UTC(),
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// older entries that were never reconciled stay candidates
+	j.Entries = append(j.Entries, entry)
+	return j.save()
+}
+
+// Mark every pending entry for a user committed and upload the journal.
+func (j *Journal) commit(env Environment, username string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for idx := j.find(env, username); idx >= 0; idx = j.find(env, username) {
+		j.Entries[idx].Committed = true
+	}
+	return j.save()
+}
+
+// Drop every pending entry for a user, whose password is known not to have
+// changed, and upload the journal.
+func (j *Journal) discard(env Environment, username string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries := []JournalEntry{}
+	for _, entry := range j.Entries {
+		if entry.Environment == env && entry.Username == username && !entry.Committed {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	j.Entries = entries
+	return j.save()
+}
+
+// Passwords a user might have been given by runs that did not finish,
+// newest first
+func (j *Journal) pending(env Environment, username string) []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	passwords := []string{}
+	for idx := len(j.Entries) - 1; idx >= 0; idx-- {
+		entry := j.Entries[idx]
+		if entry.Environment != env || entry.Username != username || entry.Committed {
+			continue
+		}
+		password, err := decryptSecret(j.password, entry.Password)
+		if err != nil {
+			logger.Error("failed to decrypt journal entry", err, Fields{"env": env, "user": username})
+			continue
+		}
+		registerSecret(password)
+		passwords = append(passwords, password)
+	}
+	return passwords
+}
+
+// Users with pending entries in an environment
+func (j *Journal) pendingUsers(env Environment) map[string]bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	users := map[string]bool{}
+	for _, entry := range j.Entries {
+		if entry.Environment == env && !entry.Committed {
+			users[entry.Username] = true
+		}
+	}
+	return users
+}
+
+type journalUser struct {
+	env      Environment
+	username string
+}
+
+// Reconcile uncommitted journal entries against the portal. A password the
+// portal accepts is written to the workbook as if it had just been rotated;
+// entries the portal rejects while the sheet password still works are
+// dropped. Entries that cannot be reconciled are kept for the next run.
+func replayJournal(ctx context.Context, f *excelize.File, input *Input, envToPortal map[Environment]*Portal, j *Journal, client S3ClientAPI, report *RunReport) error {
+	users := []journalUser{}
+	seen := map[journalUser]bool{}
+	for _, entry := range j.Entries {
+		u := journalUser{entry.Environment, entry.Username}
+		if !entry.Committed && !seen[u] {
+			seen[u] = true
+			users = append(users, u)
+		}
+	}
+
+	envToTOTPSecrets := map[Environment]map[string]string{}
+	for _, u := range users {
+		portal, ok := envToPortal[u.env]
+		if !ok {
+			logger.Warn("journal has an uncommitted password in an unconfigured environment", nil, Fields{"env": u.env, "user": u.username})
+			continue
+		}
+		if _, ok := envToTOTPSecrets[u.env]; !ok {
+			// decrypted once per environment
+			secrets, err := getTOTPSecrets(f, input, u.env)
+			if err != nil {
+				return err
+			}
+			envToTOTPSecrets[u.env] = secrets
+		}
+		totpSecret := envToTOTPSecrets[u.env][strings.ToLower(u.username)]
+
+		userToPasswordRow, err := getManagedUsers(f, input, u.env)
+		if err != nil {
+			return err
+		}
+		pwRow, ok := userToPasswordRow[u.username]
+		if !ok {
+			logger.Warn("dropping journal entries for a user no longer in the sheet", nil, Fields{"env": u.env, "sheet": input.SheetGroups[u.env].AutomatedSheetName, "user": u.username})
+			err = j.discard(u.env, u.username)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		reconciled := false
+		uncertain := false
+		for _, password := range j.pending(u.env, u.username) {
+			if password == pwRow.Password {
+				// the workbook was uploaded but the journal was not
+				reconciled = true
+				break
+			}
+			err = tryLogin(ctx, portal, u.username, password, totpSecret)
+			if err != nil {
+				// only a rejected password rules the entry out
+				if !errors.Is(err, ErrInvalidCredentials) {
+					uncertain = true
+				}
+				continue
+			}
+
+			mcFinUsersToPasswordRow, err := getMACFinUsers(f, input, u.env)
+			if err != nil {
+				return err
+			}
+			mfRow, ok := mcFinUsersToPasswordRow[u.username]
+			if !ok {
+				return fmt.Errorf("macFin user %s missing from PasswordManager users; failed to update sheet %s with new password", u.username, input.SheetGroups[u.env].PortalSheetName)
+			}
+			oldTimestamp, err := getCellValue(f, input.SheetGroups[u.env].AutomatedSheetName, input.AutomatedSheetColNameToIndex[ColTimestamp], pwRow.Row)
+			if err != nil {
+				return err
+			}
+			now := time.Now().UTC()
+			err = persistRotation(f, input, u.env, u.username, pwRow.Row, mfRow.Row, password, now)
+			if err != nil {
+				return err
+			}
+			err = uploadFile(f, input.Bucket, input.Key, client)
+			if err != nil {
+				return fmt.Errorf("Error uploading file after replaying journal: %s", err)
+			}
+			logger.Info("rotation complete", Fields{"env": u.env, "user": u.username, "outcome": outcomeRecovered, "source": "journal"})
+			report.add(ReportRecord{Environment: u.env, User: u.username, Action: actionRecovered, OldTimestamp: oldTimestamp, NewTimestamp: now.Format(time.UnixDate)})
+			reconciled = true
+			break
+		}
+
+		if reconciled {
+			err = j.commit(u.env, u.username)
+			if err != nil {
+				return err
+			}
+		} else if uncertain {
+			logger.Error("could not check journal passwords; journal entries kept", nil, Fields{"env": u.env, "user": u.username})
+		} else if tryLogin(ctx, portal, u.username, pwRow.Password, totpSecret) == nil {
+			// the password was never changed
+			err = j.discard(u.env, u.username)
+			if err != nil {
+				return err
+			}
+		} else {
+			logger.Error("no journal or sheet password works; journal entries kept", nil, Fields{"env": u.env, "user": u.username})
+		}
+	}
+
+	// committed entries are no longer needed
+	entries := []JournalEntry{}
+	for _, entry := range j.Entries {
+		if !entry.Committed {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) != len(j.Entries) {
+		j.Entries = entries
+		return j.save()
+	}
+	return nil
+}
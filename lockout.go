@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// lockoutState is what the automated sheet records of a user's failed
+// logins.
+type lockoutState struct {
+	failedLogins int    // consecutive failed logins
+	quarantined  string // why logins stopped; empty unless quarantined
+}
+
+// Read a user's lockout state from their row of the automated sheet
+func readLockout(header map[string]int, row []string) lockoutState {
+	state := lockoutState{}
+	if x, ok := header[ColFailedLoginsHeading]; ok && x < len(row) {
+		// an unreadable count is as good as none
+		state.failedLogins, _ = strconv.Atoi(strings.TrimSpace(row[x]))
+	}
+	if x, ok := header[ColQuarantinedHeading]; ok && x < len(row) {
+		state.quarantined = strings.TrimSpace(row[x])
+	}
+	return state
+}
+
+// Whether a failed login counts toward IDM locking the account: IDM itself
+// rejected the credentials or said the account is locked out. A 401 or 403
+// from a proxy or firewall in front of IDM never reached its counter.
+func isFailedLogin(err error) bool {
+	var loginErr *LoginError
+	if !errors.As(err, &loginErr) {
+		return false
+	}
+	var portalErr *PortalError
+	return idmLocked(err) ||
+		errors.Is(err, ErrInvalidCredentials) && errors.As(err, &portalErr) && portalErr.Code != ""
+}
+
+// Whether IDM said the account is locked out, by its authentication status or
+// error code
+func idmLocked(err error) bool {
+	var portalErr *PortalError
+	return errors.As(err, &portalErr) && (portalErr.Code == "LOCKED_OUT" || contains(lockedCodes, portalErr.Code))
+}
+
+// Whether a user with state, who failed attempts logins in this run, may try
+// another login without going past quarantineAfter failed logins
+func loginAllowed(state lockoutState, attempts, quarantineAfter int) bool {
+	return quarantineAfter < 1 || state.failedLogins+attempts < quarantineAfter
+}
+
+// Whether attempts failed logins are written to the automated sheet
+func recordsFailedLogins(attempts, quarantineAfter int) bool {
+	return quarantineAfter > 0 && attempts > 0
+}
+
+// Add a user's failed logins to the automated sheet and quarantine the user
+// if IDM locked the account or the failures reach quarantineAfter. Returns why
+// the user was quarantined, or an empty string. Nothing is recorded unless
+// quarantine is enabled.
+func recordFailedLogins(f *excelize.File, input *Input, env Environment, name string, row int, state lockoutState, attempts, quarantineAfter int, loginErr error, at time.Time) (string, error) {
+	if !recordsFailedLogins(attempts, quarantineAfter) {
+		return "", nil
+	}
+	automatedSheet := input.SheetGroups[env].AutomatedSheetName
+	failedLogins := state.failedLogins + attempts
+	x, err := optionalCol(f, input, env, ColFailedLoginsHeading)
+	if err != nil {
+		return "", err
+	}
+	err = writeCell(f, automatedSheet, x, row, strconv.Itoa(failedLogins))
+	if err != nil {
+		return "", fmt.Errorf("failed to write failed logins to sheet %s in row %d for user %s: %s",
+			automatedSheet, toSheetCoord(row), name, err)
+	}
+
+	reason := ""
+	if idmLocked(loginErr) {
+		reason = "account locked"
+	} else if failedLogins >= quarantineAfter {
+		reason = fmt.Sprintf("%d failed logins", failedLogins)
+	}
+	if reason == "" {
+		return "", nil
+	}
+	reason = at.Format(time.UnixDate) + ": " + reason
+	x, err = optionalCol(f, input, env, ColQuarantinedHeading)
+	if err != nil {
+		return "", err
+	}
+	err = writeCell(f, automatedSheet, x, row, reason)
+	if err != nil {
+		return "", fmt.Errorf("failed to quarantine user %s in sheet %s in row %d: %s", name,
+			automatedSheet, toSheetCoord(row), err)
+	}
+	envLogger(input, env).Warn("user quarantined; clear the Quarantined cell after unlocking the account", nil,
+		Fields{"user": name, "quarantined": reason, "failed_logins": failedLogins})
+	return reason, nil
+}
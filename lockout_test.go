@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestQuarantine(t *testing.T) {
+	emf := &lockedBuffer{}
+	setMetricsOutput(emf)
+	dir := t.TempDir()
+	filename := path.Join(dir, localS3Filename)
+
+	quarantinedAt := format(-2*Day) + ": account locked"
+	headers := []string{ColUserHeading, ColPasswordHeading, ColPreviousHeading, ColTimestampHeading, ColFailedLoginsHeading, ColQuarantinedHeading}
+	rows := [][]string{
+		{"ann", "ann-pw", "", format(-80 * Day), "1", ""},
+		{"ben", "stale-pw", "older-pw", format(-80 * Day), "", ""},
+		{"cat", "cat-pw", "", format(-80 * Day), "3", quarantinedAt},
+		{"dan", "dan-pw", "", format(-80 * Day), "", ""},
+		{"eve", "eve-pw", "eve-prev-pw", format(-80 * Day), "1", ""},
+		{"fay", "fay-pw", "", format(-80 * Day), "", ""},
+	}
+	f := excelize.NewFile()
+	f.SetSheetName("Sheet1", sheetNameMACFin)
+	f.NewSheet(sheetNamePasswordManager)
+	f.SetSheetRow(sheetNameMACFin, "A1", &[]string{headingMACFinUsername, headingMACFinPassword})
+	f.SetSheetRow(sheetNamePasswordManager, "A1", &headers)
+	for idx, row := range rows {
+		row := row
+		err := f.SetSheetRow(sheetNamePasswordManager, fmt.Sprintf("A%d", 2+idx), &row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		portalPassword := row[1]
+		if row[0] == "ben" {
+			portalPassword = "oldest-pw"
+		}
+		f.SetSheetRow(sheetNameMACFin, fmt.Sprintf("A%d", 2+idx), &[]string{row[0], portalPassword})
+	}
+	err := f.SaveAs(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &AuthServer{
+		UserToPassword: map[string]string{
+			"ann": "ann-pw",
+			"ben": "other-pw",
+			"cat": "cat-pw",
+			"dan": "dan-pw",
+			"eve": "eve-pw",
+			"fay": "fay-pw",
+		},
+		Statuses: map[string]string{"dan": "LOCKED_OUT"},
+		// a firewall's page is not IDM rejecting eve's passwords, so it does
+		// not count toward quarantine; IDM's E0000119 locks fay out
+		LoginErrors: map[string]string{
+			"eve": "<html><h1>Access Denied</h1>The request was blocked. Your account may be locked.</html>",
+			"fay": `{"errorCode":"E0000119","errorSummary":"This account is locked"}`,
+		},
+	}
+	server := &http.Server{
+		Addr:    ":3398",
+		Handler: handler,
+	}
+	go func() {
+		log.Printf("Server stopped: %s", server.ListenAndServe())
+	}()
+	defer server.Shutdown(context.Background())
+
+	input := &Input{
+		UsernameHeader:                 headingMACFinUsername,
+		PasswordHeader:                 headingMACFinPassword,
+		Bucket:                         inputBucket,
+		Key:                            inputKey,
+		AutomatedSheetPassword:         "asfas",
+		AutomatedSheetColNameToIndex:   columnArrangements[0].Columns,
+		AutomatedSheetColNameToHeading: headings,
+		RowOffset:                      1,
+		SheetGroups: map[Environment]SheetGroup{
+			dev: {
+				AutomatedSheetName: sheetNamePasswordManager,
+				PortalSheetName:    sheetNameMACFin,
+			},
+		},
+		Policies:     map[Environment]UserPolicy{dev: {QuarantineAfter: 2}},
+		Workers:      2,
+		ReportPrefix: "reports/",
+		RunID:        "test",
+	}
+	envToPortal := map[Environment]*Portal{
+		dev: {
+			Hostname:    portalServer,
+			IDMHostname: idmServer,
+			Scheme:      "http://",
+			env:         dev,
+			limiter:     newRateLimiter(1000),
+		},
+	}
+	fc := &FakeS3Client{
+		Bucket:                       input.Bucket,
+		Key:                          input.Key,
+		LocalPath:                    filename,
+		AutomatedSheetName:           sheetNamePasswordManager,
+		AutomatedSheetColNameToIndex: input.AutomatedSheetColNameToIndex,
+		RowOffset:                    input.RowOffset,
+		SheetName:                    sheetNameMACFin,
+		UsernameHeader:               input.UsernameHeader,
+		PasswordHeader:               input.PasswordHeader,
+	}
+
+	err = rotate(context.Background(), input, envToPortal, fc)
+	if err != nil {
+		t.Fatalf("Error running rotate(): %s", err)
+	}
+
+	// ben's stale password and his previous one are tried, but not the
+	// portal sheet's, which would go past the limit
+	for _, pw := range handler.SentPasswords {
+		switch pw {
+		case "oldest-pw":
+			t.Fatal("Expected no third login as ben")
+		case "cat-pw":
+			t.Fatal("Expected no login as quarantined user cat")
+		}
+	}
+
+	out, err := excelize.OpenFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outRows, err := out.GetRows(sheetNamePasswordManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := getHeaderToXCoord(outRows[0])
+	userToLockout := map[string]lockoutState{}
+	for _, row := range outRows[1:] {
+		userToLockout[row[0]] = readLockout(header, row)
+	}
+	for user, expected := range map[string]lockoutState{
+		"ann": {0, ""},
+		"ben": {2, "2 failed logins"},
+		"cat": {3, quarantinedAt},
+		"dan": {1, "account locked"},
+		"eve": {1, ""},
+		"fay": {1, "account locked"},
+	} {
+		got := userToLockout[user]
+		if got.failedLogins != expected.failedLogins || (got.quarantined == "") != (expected.quarantined == "") ||
+			!strings.HasSuffix(got.quarantined, expected.quarantined) {
+			t.Errorf("Expected lockout state %+v for %s; got %+v", expected, user, got)
+		}
+	}
+
+	report := getRunReport(t, fc, "reports/")
+	for user, action := range map[string]string{"ann": actionRotated, "ben": actionFailed, "cat": actionQuarantined, "dan": actionFailed, "eve": actionFailed, "fay": actionFailed} {
+		rec := report.find(dev, user)
+		quarantined := user != "ann" && user != "eve"
+		if rec == nil || rec.Action != action || quarantined != (rec.Quarantined != "") {
+			t.Errorf("Expected %s to be %s; got %+v", user, action, rec)
+		}
+	}
+	data := newMailData(report, nil, "")
+	if len(data.Quarantined) != 4 || data.Environments[0].Quarantined != 4 {
+		t.Fatalf("Expected 4 quarantined users in the email; got %+v", data.Quarantined)
+	}
+	if quarantined := getMetrics(t, emf)[dev][metricAccountsQuarantined]; quarantined != 4 {
+		t.Fatalf("Expected AccountsQuarantined 4; got %v", quarantined)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// log levels; the CloudWatch metric filters in password-rotation/main.tf
+// count warn and error lines
+const (
+	levelInfo  = "info"
+	levelWarn  = "warn" // a problem with the workbook that testers should fix
+	levelError = "error"
+)
+
+// steps of a rotation, for the step field
+const (
+	stepLogin         = "login"
+	stepChange        = "change"
+	stepChangeExpired = "change-expired" // the change IDM forces at login for an expired password
+	stepLogout        = "logout"
+	stepUpload        = "upload"
+)
+
+// outcomes, for the outcome field
+const (
+	outcomeSuccess   = "success"
+	outcomeRecovered = "recovered"
+	outcomeFail      = "fail"
+	outcomeSkipped   = "skipped"
+)
+
+// Fields are the structured fields of a log line, such as run_id, env,
+// sheet, user, step, outcome and duration_ms.
+type Fields map[string]interface{}
+
+// logOutput is where every Logger writes, so that it can be changed after
+// loggers with fields have been made.
+type logOutput struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var output = &logOutput{w: os.Stderr}
+
+// Logger writes one JSON object per line. String values are redacted.
+type Logger struct {
+	fields Fields
+}
+
+var logger = &Logger{}
+
+// Get a logger that adds fields to every line
+func (l *Logger) With(fields Fields) *Logger {
+	merged := Fields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{fields: merged}
+}
+
+func (l *Logger) Info(msg string, fields Fields) {
+	l.write(levelInfo, msg, nil, fields)
+}
+
+func (l *Logger) Warn(msg string, err error, fields Fields) {
+	l.write(levelWarn, msg, err, fields)
+}
+
+func (l *Logger) Error(msg string, err error, fields Fields) {
+	l.write(levelError, msg, err, fields)
+}
+
+// Log an error and exit
+func (l *Logger) Fatal(msg string, err error, fields Fields) {
+	l.write(levelError, msg, err, fields)
+	os.Exit(1)
+}
+
+func (l *Logger) write(level, msg string, err error, fields Fields) {
+	line := map[string]interface{}{}
+	for k, v := range l.fields {
+		line[k] = redactValue(v)
+	}
+	for k, v := range fields {
+		line[k] = redactValue(v)
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level
+	line["msg"] = redact(msg)
+	if err != nil {
+		line["error"] = redact(err.Error())
+	}
+	if _, file, lineNo, ok := runtime.Caller(2); ok {
+		line["caller"] = fmt.Sprintf("%s:%d", filepath.Base(file), lineNo)
+	}
+
+	b, merr := json.Marshal(line)
+	if merr != nil {
+		b, _ = json.Marshal(map[string]string{"level": levelError, "msg": "Error marshalling log line: " + merr.Error()})
+	}
+	output.mu.Lock()
+	defer output.mu.Unlock()
+	output.w.Write(append(b, '\n'))
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return redact(v)
+	case error:
+		return redact(v.Error())
+	case time.Duration:
+		return v.Milliseconds()
+	case fmt.Stringer:
+		return redact(v.String())
+	}
+	return v
+}
+
+// Get a logger for an environment's users
+func envLogger(input *Input, env Environment) *Logger {
+	return logger.With(Fields{"env": env, "sheet": input.SheetGroups[env].AutomatedSheetName})
+}
+
+// Send structured and standard log output to w
+func setLogOutput(w io.Writer) {
+	output.mu.Lock()
+	output.w = w
+	output.mu.Unlock()
+	redactLogs(w)
+}
+
+// A random identifier for the run, to tie its log lines together
+func newRunID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func durationMS(start time.Time) int64 {
+	return time.Since(start).Milliseconds()
+}
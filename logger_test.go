@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	buf := &lockedBuffer{}
+	setLogOutput(buf)
+	defer setLogOutput(os.Stderr)
+
+	registerSecret("s3cret-Passw0rd")
+	l := logger.With(Fields{"run_id": "r1", "env": Environment("dev")})
+	l.Info("rotation complete", Fields{"user": "ben", "outcome": outcomeSuccess, "duration_ms": 2 * time.Second})
+	l.Error("password reset failed", errors.New("rejected s3cret-Passw0rd"), Fields{"user": "ben"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines; got %q", buf.String())
+	}
+	for i, expected := range []map[string]interface{}{
+		{"level": "info", "msg": "rotation complete", "run_id": "r1", "env": "dev", "user": "ben", "outcome": "success", "duration_ms": 2000.0},
+		{"level": "error", "msg": "password reset failed", "run_id": "r1", "env": "dev", "user": "ben", "error": "rejected [REDACTED]"},
+	} {
+		got := map[string]interface{}{}
+		dec := json.NewDecoder(bytes.NewReader([]byte(lines[i])))
+		err := dec.Decode(&got)
+		if err != nil {
+			t.Fatalf("Line %d is not JSON: %s: %q", i, err, lines[i])
+		}
+		for k, v := range expected {
+			if got[k] != v {
+				t.Fatalf("Line %d: expected %s=%v; got %v in %q", i, k, v, got[k], lines[i])
+			}
+		}
+		if got["time"] == nil || !strings.HasPrefix(got["caller"].(string), "logger_test.go:") {
+			t.Fatalf("Line %d: expected time and caller; got %q", i, lines[i])
+		}
+	}
+}
@@ -4,16 +4,19 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"log"
+	"mime"
 	"mime/multipart"
+	"mime/quotedprintable"
 	"net/mail"
-	"net/smtp"
 	"net/textproto"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	b64 "encoding/base64"
+
+	"github.com/xuri/excelize/v2"
 )
 
 const (
@@ -23,6 +26,16 @@ const (
 	charSet          = "UTF-8"
 )
 
+// notification policies, for mail.notify
+const (
+	notifyAlways    = "always"
+	notifyOnChange  = "on-change"  // a password changed, or a user was added or deleted
+	notifyOnFailure = "on-failure" // a rotation failed
+	notifyNever     = "never"
+)
+
+var notifyPolicies = []string{notifyAlways, notifyOnChange, notifyOnFailure, notifyNever}
+
 const (
 	FileMimeType           = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
 	FileContentDisposition = "attachment"
@@ -38,39 +51,67 @@ func addHeader(headers *textproto.MIMEHeader, key, value string) {
 	headers.Add(h, value)
 }
 
-// create a multipart MIME message with text and file attachment
-func setBody(headers *textproto.MIMEHeader, body *bytes.Buffer, filename string) error {
-
-	multipartType := "fixed"
-
-	// create a new multipart writer
-	writer := multipart.NewWriter(body)
-	contentType := "multipart/" + multipartType + ";\n \tboundary=" + writer.Boundary()
-	// add header to main header group
-	setHeader(headers, "Content-Type", contentType)
-
-	// add text part
-	textBody := "\r\nPlease see attached file with portal accounts.\r\n"
-	textHeader := make(textproto.MIMEHeader)
-	setHeader(&textHeader, "Content-Type", "text/plain; charset="+charSet)
-	setHeader(&textHeader, "Content-Transfer-Encoding", bodyEncoding)
-	p, err := writer.CreatePart(textHeader)
+// Create the MIME tree of the message: the text and HTML bodies as
+// alternatives, followed by the file attachment unless filename is empty
+//
+//	multipart/mixed
+//	  multipart/alternative
+//	    text/plain
+//	    text/html
+//	  attachment
+func setBody(headers *textproto.MIMEHeader, body *bytes.Buffer, text, html, filename string) error {
+	mixed := multipart.NewWriter(body)
+	setHeader(headers, "MIME-Version", "1.0")
+	setHeader(headers, "Content-Type", "multipart/mixed;\n \tboundary="+mixed.Boundary())
+
+	// the alternatives go in a part of their own, which needs their boundary
+	// in its header
+	alternatives := &bytes.Buffer{}
+	alternative := multipart.NewWriter(alternatives)
+	for _, part := range []struct {
+		contentType, content string
+	}{
+		{"text/plain", text},
+		{"text/html", html},
+	} {
+		partHeader := make(textproto.MIMEHeader)
+		setHeader(&partHeader, "Content-Type", part.contentType+"; charset="+charSet)
+		setHeader(&partHeader, "Content-Transfer-Encoding", "quoted-printable")
+		p, err := alternative.CreatePart(partHeader)
+		if err != nil {
+			return err
+		}
+		qp := quotedprintable.NewWriter(p)
+		_, err = qp.Write([]byte(part.content))
+		if err != nil {
+			return err
+		}
+		err = qp.Close()
+		if err != nil {
+			return err
+		}
+	}
+	err := alternative.Close()
 	if err != nil {
 		return err
 	}
-	_, err = p.Write([]byte(b64.StdEncoding.EncodeToString([]byte(textBody))))
+	alternativeHeader := make(textproto.MIMEHeader)
+	setHeader(&alternativeHeader, "Content-Type", "multipart/alternative;\n \tboundary="+alternative.Boundary())
+	p, err := mixed.CreatePart(alternativeHeader)
 	if err != nil {
 		return err
 	}
-
-	// add file attachment part
-	fp, err := os.Open(filename)
+	_, err = p.Write(alternatives.Bytes())
 	if err != nil {
 		return err
 	}
-	defer fp.Close()
 
-	data, err := io.ReadAll(fp)
+	if filename == "" {
+		return mixed.Close()
+	}
+
+	// add file attachment part
+	data, err := os.ReadFile(filename)
 	if err != nil {
 		return err
 	}
@@ -81,20 +122,29 @@ func setBody(headers *textproto.MIMEHeader, body *bytes.Buffer, filename string)
 	setHeader(&fileHeader, "Content-Transfer-Encoding", bodyEncoding)
 	value = fmt.Sprintf("attachment;\n \tfilename=%q", AttachedFileName)
 	setHeader(&fileHeader, "Content-Disposition", value)
-	p, err = writer.CreatePart(fileHeader)
+	p, err = mixed.CreatePart(fileHeader)
 	if err != nil {
 		return err
 	}
-	_, err = p.Write([]byte(b64.StdEncoding.EncodeToString(data)))
+	err = writeBase64(p, data)
 	if err != nil {
 		return err
 	}
 
-	err = writer.Close()
-	if err != nil {
-		return err
-	}
+	return mixed.Close()
+}
 
+// Write data in base64, in lines of 76 characters as MIME requires
+func writeBase64(w io.Writer, data []byte) error {
+	encoded := b64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 0 {
+		n := minInt(len(encoded), 76)
+		_, err := io.WriteString(w, encoded[:n]+"\r\n")
+		if err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
 	return nil
 }
 
@@ -122,7 +172,7 @@ func validateRecipientAddresses(addresses []string) ([]string, error) {
 		if len(addr) > 0 {
 			a, err := mail.ParseAddress(addr)
 			if err != nil {
-				log.Printf("Info: validating recipient address %s: %s", addr, err)
+				logger.Warn("skipping invalid recipient address", err, Fields{"address": addr})
 				continue
 			}
 			validAddresses = append(validAddresses, a.Address)
@@ -135,56 +185,243 @@ func validateRecipientAddresses(addresses []string) ([]string, error) {
 	return validAddresses, nil
 }
 
-func sendEmail(filename string) error {
+// Email the workbook to the configured recipients: the whole workbook to
+// mail.toAddresses, and to each mail group a copy with only its sheets. Every
+// recipient is tried before an error is returned.
+func sendEmail(f *excelize.File, input *Input, report *RunReport) error {
+	if !input.Mail.Enabled {
+		logger.Info("mail is not enabled", nil)
+		return nil
+	}
 
-	host := os.Getenv("MAILSMTPHOST")
-	port := os.Getenv("MAILSMTPPORT")
+	if input.Mail.SenderName == "" || input.Mail.FromAddress == "" {
+		return fmt.Errorf("Error sending email: missing sender name and/or sender address")
+	}
 
-	senderName := os.Getenv("MAILSENDERNAME")
-	fromAddress := os.Getenv("MAILFROMADDRESS")
-	toAddresses := strings.Split(os.Getenv("MAILTOADDRESSES"), ",")
-	headers := make(textproto.MIMEHeader)
-	body := new(bytes.Buffer)
-	mailEnabled := strings.ToLower(os.Getenv("MAILENABLED"))
+	failed := []string{}
+	if len(input.Mail.ToAddresses) > 0 {
+		data := newMailData(report, nil, "")
+		if notifies(input.Mail.Notify, data) {
+			err := sendWorkbook(f, input, data, input.Mail.ToAddresses)
+			if err != nil {
+				failed = append(failed, err.Error())
+			}
+		} else {
+			logger.Info("nothing to email", Fields{"notify": input.Mail.Notify})
+		}
+	}
+	for _, group := range input.Mail.Groups {
+		err := sendGroupWorkbook(f, input, report, group)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("mail group %s: %s", group.Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
 
-	if mailEnabled != "true" {
-		log.Println("Mail feature is not enabled")
+// Email a mail group a copy of the workbook with only the group's sheets
+func sendGroupWorkbook(f *excelize.File, input *Input, report *RunReport, group MailGroup) error {
+	data := newMailData(report, append([]Environment{}, group.Environments...), group.Name)
+	if !notifies(input.Mail.Notify, data) {
+		logger.Info("nothing to email", Fields{"notify": input.Mail.Notify, "group": group.Name})
 		return nil
 	}
 
-	if senderName == "" || fromAddress == "" {
-		return fmt.Errorf("Error sending email: missing sender name and/or sender address")
+	sheets, err := mailGroupSheets(f, input, group)
+	if err != nil {
+		return err
+	}
+	if len(sheets) == 0 {
+		logger.Info("no sheets to email", Fields{"group": group.Name})
+		return nil
 	}
 
-	validatedToAddresses, err := validateRecipientAddresses(toAddresses)
+	filtered, err := filterWorkbook(f, sheets)
 	if err != nil {
-		return fmt.Errorf("Error sending email: %s", err)
+		return err
 	}
+	filtered.Path = filepath.Join(filepath.Dir(f.Path), group.Name+"-"+filepath.Base(f.Path))
+	return sendWorkbook(filtered, input, data, group.ToAddresses)
+}
 
-	protectedFilename, err := protectExcelWorkbook(filename)
+// Get the sheets a mail group receives, in workbook order. Environments not
+// rotated in this run add no sheets.
+func mailGroupSheets(f *excelize.File, input *Input, group MailGroup) ([]string, error) {
+	wanted := map[string]bool{}
+	for _, env := range group.Environments {
+		sheetGroup, ok := input.SheetGroups[env]
+		if !ok {
+			continue
+		}
+		wanted[sheetGroup.PortalSheetName] = true
+		for _, sheet := range sheetGroup.TestingSheetNames {
+			wanted[sheet] = true
+		}
+		if !group.OmitAutomatedSheets {
+			wanted[sheetGroup.AutomatedSheetName] = true
+		}
+	}
+	for _, sheet := range group.Sheets {
+		if f.GetSheetIndex(sheet) == -1 {
+			return nil, fmt.Errorf("sheet %s is not in the workbook", sheet)
+		}
+		wanted[sheet] = true
+	}
+
+	sheets := []string{}
+	for _, sheet := range f.GetSheetList() {
+		if wanted[sheet] {
+			sheets = append(sheets, sheet)
+		}
+	}
+	return sheets, nil
+}
+
+// Copy the values of sheets into a new workbook. The copy is built rather
+// than cut down from the original so that nothing of the other sheets, such
+// as their shared strings, is left in it.
+func filterWorkbook(f *excelize.File, sheets []string) (*excelize.File, error) {
+	filtered := excelize.NewFile()
+	for i, sheet := range sheets {
+		if i == 0 {
+			filtered.SetSheetName(filtered.GetSheetName(0), sheet)
+		} else {
+			filtered.NewSheet(sheet)
+		}
+
+		rows, err := f.GetRows(sheet)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading sheet %s: %s", sheet, err)
+		}
+		for y, row := range rows {
+			values := make([]interface{}, len(row))
+			for x, value := range row {
+				values[x] = value
+			}
+			cell, err := excelize.CoordinatesToCellName(1, y+1)
+			if err != nil {
+				return nil, err
+			}
+			err = filtered.SetSheetRow(sheet, cell, &values)
+			if err != nil {
+				return nil, fmt.Errorf("Error copying sheet %s: %s", sheet, err)
+			}
+		}
+	}
+	filtered.SetActiveSheet(0)
+	return filtered, nil
+}
+
+// Whether a notification policy calls for an email to recipients whose
+// part of the run is summarized by data. An empty policy is always.
+func notifies(policy string, data *MailData) bool {
+	switch policy {
+	case notifyAlways, "":
+		return true
+	case notifyOnChange:
+		return data.changed()
+	case notifyOnFailure:
+		return data.Failed > 0 || len(data.HeartbeatFailures) > 0
+	}
+	return false
+}
+
+// Email every recipient that the run stopped with an error, without the
+// workbook. Only mail.notify never turns the alert off.
+func sendAlertEmail(input *Input, report *RunReport) error {
+	if !input.Mail.Enabled || input.Mail.Notify == notifyNever {
+		return nil
+	}
+
+	failed := []string{}
+	if len(input.Mail.ToAddresses) > 0 {
+		err := sendMessage(input, newMailData(report, nil, ""), input.Mail.ToAddresses, "")
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	for _, group := range input.Mail.Groups {
+		data := newMailData(report, append([]Environment{}, group.Environments...), group.Name)
+		err := sendMessage(input, data, group.ToAddresses, "")
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("mail group %s: %s", group.Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	logger.Info("emailed alert", Fields{"error": report.Error})
+	return nil
+}
+
+// Encrypt a workbook and email it to addresses, with a subject and body
+// rendered from data
+func sendWorkbook(f *excelize.File, input *Input, data *MailData, addresses []string) error {
+	protectedFilename, err := protectExcelWorkbook(f, input.WorkbookPassword)
+	if err != nil {
+		return err
+	}
+	err = sendMessage(input, data, addresses, protectedFilename)
 	if err != nil {
 		return err
 	}
 
+	fields := Fields{"attachment": AttachedFileName, "recipients": len(addresses), "sheets": len(f.GetSheetList())}
+	if data.Group != "" {
+		fields["group"] = data.Group
+	}
+	logger.Info("emailed workbook", fields)
+	return nil
+}
+
+// Email addresses a message rendered from data, with the file attachment
+// if there is one
+func sendMessage(input *Input, data *MailData, addresses []string, attachment string) error {
+	fromAddress := input.Mail.FromAddress
+	headers := make(textproto.MIMEHeader)
+	body := new(bytes.Buffer)
+
+	validatedToAddresses, err := validateRecipientAddresses(addresses)
+	if err != nil {
+		return fmt.Errorf("Error sending email: %s", err)
+	}
+
+	if attachment == "" {
+		data.Attachment = ""
+	}
 	setHeader(&headers, "From", fromAddress)
 	for _, address := range validatedToAddresses {
 		addHeader(&headers, "To", address)
 	}
-	setHeader(&headers, "Subject", mailSubject)
-	err = setBody(&headers, body, protectedFilename)
+	templates := input.MailTemplates
+	if templates == nil {
+		templates, err = parseMailTemplates(defaultSubjectTemplate, defaultTextTemplate, defaultHTMLTemplate)
+		if err != nil {
+			return err
+		}
+	}
+	subject, text, html, err := templates.render(data)
+	if err != nil {
+		return fmt.Errorf("Error sending email: %s", err)
+	}
+	setHeader(&headers, "Subject", mime.QEncoding.Encode(charSet, subject))
+	err = setBody(&headers, body, text, html, attachment)
 	if err != nil {
 		return fmt.Errorf("Error sending email: %s", err)
 	}
 
 	msgString := toMIMEString(&headers, body)
 
-	err = smtp.SendMail(host+":"+port, nil, fromAddress, validatedToAddresses, []byte(msgString))
+	mailer, err := newSMTPMailer(input.Mail)
+	if err != nil {
+		return fmt.Errorf("Error sending mail: %s", err)
+	}
+	err = mailer.send(fromAddress, validatedToAddresses, []byte(msgString))
 	if err != nil {
 		return fmt.Errorf("Error sending mail: %s", err)
 	}
-
-	log.Printf("successfully emailed %s", AttachedFileName)
-
 	return nil
-
 }
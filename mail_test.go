@@ -0,0 +1,110 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestFilterWorkbook(t *testing.T) {
+	f := excelize.NewFile()
+	f.SetSheetName("Sheet1", "Instructions")
+	for _, sheet := range []string{"Portal-VAL", "PasswordManager-VAL", "VAL", "Portal-PROD", "PasswordManager-PROD", "PROD"} {
+		f.NewSheet(sheet)
+		f.SetCellValue(sheet, "A1", "User")
+		f.SetCellValue(sheet, "B1", "Password")
+		f.SetCellValue(sheet, "A2", strings.ToLower(sheet)+"-user")
+		f.SetCellValue(sheet, "B2", sheet+"-secret")
+	}
+	input := &Input{SheetGroups: map[Environment]SheetGroup{
+		val:  {AutomatedSheetName: "PasswordManager-VAL", PortalSheetName: "Portal-VAL", TestingSheetNames: []string{"VAL"}},
+		prod: {AutomatedSheetName: "PasswordManager-PROD", PortalSheetName: "Portal-PROD", TestingSheetNames: []string{"PROD"}},
+	}}
+
+	for _, tc := range []struct {
+		group    MailGroup
+		expected []string
+	}{
+		{MailGroup{Environments: []Environment{val}}, []string{"Portal-VAL", "PasswordManager-VAL", "VAL"}},
+		{MailGroup{Environments: []Environment{val}, OmitAutomatedSheets: true, Sheets: []string{"Instructions"}}, []string{"Instructions", "Portal-VAL", "VAL"}},
+		// environments not rotated in this run add nothing
+		{MailGroup{Environments: []Environment{dev}}, []string{}},
+	} {
+		sheets, err := mailGroupSheets(f, input, tc.group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(sheets, ",") != strings.Join(tc.expected, ",") {
+			t.Fatalf("Expected sheets %v for %+v; got %v", tc.expected, tc.group, sheets)
+		}
+	}
+	_, err := mailGroupSheets(f, input, MailGroup{Sheets: []string{"Missing"}})
+	if err == nil {
+		t.Fatal("Expected an error for a sheet missing from the workbook")
+	}
+
+	filtered, err := filterWorkbook(f, []string{"Portal-VAL", "VAL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := filtered.GetSheetList(); strings.Join(list, ",") != "Portal-VAL,VAL" {
+		t.Fatalf("Expected only the VAL sheets; got %v", list)
+	}
+	if v, _ := filtered.GetCellValue("VAL", "B2"); v != "VAL-secret" {
+		t.Fatalf("Expected VAL's password to be copied; got %q", v)
+	}
+
+	// nothing of the other sheets is anywhere in the package
+	buf, err := filtered.WriteToBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range z.File {
+		rc, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		if bytes.Contains(b, []byte("PROD")) || bytes.Contains(b, []byte("PasswordManager")) {
+			t.Fatalf("Found another sheet's contents in %s: %s", file.Name, b)
+		}
+	}
+}
+
+func TestNotifies(t *testing.T) {
+	report := newRunReport("run1", time.Now())
+	report.add(ReportRecord{Environment: dev, User: "ann", Action: actionSkipped})
+	report.add(ReportRecord{Environment: val, User: "ben", Action: actionDeleted})
+	report.add(ReportRecord{Environment: prod, User: "cal", Action: actionFailed, ErrorClass: "transient"})
+
+	for _, tc := range []struct {
+		envs     []Environment
+		policy   string
+		expected bool
+	}{
+		{[]Environment{dev}, notifyAlways, true},
+		{[]Environment{dev}, "", true},
+		{[]Environment{dev}, notifyOnChange, false},
+		{[]Environment{dev}, notifyOnFailure, false},
+		{[]Environment{val}, notifyOnChange, true},
+		{[]Environment{val}, notifyOnFailure, false},
+		{[]Environment{prod}, notifyOnChange, false},
+		{[]Environment{prod}, notifyOnFailure, true},
+		{nil, notifyOnChange, true},
+		{nil, notifyNever, false},
+	} {
+		if got := notifies(tc.policy, newMailData(report, tc.envs, "")); got != tc.expected {
+			t.Fatalf("Expected %v for policy %q in %v; got %v", tc.expected, tc.policy, tc.envs, got)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+// the built-in mail templates, used unless mail.subjectTemplate,
+// mail.textTemplate or mail.htmlTemplate name others
+const (
+	defaultSubjectTemplate = mailSubject + `{{if .Error}}: rotation failed{{else}}{{with .Failed}} ({{.}} failed){{end}}{{end}}`
+
+	defaultTextTemplate = `{{if .Error}}The password rotation run stopped with an error, and the workbook was not sent:
+{{.Error}}
+{{else}}Please see attached file with portal accounts.
+{{end}}{{range .Environments}}
+{{.Environment}}: {{.Rotated}} rotated, {{.Recovered}} recovered, {{.Added}} added, {{.Deleted}} deleted, {{.Skipped}} not due, {{.Failed}} failed, {{.Heartbeats}} heartbeat logins
+{{- end}}
+{{with .NeedsAttention}}
+Accounts needing manual attention:
+{{range .}}  {{.Environment}} {{.User}}: {{.ErrorClass}}
+{{end}}{{end}}{{with .Failures}}
+Other failed rotations, retried on the next run:
+{{range .}}  {{.Environment}} {{.User}}: {{.ErrorClass}}
+{{end}}{{end}}{{with .HeartbeatFailures}}
+Failed heartbeat logins, whose accounts IDM may deactivate:
+{{range .}}  {{.Environment}} {{.User}}: {{.ErrorClass}}
+{{end}}{{end}}{{with .Quarantined}}
+Quarantined accounts, not logged in until unlocked and their Quarantined cell is cleared:
+{{range .}}  {{.Environment}} {{.User}}: {{.Quarantined}}
+{{end}}{{end}}
+Run {{.RunID}}, started {{.Started.Format "2006-01-02 15:04 MST"}}
+`
+
+	defaultHTMLTemplate = `<!DOCTYPE html>
+<html>
+<body>
+{{if .Error}}<p>The password rotation run stopped with an error, and the workbook was not sent:</p>
+<pre>{{.Error}}</pre>
+{{else}}<p>Please see attached file with portal accounts.</p>
+{{end}}{{with .Environments}}<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Environment</th><th>Rotated</th><th>Recovered</th><th>Added</th><th>Deleted</th><th>Not due</th><th>Failed</th><th>Heartbeat logins</th></tr>
+{{range .}}<tr><td>{{.Environment}}</td><td>{{.Rotated}}</td><td>{{.Recovered}}</td><td>{{.Added}}</td><td>{{.Deleted}}</td><td>{{.Skipped}}</td><td>{{.Failed}}</td><td>{{.Heartbeats}}</td></tr>
+{{end}}</table>{{end}}
+{{with .NeedsAttention}}<h3>Accounts needing manual attention</h3>
+<ul>
+{{range .}}<li>{{.Environment}} {{.User}}: {{.ErrorClass}}</li>
+{{end}}</ul>{{end}}
+{{with .Failures}}<h3>Other failed rotations, retried on the next run</h3>
+<ul>
+{{range .}}<li>{{.Environment}} {{.User}}: {{.ErrorClass}}</li>
+{{end}}</ul>{{end}}
+{{with .HeartbeatFailures}}<h3>Failed heartbeat logins, whose accounts IDM may deactivate</h3>
+<ul>
+{{range .}}<li>{{.Environment}} {{.User}}: {{.ErrorClass}}</li>
+{{end}}</ul>{{end}}
+{{with .Quarantined}}<h3>Quarantined accounts, not logged in until unlocked and their Quarantined cell is cleared</h3>
+<ul>
+{{range .}}<li>{{.Environment}} {{.User}}: {{.Quarantined}}</li>
+{{end}}</ul>{{end}}
+<p>Run {{.RunID}}, started {{.Started.Format "2006-01-02 15:04 MST"}}</p>
+</body>
+</html>
+`
+)
+
+// failures that another run will not fix
+var attentionClasses = map[string]bool{
+	errorClass(ErrInvalidCredentials):     true,
+	errorClass(ErrAccountLocked):          true,
+	errorClass(ErrPasswordPolicyRejected): true,
+	errorClass(ErrPasswordExpired):        true,
+	errorClass(ErrMFARequired):            true,
+}
+
+// MailTemplates render the subject and the text and HTML bodies of the
+// email.
+type MailTemplates struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// MailData is what the mail templates are executed with. A mail group's
+// email covers only the group's environments.
+type MailData struct {
+	RunID          string
+	Started        time.Time
+	Group          string // mail group, or empty for the whole workbook
+	Attachment     string // empty if the workbook is not attached
+	Error          string // why the run stopped, for an alert
+	Environments   []MailEnvironmentSummary
+	Rotated        []ReportRecord // rotated, recovered or added
+	NeedsAttention []ReportRecord // failures another run will not fix, such as a locked account
+	Failures       []ReportRecord // other failures, which the next run retries
+	Failed         int            // all failed rotations
+
+	HeartbeatFailures []ReportRecord // failed heartbeat logins
+	Quarantined       []ReportRecord // locked or failing accounts that are no longer logged in
+}
+
+// MailEnvironmentSummary counts the actions taken in an environment.
+type MailEnvironmentSummary struct {
+	Environment Environment `json:"environment"`
+	Rotated     int         `json:"rotated"`
+	Recovered   int         `json:"recovered"`
+	Added       int         `json:"added"`
+	Deleted     int         `json:"deleted"`
+	Skipped     int         `json:"skipped"`
+	Failed      int         `json:"failed"`
+
+	Heartbeats       int `json:"heartbeats"`       // logged in without rotating
+	HeartbeatsFailed int `json:"heartbeatsFailed"` // heartbeat logins that failed
+
+	Quarantined int `json:"quarantined"` // users whose logins are stopped
+}
+
+// Load the mail templates, each from a local file or an s3://bucket/key URI,
+// or the built-in template where none is configured
+func loadMailTemplates(c MailConfig, client S3ClientAPI) (*MailTemplates, error) {
+	sources := map[string]string{}
+	for _, t := range []struct {
+		path, field, env, fallback string
+	}{
+		{c.SubjectTemplate, "subjectTemplate", "MAILSUBJECTTEMPLATE", defaultSubjectTemplate},
+		{c.TextTemplate, "textTemplate", "MAILTEXTTEMPLATE", defaultTextTemplate},
+		{c.HTMLTemplate, "htmlTemplate", "MAILHTMLTEMPLATE", defaultHTMLTemplate},
+	} {
+		sources[t.field] = t.fallback
+		if t.path == "" {
+			continue
+		}
+		b, err := readFileOrS3(t.path, client)
+		if err != nil {
+			return nil, fmt.Errorf("mail.%s (%s): %s", t.field, t.env, err)
+		}
+		sources[t.field] = string(b)
+	}
+	return parseMailTemplates(sources["subjectTemplate"], sources["textTemplate"], sources["htmlTemplate"])
+}
+
+func parseMailTemplates(subject, text, html string) (*MailTemplates, error) {
+	t := &MailTemplates{}
+	var err error
+	t.subject, err = texttemplate.New("subject").Option("missingkey=error").Parse(subject)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing subject template: %s", err)
+	}
+	t.text, err = texttemplate.New("text").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing text template: %s", err)
+	}
+	t.html, err = htmltemplate.New("html").Option("missingkey=error").Parse(html)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing HTML template: %s", err)
+	}
+
+	// catch references to fields that do not exist before a run needs them
+	_, _, _, err = t.render(&MailData{Started: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Render the subject, on one line, and the text and HTML bodies
+func (t *MailTemplates) render(data *MailData) (subject, text, html string, err error) {
+	buf := &bytes.Buffer{}
+	err = t.subject.Execute(buf, data)
+	if err != nil {
+		return "", "", "", fmt.Errorf("Error rendering subject template: %s", err)
+	}
+	subject = strings.Join(strings.Fields(buf.String()), " ")
+
+	buf.Reset()
+	err = t.text.Execute(buf, data)
+	if err != nil {
+		return "", "", "", fmt.Errorf("Error rendering text template: %s", err)
+	}
+	text = buf.String()
+
+	buf.Reset()
+	err = t.html.Execute(buf, data)
+	if err != nil {
+		return "", "", "", fmt.Errorf("Error rendering HTML template: %s", err)
+	}
+	return subject, text, buf.String(), nil
+}
+
+// Whether a password changed or a user was added or deleted
+func (d *MailData) changed() bool {
+	if len(d.Rotated) > 0 {
+		return true
+	}
+	for _, env := range d.Environments {
+		if env.Deleted > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Summarize a run report for the mail templates. envs limits the summary to
+// some environments, or is nil for all of them.
+func newMailData(report *RunReport, envs []Environment, group string) *MailData {
+	data := &MailData{
+		RunID:      report.RunID,
+		Started:    report.Started,
+		Group:      group,
+		Attachment: AttachedFileName,
+		Error:      report.Error,
+	}
+	included := map[Environment]bool{}
+	for _, env := range envs {
+		included[env] = true
+	}
+
+	summaries := map[Environment]*MailEnvironmentSummary{}
+	order := []Environment{}
+	for _, rec := range report.Records {
+		if envs != nil && !included[rec.Environment] {
+			continue
+		}
+		s, ok := summaries[rec.Environment]
+		if !ok {
+			s = &MailEnvironmentSummary{Environment: rec.Environment}
+			summaries[rec.Environment] = s
+			order = append(order, rec.Environment)
+		}
+		switch rec.Action {
+		case actionRotated:
+			s.Rotated++
+			data.Rotated = append(data.Rotated, rec)
+		case actionRecovered:
+			s.Recovered++
+			data.Rotated = append(data.Rotated, rec)
+		case actionAdded:
+			s.Added++
+			data.Rotated = append(data.Rotated, rec)
+		case actionDeleted:
+			s.Deleted++
+		case actionSkipped:
+			s.Skipped++
+		case actionFailed:
+			s.Failed++
+			data.Failed++
+			if attentionClasses[rec.ErrorClass] {
+				data.NeedsAttention = append(data.NeedsAttention, rec)
+			} else {
+				data.Failures = append(data.Failures, rec)
+			}
+		case actionHeartbeat:
+			s.Heartbeats++
+		case actionHeartbeatFailed:
+			s.HeartbeatsFailed++
+			data.HeartbeatFailures = append(data.HeartbeatFailures, rec)
+		}
+		if rec.Quarantined != "" {
+			s.Quarantined++
+			data.Quarantined = append(data.Quarantined, rec)
+		}
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+	for _, env := range order {
+		data.Environments = append(data.Environments, *summaries[env])
+	}
+	return data
+}
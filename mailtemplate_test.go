@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMailTemplates(t *testing.T) {
+	report := newRunReport("run1", time.Date(2026, 3, 2, 4, 5, 0, 0, time.UTC))
+	report.add(ReportRecord{Environment: val, User: "ann", Action: actionRotated})
+	report.add(ReportRecord{Environment: val, User: "ben", Action: actionSkipped})
+	report.add(ReportRecord{Environment: dev, User: "<b>cal</b>", Action: actionFailed, ErrorClass: "account locked"})
+	report.add(ReportRecord{Environment: dev, User: "dee", Action: actionFailed, ErrorClass: "transient"})
+	report.add(ReportRecord{Environment: dev, User: "eve", Action: actionAdded})
+
+	data := newMailData(report, nil, "")
+	if len(data.Environments) != 2 || data.Environments[0].Environment != dev || data.Environments[1].Environment != val {
+		t.Fatalf("Expected dev and val summaries in order; got %+v", data.Environments)
+	}
+	if d := data.Environments[0]; d.Failed != 2 || d.Added != 1 || d.Rotated != 0 {
+		t.Fatalf("Unexpected dev summary %+v", d)
+	}
+	if data.Failed != 2 || len(data.NeedsAttention) != 1 || data.NeedsAttention[0].User != "<b>cal</b>" ||
+		len(data.Failures) != 1 || data.Failures[0].User != "dee" || len(data.Rotated) != 2 {
+		t.Fatalf("Unexpected mail data %+v", data)
+	}
+	if valOnly := newMailData(report, []Environment{val}, "val"); len(valOnly.Environments) != 1 || valOnly.Failed != 0 || valOnly.Group != "val" {
+		t.Fatalf("Expected only val; got %+v", valOnly)
+	}
+
+	templates, err := loadMailTemplates(MailConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, text, html, err := templates.render(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != mailSubject+" (2 failed)" {
+		t.Fatalf("Unexpected subject %q", subject)
+	}
+	for _, expected := range []string{"dev: 0 rotated, 0 recovered, 1 added, 0 deleted, 0 not due, 2 failed", "<b>cal</b>: account locked", "dee: transient", "Run run1, started 2026-03-02 04:05 UTC"} {
+		if !strings.Contains(text, expected) {
+			t.Fatalf("Expected %q in the text body:\n%s", expected, text)
+		}
+	}
+	if !strings.Contains(html, "&lt;b&gt;cal&lt;/b&gt;") || strings.Contains(html, "<b>cal") {
+		t.Fatalf("Expected user names to be escaped in the HTML body:\n%s", html)
+	}
+
+	// templates from files and S3
+	dir := t.TempDir()
+	subjectPath := filepath.Join(dir, "subject.tmpl")
+	os.WriteFile(subjectPath, []byte("Rotation {{.RunID}}\n{{if .NeedsAttention}}needs attention{{end}}"), 0600)
+	fc := &FakeS3Client{Bucket: "bucket", Objects: map[string][]byte{"mail/text.tmpl": []byte("{{.Failed}} failed")}}
+	templates, err = loadMailTemplates(MailConfig{SubjectTemplate: subjectPath, TextTemplate: "s3://bucket/mail/text.tmpl"}, fc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, text, _, err = templates.render(data)
+	if err != nil || subject != "Rotation run1 needs attention" || text != "2 failed" {
+		t.Fatalf("Unexpected subject %q and text %q, %v", subject, text, err)
+	}
+
+	for name, c := range map[string]MailConfig{
+		"missing file":  {HTMLTemplate: filepath.Join(dir, "missing.html")},
+		"syntax":        {SubjectTemplate: "s3://bucket/bad.tmpl"},
+		"unknown field": {TextTemplate: "s3://bucket/unknown.tmpl"},
+	} {
+		fc.Objects["bad.tmpl"] = []byte("{{.RunID")
+		fc.Objects["unknown.tmpl"] = []byte("{{.Failures.Count}}")
+		if _, err := loadMailTemplates(c, fc); err == nil {
+			t.Fatalf("Expected an error for a template with %s", name)
+		}
+	}
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/cookiejar"
 	"os"
-	"path"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/xuri/excelize/v2"
 )
 
 type Column int
-type Environment int
+type Environment string
 
 const (
 	ColUser Column = iota
@@ -29,32 +33,106 @@ const (
 	ColTimestampHeading = "Timestamp"
 )
 
+// headings of the optional columns that set a user's rotation policy in the
+// automated or portal sheet
 const (
-	maxPasswordAgeDays int = 28
+	ColMaxAgeDaysHeading     = "Max Age Days"
+	ColPasswordLengthHeading = "Password Length"
+	ColExcludeCharsHeading   = "Exclude Chars"
 )
 
+// heading of the automated sheet column that holds each user's last
+// successful login, added when a login is first recorded
+const ColLastLoginHeading = "Last Login"
+
+// heading of the automated sheet column that holds the result of each user's
+// last verification, added by the verify command
+const ColStatusHeading = "Status"
+
+// headings of the automated sheet columns that count each user's consecutive
+// failed logins and hold why the user's logins stopped, added when a login
+// first fails with quarantine enabled
+const (
+	ColFailedLoginsHeading = "Failed Logins"
+	ColQuarantinedHeading  = "Quarantined"
+)
+
+// heading of the optional automated sheet column that holds the TOTP secret of
+// each user enrolled in MFA, encrypted with the automated sheet password
+const ColTOTPSecretHeading = "TOTP Secret"
+
+// the optional automated sheet columns the app adds and maintains
+var trackingHeadings = []string{ColLastLoginHeading, ColStatusHeading, ColFailedLoginsHeading, ColQuarantinedHeading}
+
+const (
+	maxPasswordAgeDays int = 28 // default
+)
+
+// names of the default environments
 const (
-	dev Environment = iota
-	val
-	prod
+	dev  Environment = "dev"
+	val  Environment = "val"
+	prod Environment = "prod"
 )
 
+func (e Environment) String() string {
+	return string(e)
+}
+
 type Input struct {
 	Bucket                         string
 	Key                            string
 	UsernameHeader                 string
 	PasswordHeader                 string
 	AutomatedSheetPassword         string
+	WorkbookPassword               string // protects the emailed workbook
+	Policies                       map[Environment]UserPolicy
+	Mail                           MailConfig
+	MailTemplates                  *MailTemplates // nil for the built-in templates
+	Webhooks                       []WebhookConfig
+	Notifiers                      []Notifier    // told how each run went
+	Workers                        int           // users rotated at once
+	UploadBatchSize                int           // failed rotations per workbook upload; a new password is uploaded at once
+	UploadInterval                 time.Duration // longest wait before uploading a partial batch
+	MetricsNamespace               string
+	ReportPrefix                   string // key prefix of run reports in Bucket
+	RunID                          string
 	AutomatedSheetColNameToIndex   map[Column]int
 	AutomatedSheetColNameToHeading map[Column]string
 	RowOffset                      int // number of header rows (common to all sheets)
 	SheetGroups                    map[Environment]SheetGroup
 }
 
+// UserPolicy is how often a user's password is rotated and what the new
+// password looks like. Environment defaults can be overridden per user in the
+// optional policy columns.
+type UserPolicy struct {
+	MaxAgeDays    int
+	Password      PasswordPolicy
+	HeartbeatDays int // days without a login before a heartbeat; 0 or less for never
+
+	QuarantineAfter int // failed logins before logins stop; 0 or less for never
+}
+
+// Get the default policy for users in env
+func (input *Input) policy(env Environment) UserPolicy {
+	p := input.Policies[env]
+	if p.MaxAgeDays == 0 {
+		p.MaxAgeDays = maxPasswordAgeDays
+	}
+	if p.Password.MaxLength == 0 {
+		p.Password = passwordPolicies[defaultPasswordPolicy]
+	}
+	return p
+}
+
 type Portal struct {
 	Hostname    string
 	IDMHostname string // identity management hostname
 	Scheme      string
+
+	env     Environment  // for log lines
+	limiter *rateLimiter // nil for no limit
 }
 
 type SheetGroup struct {
@@ -68,155 +146,341 @@ type Creds struct {
 	NewPassword string
 }
 
-func portalClient() *http.Client {
+// Get a client with a fresh session for the portal, whose requests wait for
+// the portal's rate limit and are timed
+func portalClient(portal *Portal) *http.Client {
 	jar, err := cookiejar.New(nil)
 	if err != nil {
-		log.Fatal("Error creating cookiejar")
+		logger.Fatal("Error creating cookiejar", err, nil)
+	}
+	var transport http.RoundTripper = &meteredTransport{env: portal.env, next: http.DefaultTransport}
+	if portal.limiter != nil {
+		transport = &rateLimitedTransport{limiter: portal.limiter, next: transport}
 	}
 	return &http.Client{
-		Jar: jar,
+		Jar:       jar,
+		Transport: transport,
+	}
+}
+
+// rotationDue reports whether a password last rotated at timestamp needs to
+// be rotated at now.
+func rotationDue(timestamp string, now time.Time, maxAgeDays int) (bool, error) {
+	var lastRotated time.Time
+	if timestamp == "Rotate Now" {
+		// force rotation
+		lastRotated = now.AddDate(0, 0, -maxAgeDays-1)
+	} else {
+		var err error
+		lastRotated, err = time.Parse(time.UnixDate, timestamp)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// determine whether rotation is needed based on year, month, day only (ignore time of day)
+	refDate := time.Date(lastRotated.Year(), lastRotated.Month(), lastRotated.Day(), 0, 0, 0, 0, time.UTC)
+	return !now.Before(refDate.AddDate(0, 0, maxAgeDays)), nil
+}
+
+// Passwords other than the current one that the portal might accept for a
+// user, most likely first
+func passwordCandidates(current string, known ...string) []string {
+	candidates := []string{}
+	for _, password := range known {
+		if password == "" || password == current || contains(candidates, password) {
+			continue
+		}
+		candidates = append(candidates, password)
 	}
+	return candidates
 }
 
-func resetPasswords(f *excelize.File, input *Input, portal *Portal, s3Client S3ClientAPI, env Environment) (err error) {
+// Write a user's new password to the automated sheet, keeping the old one as
+// the previous password, and to the portal sheet. The password was changed
+// after a login, so the login is recorded too.
+func persistRotation(f *excelize.File, input *Input, env Environment, name string, row, portalRow int, newPassword string, now time.Time) error {
 	automatedSheet := input.SheetGroups[env].AutomatedSheetName
-	rows, err := f.GetRows(automatedSheet)
+	colPassword := input.AutomatedSheetColNameToIndex[ColPassword]
+	colPrevious := input.AutomatedSheetColNameToIndex[ColPrevious]
+	colTimestamp := input.AutomatedSheetColNameToIndex[ColTimestamp]
+
+	// copy password to previous col
+	err := copyCell(f, automatedSheet, colPassword, row, colPrevious, row)
+	if err != nil {
+		return fmt.Errorf("failed to write previous password to sheet %s, row %d for user %s: %s",
+			automatedSheet, toSheetCoord(row), name, err)
+	}
+
+	// write new password to password col
+	err = writeCell(f, automatedSheet, colPassword, row, newPassword)
+	if err != nil {
+		return fmt.Errorf("failed to write new password to sheet %s in row %d for user %s: %v; manually set password for user",
+			automatedSheet, toSheetCoord(row), name, err)
+	}
+	// set timestamp
+	ts := now.Format(time.UnixDate)
+	err = writeCell(f, automatedSheet, colTimestamp, row, ts)
+	if err != nil {
+		return fmt.Errorf("failed to write timestamp %s to sheet %s in row %d for user %s: %s", ts,
+			automatedSheet, toSheetCoord(row), name, err)
+	}
+	err = recordLogin(f, input, env, name, row, now)
 	if err != nil {
 		return err
 	}
 
+	// update password for user in macFin sheet
 	sheetName := input.SheetGroups[env].PortalSheetName
-	mcFinUsersToPasswordRow, err := getMACFinUsers(f, input, env)
+	mfRows, err := f.GetRows(sheetName)
 	if err != nil {
 		return err
 	}
-	mfRows, err := f.GetRows(sheetName)
+	passwordXCoord := getHeaderToXCoord(mfRows[0])[input.PasswordHeader]
+	err = writeCell(f, sheetName, passwordXCoord, portalRow, newPassword)
+	if err != nil {
+		return fmt.Errorf("failed to write password for user %s to sheet %s in row %d: %s", name,
+			sheetName, toSheetCoord(portalRow), err)
+	}
+	return nil
+}
+
+func resetPasswords(ctx context.Context, f *excelize.File, input *Input, portal *Portal, s3Client S3ClientAPI, env Environment, journal *Journal, report *RunReport) (err error) {
+	envLog := envLogger(input, env)
+	automatedSheet := input.SheetGroups[env].AutomatedSheetName
+	rows, err := f.GetRows(automatedSheet)
 	if err != nil {
 		return err
 	}
-	headerNameToXCoord := getHeaderToXCoord(mfRows[0])
-	passwordXCoord := headerNameToXCoord[input.PasswordHeader]
 
-	var now time.Time
+	mcFinUsersToPasswordRow, err := getMACFinUsers(f, input, env)
+	if err != nil {
+		return err
+	}
 
-	numSuccess := 0
-	numFail := 0
 	numNoRotation := 0
 	rowOffset := input.RowOffset
 	colUser := input.AutomatedSheetColNameToIndex[ColUser]
 	colPassword := input.AutomatedSheetColNameToIndex[ColPassword]
 	colPrevious := input.AutomatedSheetColNameToIndex[ColPrevious]
 	colTimestamp := input.AutomatedSheetColNameToIndex[ColTimestamp]
+	header := getHeaderToXCoord(rows[0])
+	colLastLogin, hasLastLogin := header[ColLastLoginHeading]
 
-	var lastRotated time.Time
-
-	randomPasswords := make([]string, len(rows)-rowOffset)
-	for i := 0; i < len(rows)-rowOffset; i++ {
-		password, err := getRandomPassword()
-		if err != nil {
-			return err
-		}
-		randomPasswords[i] = password
+	userToPolicy, err := getUserPolicies(f, input, env)
+	if err != nil {
+		return err
+	}
+	userToTOTPSecret, err := getTOTPSecrets(f, input, env)
+	if err != nil {
+		return err
 	}
 
+	now := time.Now().UTC()
+	jobs := []rotationJob{}
+	heartbeats := []heartbeatJob{}
+	quarantined := []string{}
 	for i, row := range rows[rowOffset:] {
-		// delete all cookies
-		client := portalClient()
-
-		now = time.Now().UTC()
 		name := row[colUser]
 
-		if row[colTimestamp] == "Rotate Now" {
-			// force rotation
-			lastRotated = now.AddDate(0, 0, -maxPasswordAgeDays-1)
-		} else {
-			lastRotated, err = time.Parse(time.UnixDate, row[colTimestamp])
-			if err != nil {
-				return fmt.Errorf("Error parsing timestamp from row %d for user %s: %s", toSheetCoord(i+rowOffset), name, err)
-			}
+		policy, ok := userToPolicy[name]
+		if !ok {
+			policy = input.policy(env)
 		}
 
-		// determine whether rotation is needed based on year, month, day only (ignore time of day)
-		refDate := time.Date(lastRotated.Year(), lastRotated.Month(), lastRotated.Day(), 0, 0, 0, 0, time.UTC)
-		if now.Before(refDate.AddDate(0, 0, maxPasswordAgeDays)) {
-			log.Printf("%s: no rotation needed", row[colUser])
-			numNoRotation++
+		lockout := readLockout(header, row)
+		if lockout.quarantined != "" {
+			envLog.Warn("user quarantined; not logging in", nil, Fields{"user": name, "outcome": outcomeSkipped, "quarantined": lockout.quarantined})
+			report.add(ReportRecord{Environment: env, User: name, Action: actionQuarantined, OldTimestamp: row[colTimestamp], Quarantined: lockout.quarantined})
+			quarantined = append(quarantined, name)
 			continue
-		} else {
-			newPassword := randomPasswords[i]
-			err = changeUserPassword(client, portal, name, row[colPassword], newPassword)
-			if err != nil {
-				numFail++
-				log.Printf("Error: user %s password reset FAIL: %s", name, err)
-				continue
-			}
-			numSuccess++
-			// copy password to previous col
-			err = copyCell(f, automatedSheet, colPassword, i+rowOffset, colPrevious, i+rowOffset)
-			if err != nil {
-				return fmt.Errorf("failed to write previous password %s to sheet %s, row %d for user %s: %s",
-					row[colPassword], automatedSheet, toSheetCoord(i+rowOffset), name, err)
-			}
+		}
 
-			// write new password to password col
-			err := writeCell(f, automatedSheet, colPassword, i+rowOffset, newPassword)
-			if err != nil {
-				return fmt.Errorf("failed to write new password to sheet %s in row %d for user %s: %v; manually set password for user",
-					automatedSheet, toSheetCoord(i+rowOffset), name, err)
+		due, err := rotationDue(row[colTimestamp], now, policy.MaxAgeDays)
+		if err != nil {
+			return fmt.Errorf("Error parsing timestamp from row %d for user %s: %s", toSheetCoord(i+rowOffset), name, err)
+		}
+		if !due {
+			lastLogin := ""
+			if hasLastLogin && colLastLogin < len(row) {
+				lastLogin = row[colLastLogin]
 			}
-			// set timestamp
-			ts := now.Format(time.UnixDate)
-			err = writeCell(f, automatedSheet, colTimestamp, i+rowOffset, ts)
-			if err != nil {
-				return fmt.Errorf("failed to write timestamp %s to sheet %s in row %d for user %s: %s", ts,
-					automatedSheet, toSheetCoord(i+rowOffset), name, err)
+			if heartbeatDue(lastLogin, row[colTimestamp], now, policy.HeartbeatDays) {
+				heartbeats = append(heartbeats, heartbeatJob{
+					row:        i + rowOffset,
+					name:       name,
+					password:   row[colPassword],
+					timestamp:  row[colTimestamp],
+					policy:     policy,
+					lockout:    lockout,
+					totpSecret: userToTOTPSecret[strings.ToLower(name)],
+				})
+				continue
 			}
+			envLog.Info("no rotation needed", Fields{"user": name, "outcome": outcomeSkipped})
+			report.add(ReportRecord{Environment: env, User: name, Action: actionSkipped, OldTimestamp: row[colTimestamp]})
+			numNoRotation++
+			continue
+		}
 
-			log.Printf("%s: rotation complete", name)
-
-			// update password for user in macFin sheet
-			if pwRow, ok := mcFinUsersToPasswordRow[name]; !ok {
-				return fmt.Errorf("macFin user %s missing from PasswordManager users; failed to update sheet %s with new password", name, sheetName)
-			} else {
-				err = writeCell(f, sheetName, passwordXCoord, pwRow.Row, newPassword)
-				if err != nil {
-					return fmt.Errorf("failed to write password for user %s to sheet %s in row %d: %s", name,
-						sheetName, toSheetCoord(pwRow.Row), err)
-				}
-			}
+		pwRow, inPortalSheet := mcFinUsersToPasswordRow[name]
+		jobs = append(jobs, rotationJob{
+			row:            i + rowOffset,
+			name:           name,
+			password:       row[colPassword],
+			previous:       row[colPrevious],
+			timestamp:      row[colTimestamp],
+			portalPassword: pwRow.Password,
+			portalRow:      pwRow.Row,
+			inPortalSheet:  inPortalSheet,
+			policy:         policy,
+			lockout:        lockout,
+			totpSecret:     userToTOTPSecret[strings.ToLower(name)],
+		})
+	}
 
-			err = uploadFile(f, input.Bucket, input.Key, s3Client)
-			if err != nil {
-				return fmt.Errorf("Error uploading file after successful rotation: %s", err)
-			}
-			log.Printf("successfully uploaded file after rotating password for MACFin user %s", name)
+	addRotations := func(stats rotationStats) {
+		for _, rec := range stats.records {
+			report.add(rec)
 		}
+		metrics.add(env, metricRotationsAttempted, float64(stats.success+stats.recovered+stats.fail))
+		metrics.add(env, metricRotationsSucceeded, float64(stats.success+stats.recovered))
+		metrics.add(env, metricRotationsFailed, float64(stats.fail))
+		metrics.add(env, metricAccountsLocked, float64(stats.causes[errorClass(ErrAccountLocked)]))
+	}
+	stats, err := rotateUsers(ctx, f, input, portal, s3Client, env, journal, jobs)
+	addRotations(stats)
+	metrics.add(env, metricAccountsSkipped, float64(numNoRotation))
+	if err != nil {
+		return err
+	}
+
+	hbStats, expired, err := heartbeatUsers(ctx, f, input, portal, s3Client, env, heartbeats)
+	for _, rec := range hbStats.records {
+		report.add(rec)
+	}
+	metrics.add(env, metricHeartbeatsAttempted, float64(hbStats.success+hbStats.fail))
+	metrics.add(env, metricHeartbeatsFailed, float64(hbStats.fail))
+	metrics.add(env, metricAccountsLocked, float64(hbStats.causes[errorClass(ErrAccountLocked)]))
+	if err != nil {
+		return err
 	}
 
-	log.Printf("total rotations in %s: %d success: %d  fail: %d  not rotated: %d total users: %d",
-		automatedSheet, numSuccess+numFail, numSuccess, numFail, numNoRotation, len(rows)-1)
+	// a heartbeat that IDM refused for an expired password is answered with
+	// a new password, journaled and uploaded like any rotation
+	jobs = []rotationJob{}
+	for _, hb := range expired {
+		pwRow, inPortalSheet := mcFinUsersToPasswordRow[hb.name]
+		jobs = append(jobs, rotationJob{
+			row:            hb.row,
+			name:           hb.name,
+			password:       hb.password,
+			previous:       rows[hb.row][colPrevious],
+			timestamp:      hb.timestamp,
+			portalPassword: pwRow.Password,
+			portalRow:      pwRow.Row,
+			inPortalSheet:  inPortalSheet,
+			policy:         hb.policy,
+			lockout:        hb.lockout,
+			totpSecret:     hb.totpSecret,
+		})
+	}
+	expiredStats, err := rotateUsers(ctx, f, input, portal, s3Client, env, journal, jobs)
+	addRotations(expiredStats)
+	stats.success += expiredStats.success
+	stats.recovered += expiredStats.recovered
+	stats.fail += expiredStats.fail
+	for class, n := range expiredStats.causes {
+		stats.causes[class] += n
+	}
+	stats.records = append(stats.records, expiredStats.records...)
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range append(stats.records, hbStats.records...) {
+		if rec.Quarantined != "" {
+			quarantined = append(quarantined, rec.User)
+		}
+	}
+	metrics.add(env, metricAccountsQuarantined, float64(len(quarantined)))
+
+	envLog.Info("rotation summary", Fields{
+		"rotations":   stats.success + stats.recovered + stats.fail,
+		"success":     stats.success,
+		"recovered":   stats.recovered,
+		"fail":        stats.fail,
+		"not_rotated": numNoRotation,
+		"total_users": len(rows) - 1,
+		"failures":    stats.causes,
+		"quarantined": quarantined,
+	})
+	if len(heartbeats) > 0 {
+		envLog.Info("heartbeat summary", Fields{
+			"heartbeats": hbStats.success + hbStats.fail,
+			"success":    hbStats.success,
+			"fail":       hbStats.fail,
+			"failures":   hbStats.causes,
+		})
+	}
 
 	return nil
 }
 
-func rotate(input *Input, envToPortal map[Environment]*Portal, client S3ClientAPI) error {
+// Rotate passwords and write a report of what was done to each user and the
+// run's metrics, even if the run stops early
+func rotate(ctx context.Context, input *Input, envToPortal map[Environment]*Portal, client S3ClientAPI) error {
+	client = meteredS3Client{S3ClientAPI: client}
+	timer := newRunTimer(sortedEnvironments(envToPortal), metricRunSucceeded, metricRunDuration)
+	report := newRunReport(input.RunID, timer.start.UTC())
+	err := rotateWorkbook(ctx, input, envToPortal, client, report, timer)
+	report.finish(err, time.Now().UTC())
+	if err != nil {
+		notifyAlert(input, report)
+	}
+
+	reportErr := report.upload(input, client)
+	if reportErr != nil && err != nil {
+		logger.Error("failed to upload run report", reportErr, nil)
+	} else if reportErr != nil {
+		err = reportErr
+	}
+
+	timer.flush(err == nil)
+	return err
+}
+
+func rotateWorkbook(ctx context.Context, input *Input, envToPortal map[Environment]*Portal, client S3ClientAPI, report *RunReport, timer *runTimer) error {
 	f, err := downloadFile(input, client)
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(path.Dir(f.Path))
+	defer closeWorkbook(f)
 
 	err = validateSheets(f, input)
 	if err != nil {
 		return err
 	}
 
+	// finish what an interrupted run started before changing anything else
+	journal, err := loadJournal(input, client)
+	if err != nil {
+		return err
+	}
+	err = replayJournal(ctx, f, input, envToPortal, journal, client, report)
+	if err != nil {
+		return err
+	}
+
 	err = removeDupsFromMACFinSheets(f, input)
 	if err != nil {
 		return err
 	}
 
-	for env, portal := range envToPortal {
+	for _, env := range sortedEnvironments(envToPortal) {
+		timer.startEnv()
+		portal := envToPortal[env]
+		envClient := envS3Client(client, env)
 		// true means "block action"
 		err = f.ProtectSheet(input.SheetGroups[env].AutomatedSheetName, &excelize.FormatSheetProtection{
 			Password:            input.AutomatedSheetPassword,
@@ -227,31 +491,38 @@ func rotate(input *Input, envToPortal map[Environment]*Portal, client S3ClientAP
 			return fmt.Errorf("failed to protect %s sheet", input.SheetGroups[env].AutomatedSheetName)
 		}
 
-		err = syncPasswordManagerUsersToMACFinUsers(f, input, client, env)
+		err = report.recordSync(f, input, env)
 		if err != nil {
 			return err
 		}
-
-		err = resetPasswords(f, input, portal, client, env)
+		err = syncPasswordManagerUsersToMACFinUsers(f, input, envClient, env)
 		if err != nil {
 			return err
 		}
 
-		err = updateMACFinUsers(f, input, client, env)
+		err = resetPasswords(ctx, f, input, portal, envClient, env, journal, report)
 		if err != nil {
 			return err
 		}
 
+		err = updateMACFinUsers(f, input, envClient, env)
+		if err != nil {
+			return err
+		}
+		timer.stopEnv(env)
 	}
 
-	for env := range envToPortal {
-		err := updateTestingSheets(f, input, env, client)
+	for _, env := range sortedEnvironments(envToPortal) {
+		timer.startEnv()
+		err := updateTestingSheets(f, input, env, envS3Client(client, env), report)
 		if err != nil {
 			return err
 		}
+		timer.stopEnv(env)
+		timer.finishEnv(env, true)
 	}
 
-	err = sendEmail(f.Path)
+	err = notifyRun(f, input, report)
 	if err != nil {
 		return err
 	}
@@ -260,63 +531,100 @@ func rotate(input *Input, envToPortal map[Environment]*Portal, client S3ClientAP
 
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	setLogOutput(os.Stderr)
+	runID := newRunID()
+	logger = logger.With(Fields{"run_id": runID})
 
-	envToPortal := map[Environment]*Portal{
-		dev: {
-			Hostname:    os.Getenv("PORTALHOSTNAMEDEV"),
-			IDMHostname: os.Getenv("IDMHOSTNAMEDEV"),
-			Scheme:      "https://",
-		},
-		val: {
-			Hostname:    os.Getenv("PORTALHOSTNAMEVAL"),
-			IDMHostname: os.Getenv("IDMHOSTNAMEVAL"),
-			Scheme:      "https://",
-		},
-		prod: {
-			Hostname:    os.Getenv("PORTALHOSTNAMEPROD"),
-			IDMHostname: os.Getenv("IDMHOSTNAMEPROD"),
-			Scheme:      "https://",
-		},
-	}
-
-	input := &Input{
-		UsernameHeader:         os.Getenv("USERNAMEHEADER"),
-		PasswordHeader:         os.Getenv("PASSWORDHEADER"),
-		Bucket:                 os.Getenv("BUCKET"),
-		Key:                    os.Getenv("KEY"),
-		AutomatedSheetPassword: os.Getenv("AUTOMATEDSHEETPASSWORD"),
-		AutomatedSheetColNameToIndex: map[Column]int{
-			ColUser: 0, ColPassword: 1, ColPrevious: 2, ColTimestamp: 3},
-		AutomatedSheetColNameToHeading: map[Column]string{
-			ColUser: ColUserHeading, ColPassword: ColPasswordHeading,
-			ColPrevious: ColPreviousHeading, ColTimestamp: ColTimestampHeading},
-		RowOffset: 1,
-		SheetGroups: map[Environment]SheetGroup{
-			dev: {
-				AutomatedSheetName: "PasswordManager-DEV",
-				PortalSheetName:    os.Getenv("PORTALSHEETNAMEDEV"),
-				TestingSheetNames:  getTestingSheets("DEVPORTALTESTINGSHEETNAMES"),
-			},
-			val: {
-				AutomatedSheetName: "PasswordManager-VAL",
-				PortalSheetName:    os.Getenv("PORTALSHEETNAMEVAL"),
-				TestingSheetNames:  getTestingSheets("VALPORTALTESTINGSHEETNAMES"),
-			},
-			prod: {
-				AutomatedSheetName: "PasswordManager-PROD",
-				PortalSheetName:    os.Getenv("PORTALSHEETNAMEPROD"),
-				TestingSheetNames:  getTestingSheets("PRODPORTALTESTINGSHEETNAMES"),
-			},
-		},
-	}
+	configPath := flag.String("config", os.Getenv("CONFIG"), "YAML or JSON configuration file, local or s3://bucket/key")
+	flag.Parse()
+	args := flag.Args()
 
 	client, err := createS3Client(region)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Error creating S3 client", err, nil)
+	}
+
+	config, err := loadConfig(*configPath, client)
+	if err != nil {
+		logger.Fatal("Error loading configuration", err, nil)
+	}
+	input, envToPortal := config.input()
+	input.RunID = runID
+	input.Notifiers, err = newNotifiers(input, client)
+	if err != nil {
+		logger.Fatal("Error loading notifiers", err, nil)
+	}
+	metrics = newMetrics(input.MetricsNamespace)
+
+	if len(args) > 0 && args[0] == "config" {
+		if len(args) != 2 || args[1] != "validate" {
+			logger.Fatal("usage: portal-test-user-manager [-config file] config validate", nil, nil)
+		}
+		logger.Info("configuration is valid", Fields{"environments": sortedEnvironments(envToPortal)})
+		return
+	}
+
+	if len(args) > 0 && args[0] == "plan" {
+		// report what a rotation would do without changing anything
+		flags := flag.NewFlagSet("plan", flag.ExitOnError)
+		out := flags.String("out", "", "also write the plan as JSON to this file")
+		flags.Parse(args[1:])
+
+		p, err := plan(input, envToPortal, client)
+		if err != nil {
+			logger.Fatal("Error planning rotation", err, nil)
+		}
+		p.log()
+		if *out != "" {
+			err = p.writeJSON(*out)
+			if err != nil {
+				logger.Fatal("Error writing plan", err, nil)
+			}
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "totp" {
+		// encrypt a TOTP secret read from stdin for the TOTP Secret column
+		if len(args) != 2 || args[1] != "encrypt" {
+			logger.Fatal("usage: portal-test-user-manager [-config file] totp encrypt < secret", nil, nil)
+		}
+		encrypted, err := encryptTOTPSecret(input, os.Stdin)
+		if err != nil {
+			logger.Fatal("Error encrypting TOTP secret", err, nil)
+		}
+		fmt.Println(encrypted)
+		return
+	}
+
+	// stop between requests if the task is stopped; the journal covers
+	// passwords that were changed but not uploaded
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if len(args) > 0 && args[0] == "verify" {
+		// log in with each stored password without changing any
+		flags := flag.NewFlagSet("verify", flag.ExitOnError)
+		envNames := flags.String("env", "", "comma-separated environments to verify; all if empty")
+		userNames := flags.String("user", "", "comma-separated users to verify; all if empty")
+		flags.Parse(args[1:])
+
+		envs, err := verifyEnvironments(*envNames, envToPortal)
+		if err != nil {
+			logger.Fatal("Error verifying passwords", err, nil)
+		}
+		failed, err := verify(ctx, input, envToPortal, client, envs, splitList(*userNames))
+		if err != nil {
+			logger.Fatal("Error verifying passwords", err, nil)
+		}
+		if failed > 0 {
+			logger.Fatal("stored passwords failed verification", nil, Fields{"failed": failed})
+		}
+		return
 	}
 
-	err = rotate(input, envToPortal, client)
+	err = rotate(ctx, input, envToPortal, client)
 	if err != nil {
-		log.Fatalf("Error rotating passwords: %s", err)
+		logger.Fatal("Error rotating passwords", err, nil)
 	}
 }
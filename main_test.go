@@ -12,10 +12,12 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/xuri/excelize/v2"
 )
@@ -138,21 +140,46 @@ const (
 type currentFilePath string
 
 type session struct {
-	username  string
-	token     string
-	xsrfToken string
-	loggedOut bool
+	username   string
+	token      string
+	stateToken string // of a login refused for an expired password
+	xsrfToken  string
+	loggedOut  bool
 }
 
 type AuthServer struct {
 	UserToPassword    map[string]string
 	UserToNewPassword map[string]string
 	Errors            map[string]string // user -> path
+	Statuses          map[string]string // user -> IDM status of a login that gets no session token; PASSWORD_EXPIRED until changed
+	Policies          map[string]PasswordPolicy
+	TOTPSecrets       map[string]string // user -> secret of the TOTP factor every login of the user must answer
+	LoginErrors       map[string]string // user -> body of the 403 answering the user's logins, from IDM or a firewall in front of it
 	PortalSessions    map[string]*session
 	IDMSessions       map[string]*session
+	SentPasswords     []string // every password sent to log in or change to, accepted or not
+	SentCodes         []string // user:code of every TOTP code sent, accepted or not
+
+	mu sync.Mutex // users are rotated concurrently
+}
+
+// Reply with an IDM error body
+func idmHTTPError(w http.ResponseWriter, code, summary string, statusCode int) {
+	b, err := json.Marshal(idmErrorBody{ErrorCode: code, ErrorSummary: summary})
+	if err != nil {
+		panic(err)
+	}
+	http.Error(w, string(b), statusCode)
+}
+
+type idmErrorBody struct {
+	ErrorCode    string `json:"errorCode"`
+	ErrorSummary string `json:"errorSummary"`
 }
 
 func (s *AuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.PortalSessions == nil {
 		s.PortalSessions = make(map[string]*session)
 		s.IDMSessions = make(map[string]*session)
@@ -184,6 +211,94 @@ func (s *AuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			s.IDMSessions[sessionID] = sess
 			w.Header().Set("Set-Cookie", idmSessionCookieName+"="+sessionID+"; Path=/")
 			http.Redirect(w, r, "http://"+portalServer+xsrfRedirectPath, http.StatusFound)
+		} else if r.URL.Path == expiredPasswordPath {
+			cp := &changeExpiredPassword{}
+			err := json.NewDecoder(r.Body).Decode(cp)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error decoding expired password change details: %s", err), http.StatusBadRequest)
+				return
+			}
+			var sess *session
+			for _, s := range s.PortalSessions {
+				if s.stateToken != "" && s.stateToken == cp.StateToken {
+					sess = s
+					break
+				}
+			}
+			if sess == nil {
+				http.Error(w, "Invalid state token", http.StatusUnauthorized)
+				return
+			}
+			if s.Errors[sess.username] == r.URL.Path {
+				http.Error(w, "Error triggered for test", http.StatusInternalServerError)
+				return
+			}
+			s.SentPasswords = append(s.SentPasswords, cp.NewPassword)
+			if cp.OldPassword != s.UserToPassword[sess.username] {
+				http.Error(w, `{"errorCode":"E0000001","errorSummary":"Old Password is not correct"}`, http.StatusForbidden)
+				return
+			}
+			if problem := s.checkNewPassword(sess.username, cp.NewPassword); problem != "" {
+				http.Error(w, `{"errorCode":"E0000080","errorSummary":"password requirements were not met: `+problem+`"}`, http.StatusForbidden)
+				return
+			}
+			s.setPassword(sess.username, cp.NewPassword)
+			delete(s.Statuses, sess.username)
+			sess.stateToken = ""
+			sess.token = "st-" + cp.StateToken
+			err = json.NewEncoder(w).Encode(userData{Status: "SUCCESS", SessionToken: sess.token})
+			if err != nil {
+				panic(err)
+			}
+		} else if strings.HasPrefix(r.URL.Path, factorsPath) {
+			vf := &verifyFactor{}
+			err := json.NewDecoder(r.Body).Decode(vf)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error decoding factor: %s", err), http.StatusBadRequest)
+				return
+			}
+			var sess *session
+			for _, s := range s.PortalSessions {
+				if s.stateToken != "" && s.stateToken == vf.StateToken {
+					sess = s
+					break
+				}
+			}
+			if sess == nil || r.URL.Path != factorsPath+"totp-"+sess.username+"/verify" {
+				http.Error(w, "Invalid state token or factor", http.StatusUnauthorized)
+				return
+			}
+			if s.Errors[sess.username] == factorsPath {
+				http.Error(w, "Error triggered for test", http.StatusInternalServerError)
+				return
+			}
+			for _, code := range s.SentCodes {
+				if code == sess.username+":"+vf.PassCode {
+					http.Error(w, `{"errorCode":"E0000082","errorSummary":"Each code can only be used once. Please wait for a new code and try again."}`, http.StatusForbidden)
+					return
+				}
+			}
+			s.SentCodes = append(s.SentCodes, sess.username+":"+vf.PassCode)
+			// allow for clock drift of a step either way
+			valid := false
+			step := totpStep(time.Now())
+			for _, st := range []int64{step - 1, step, step + 1} {
+				code, err := totpCode(s.TOTPSecrets[sess.username], st)
+				if err != nil {
+					panic(err)
+				}
+				valid = valid || code == vf.PassCode
+			}
+			if !valid {
+				http.Error(w, `{"errorCode":"E0000068","errorSummary":"Invalid Passcode/Answer"}`, http.StatusForbidden)
+				return
+			}
+			sess.stateToken = ""
+			sess.token = "st-" + vf.StateToken
+			err = json.NewEncoder(w).Encode(userData{Status: "SUCCESS", SessionToken: sess.token})
+			if err != nil {
+				panic(err)
+			}
 		} else {
 			http.Error(w, "Unsupported IDM path: "+r.URL.Path, http.StatusInternalServerError)
 		}
@@ -211,11 +326,43 @@ func (s *AuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, fmt.Sprintf("Error decoding login details: %s", err), http.StatusBadRequest)
 				return
 			}
+			s.SentPasswords = append(s.SentPasswords, ld.Password)
+			if body, ok := s.LoginErrors[ld.Username]; ok {
+				http.Error(w, body, http.StatusForbidden)
+				return
+			}
 			if password, ok := s.UserToPassword[ld.Username]; !ok {
-				http.Error(w, fmt.Sprintf("Bad user %q", ld.Username), http.StatusForbidden)
+				idmHTTPError(w, "E0000004", fmt.Sprintf("Authentication failed: bad user %q", ld.Username), http.StatusUnauthorized)
 				return
 			} else if password != ld.Password {
-				http.Error(w, fmt.Sprintf("Bad password for %q: %q != %q", ld.Username, password, ld.Password), http.StatusForbidden)
+				idmHTTPError(w, "E0000004", fmt.Sprintf("Authentication failed: bad password for %q: %q != %q", ld.Username, password, ld.Password), http.StatusUnauthorized)
+				return
+			}
+			if status, ok := s.Statuses[ld.Username]; ok {
+				ud := userData{Status: status}
+				if status == "PASSWORD_EXPIRED" {
+					sess.username = ld.Username
+					sess.stateToken = "state-" + cookie.Value
+					ud.StateToken = sess.stateToken
+				}
+				err = json.NewEncoder(w).Encode(ud)
+				if err != nil {
+					panic(err)
+				}
+				return
+			}
+			if _, ok := s.TOTPSecrets[ld.Username]; ok {
+				sess.username = ld.Username
+				sess.stateToken = "mfa-" + cookie.Value
+				ud := userData{Status: "MFA_REQUIRED", StateToken: sess.stateToken}
+				ud.Embedded.Factors = []factor{
+					{ID: "sms-" + ld.Username, FactorType: "sms"},
+					{ID: "totp-" + ld.Username, FactorType: totpFactorType},
+				}
+				err = json.NewEncoder(w).Encode(ud)
+				if err != nil {
+					panic(err)
+				}
 				return
 			}
 			ud := userData{
@@ -242,25 +389,16 @@ func (s *AuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, fmt.Sprintf("Error decoding password change details: %s", err), http.StatusBadRequest)
 				return
 			}
+			s.SentPasswords = append(s.SentPasswords, cp.NewPassword)
 			if cp.OldPassword != s.UserToPassword[sess.username] {
 				http.Error(w, "Incorrect old password", http.StatusBadRequest)
 				return
 			}
-			if len(cp.NewPassword) != passwordLength {
-				http.Error(w, "Invalid password length", http.StatusBadRequest)
+			if problem := s.checkNewPassword(sess.username, cp.NewPassword); problem != "" {
+				http.Error(w, problem, http.StatusBadRequest)
 				return
 			}
-			for _, class := range []string{digits, uppers, lowers, specials} {
-				if !strings.ContainsAny(cp.NewPassword, class) {
-					http.Error(w, fmt.Sprintf("Password needs a character from %q", class), http.StatusBadRequest)
-					return
-				}
-			}
-			if s.UserToNewPassword == nil {
-				s.UserToNewPassword = make(map[string]string)
-			}
-			s.UserToNewPassword[sess.username] = cp.NewPassword
-			s.UserToPassword[sess.username] = cp.NewPassword
+			s.setPassword(sess.username, cp.NewPassword)
 		} else if r.URL.Path == xsrfRedirectPath {
 			tok := fmt.Sprintf("%x", rand.Int())
 			sess.xsrfToken = tok
@@ -273,6 +411,35 @@ func (s *AuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Check a new password against the user's policy, returning the problem if
+// it breaks the policy
+func (s *AuthServer) checkNewPassword(username, password string) string {
+	policy, ok := s.Policies[username]
+	if !ok {
+		policy = PasswordPolicy{MinLength: passwordLength, MaxLength: passwordLength}
+	}
+	if len(password) < policy.MinLength || len(password) > policy.MaxLength {
+		return fmt.Sprintf("Invalid password length: %q", password)
+	}
+	if policy.Exclude != "" && strings.ContainsAny(password, policy.Exclude) {
+		return fmt.Sprintf("Password %q contains an excluded character", password)
+	}
+	for _, class := range []string{digits, uppers, lowers, specials} {
+		if !strings.ContainsAny(password, class) {
+			return fmt.Sprintf("Password needs a character from %q", class)
+		}
+	}
+	return ""
+}
+
+func (s *AuthServer) setPassword(username, password string) {
+	if s.UserToNewPassword == nil {
+		s.UserToNewPassword = make(map[string]string)
+	}
+	s.UserToNewPassword[username] = password
+	s.UserToPassword[username] = password
+}
+
 const Day = time.Hour * 24
 
 type PasswordManagerRow struct {
@@ -301,13 +468,21 @@ const (
 )
 
 type TestCase struct {
-	Name               string
-	PasswordManagerIn  []PasswordManagerRow
-	PasswordManagerOut []PasswordManagerRow
-	MACFinIn           []MACFinRow
-	UntrackedPasswords map[string]string // user -> password
-	ServerErrors       map[string]string // user -> path
-	SheetInProblem     SheetProblem
+	Name                    string
+	PasswordManagerIn       []PasswordManagerRow
+	PasswordManagerOut      []PasswordManagerRow
+	MACFinIn                []MACFinRow
+	UntrackedPasswords      map[string]string         // user -> password
+	ServerErrors            map[string]string         // user -> path
+	ServerStatuses          map[string]string         // user -> IDM status of a login that gets no session token
+	JournalIn               map[string]string         // user -> uncommitted password
+	PasswordManagerPolicies map[string][]string       // user -> policy columns in the PasswordManager sheet
+	MACFinPolicies          map[string][]string       // user -> policy columns in the MACFin sheet
+	ServerPolicies          map[string]PasswordPolicy // user -> policy the server enforces
+	HeartbeatDays           int
+	LastLoginIn             map[string]time.Duration // user -> last login in the PasswordManager sheet
+	Heartbeats              map[string]string        // user -> expected heartbeat action
+	SheetInProblem          SheetProblem
 }
 
 var testCases = []TestCase{
@@ -358,6 +533,88 @@ var testCases = []TestCase{
 			{"LESLIe", "bar"}, // repeated with different capitalization
 		},
 	},
+	{
+		Name: "heartbeat",
+		PasswordManagerIn: []PasswordManagerRow{
+			{
+				"ben", "x", "", -80 * Day,
+			},
+			{
+				"chris", "foo", "", -10 * Day,
+			},
+			{
+				"chuck", "y", "", -5 * Day,
+			},
+			{
+				"james", "baz", "", -20 * Day,
+			},
+			{
+				"leslie", "bar", "", -10 * Day,
+			},
+		},
+		PasswordManagerOut: []PasswordManagerRow{
+			{
+				"ben", newPasswordMarker, "x", 0,
+			},
+			{
+				"chris", "foo", "", -10 * Day,
+			},
+			{
+				"chuck", "y", "", -5 * Day,
+			},
+			{
+				"james", "baz", "", -20 * Day,
+			},
+			{
+				"leslie", "bar", "", -10 * Day,
+			},
+		},
+		MACFinIn: []MACFinRow{
+			{"ben", "x"},
+			{"chris", "foo"},
+			{"chuck", "y"},
+			{"james", "baz"},
+			{"leslie", "bar"},
+		},
+		UntrackedPasswords: map[string]string{"leslie": "changed-elsewhere"},
+		HeartbeatDays:      7,
+		LastLoginIn:        map[string]time.Duration{"chris": -10 * Day, "james": -2 * Day},
+		Heartbeats:         map[string]string{"chris": actionHeartbeat, "leslie": actionHeartbeatFailed},
+	},
+	{
+		Name: "expired password at heartbeat",
+		PasswordManagerIn: []PasswordManagerRow{
+			{
+				"ben", "x", "", -80 * Day,
+			},
+			{
+				"chris", "foo", "", -10 * Day,
+			},
+			{
+				"leslie", "bar", "", -10 * Day,
+			},
+		},
+		PasswordManagerOut: []PasswordManagerRow{
+			{
+				"ben", newPasswordMarker, "x", 0,
+			},
+			{
+				"chris", newPasswordMarker, "foo", 0,
+			},
+			{
+				"leslie", "bar", "", -10 * Day,
+			},
+		},
+		MACFinIn: []MACFinRow{
+			{"ben", "x"},
+			{"chris", "foo"},
+			{"leslie", "bar"},
+		},
+		// chris's heartbeat is refused and the forced change rotates the password
+		ServerStatuses: map[string]string{"chris": "PASSWORD_EXPIRED"},
+		HeartbeatDays:  7,
+		Heartbeats:     map[string]string{"leslie": actionHeartbeat},
+	},
 	{
 		Name: "delete at end",
 		PasswordManagerIn: []PasswordManagerRow{
@@ -600,6 +857,168 @@ var testCases = []TestCase{
 			"leslie": changePasswordPath,
 		},
 	},
+	{
+		Name: "expired password",
+		PasswordManagerIn: []PasswordManagerRow{
+			{
+				"ben", "x", "", -80 * Day,
+			},
+			{
+				"chris", "foo", "", -80 * Day,
+			},
+			{
+				"leslie", "bar", "", -90 * Day,
+			},
+		},
+		PasswordManagerOut: []PasswordManagerRow{
+			{
+				"ben", newPasswordMarker, "x", 0,
+			},
+			{
+				"chris", newPasswordMarker, "foo", 0,
+			},
+			{
+				"leslie", "bar", "", -90 * Day,
+			},
+		},
+		MACFinIn: []MACFinRow{
+			{"chris", "foo"},
+			{"leslie", "bar"},
+			{"ben", "x"},
+		},
+		ServerStatuses: map[string]string{
+			"ben":    "PASSWORD_EXPIRED",
+			"leslie": "PASSWORD_EXPIRED",
+		},
+		ServerErrors: map[string]string{
+			"leslie": expiredPasswordPath,
+		},
+	},
+	{
+		Name: "recover previous password",
+		PasswordManagerIn: []PasswordManagerRow{
+			{
+				"ben", "lost", "x", -80 * Day,
+			},
+			{
+				"chris", "lost", "", -80 * Day,
+			},
+			{
+				"leslie", "lost", "stale", -90 * Day,
+			},
+		},
+		PasswordManagerOut: []PasswordManagerRow{
+			{
+				"ben", newPasswordMarker, "x", 0,
+			},
+			{
+				"chris", newPasswordMarker, "foo", 0,
+			},
+			{
+				"leslie", "lost", "stale", -90 * Day,
+			},
+		},
+		MACFinIn: []MACFinRow{
+			{"ben", "lost"},
+			{"chris", "foo"}, // password only known to the MACFin sheet
+			{"leslie", "lost"},
+		},
+		UntrackedPasswords: map[string]string{
+			"ben":    "x",
+			"chris":  "foo",
+			"leslie": "bar",
+		},
+	},
+	{
+		Name: "replay journal",
+		PasswordManagerIn: []PasswordManagerRow{
+			{
+				"ben", "x", "", -80 * Day,
+			},
+			{
+				"chris", "foo", "", -20 * Day,
+			},
+			{
+				"james", "baz", "", -20 * Day,
+			},
+		},
+		PasswordManagerOut: []PasswordManagerRow{
+			{
+				"ben", "journal-ben", "x", 0,
+			},
+			{
+				"chris", "foo", "", -20 * Day,
+			},
+			{
+				"james", "baz", "", -20 * Day,
+			},
+		},
+		MACFinIn: []MACFinRow{
+			{"ben", "x"},
+			{"chris", "foo"},
+			{"james", "baz"},
+		},
+		UntrackedPasswords: map[string]string{
+			"ben": "journal-ben", // changed in the portal but never uploaded
+		},
+		JournalIn: map[string]string{
+			"ben":   "journal-ben",
+			"chris": "journal-chris", // never changed in the portal
+			"james": "baz",           // uploaded but never committed
+		},
+	},
+	{
+		Name: "policy columns",
+		PasswordManagerIn: []PasswordManagerRow{
+			{
+				"leslie", "bar", "", -20 * Day,
+			},
+			{
+				"ben", "x", "", -30 * Day,
+			},
+			{
+				"chris", "foo", "", -30 * Day,
+			},
+			{
+				"james", "baz", "", -30 * Day,
+			},
+		},
+		PasswordManagerOut: []PasswordManagerRow{
+			{
+				"ben", "x", "", -30 * Day,
+			},
+			{
+				"chris", newPasswordMarker, "foo", 0,
+			},
+			{
+				"james", newPasswordMarker, "baz", 0,
+			},
+			{
+				"leslie", newPasswordMarker, "bar", 0,
+			},
+		},
+		MACFinIn: []MACFinRow{
+			{"ben", "x"},
+			{"chris", "foo"},
+			{"james", "baz"},
+			{"leslie", "bar"},
+		},
+		PasswordManagerPolicies: map[string][]string{
+			"ben":    {"45", "", ""},
+			"leslie": {"14", "20", "aeiou"},
+			"james":  {"", "", "AEIOU"},
+		},
+		MACFinPolicies: map[string][]string{
+			"ben":   {"10", "", ""}, // overridden by the PasswordManager sheet
+			"chris": {"", "16", ""},
+			"james": {"", "not a number", ""},
+		},
+		ServerPolicies: map[string]PasswordPolicy{
+			"chris":  {MinLength: 16, MaxLength: 16},
+			"james":  {MinLength: passwordLength, MaxLength: passwordLength, Exclude: "AEIOU"},
+			"leslie": {MinLength: 20, MaxLength: 20, Exclude: "aeiou"},
+		},
+	},
 	{
 		Name: "wrong MACFinIn Username Heading",
 		PasswordManagerIn: []PasswordManagerRow{
@@ -679,14 +1098,24 @@ type FakeS3Client struct {
 	SheetName                      string
 	UsernameHeader, PasswordHeader string
 	RowOffset                      int
+	Objects                        map[string][]byte // other keys in the bucket
+
+	mu sync.Mutex
 }
 
 func (fc *FakeS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
 	if aws.StringValue(params.Bucket) != fc.Bucket {
 		return nil, fmt.Errorf("expected bucket %s; got %s", aws.StringValue(params.Bucket), fc.Bucket)
 	}
 	if aws.StringValue(params.Key) != fc.Key {
-		return nil, fmt.Errorf("expected key %s; got %s", aws.StringValue(params.Key), fc.Key)
+		if obj, ok := fc.Objects[aws.StringValue(params.Key)]; ok {
+			return &s3.GetObjectOutput{
+				Body: io.NopCloser(bytes.NewReader(obj)),
+			}, nil
+		}
+		return nil, &types.NoSuchKey{}
 	}
 
 	f, err := os.Open(fc.LocalPath)
@@ -699,18 +1128,25 @@ func (fc *FakeS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput
 }
 
 func (fc *FakeS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
 	if aws.StringValue(params.Bucket) != fc.Bucket {
 		return nil, fmt.Errorf("expected bucket %s; got %s", aws.StringValue(params.Bucket), fc.Bucket)
 	}
-	if aws.StringValue(params.Key) != fc.Key {
-		return nil, fmt.Errorf("expected key %s; got %s", aws.StringValue(params.Key), fc.Key)
-	}
 
 	contents, err := io.ReadAll(params.Body)
 	if err != nil {
 		return nil, err
 	}
 
+	if aws.StringValue(params.Key) != fc.Key {
+		if fc.Objects == nil {
+			fc.Objects = make(map[string][]byte)
+		}
+		fc.Objects[aws.StringValue(params.Key)] = contents
+		return &s3.PutObjectOutput{}, nil
+	}
+
 	// verify every password rotation has been uploaded except for, at most, one
 	// compare uploaded file (fc.LocalPath) and current file (params.Body)
 	err = verifyNewPasswordIsUploaded(fc, contents)
@@ -733,6 +1169,78 @@ func (fc *FakeS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput
 	return nil, nil
 }
 
+// Get the run report uploaded under prefix and check that a CSV copy was
+// uploaded with it
+func getRunReport(t *testing.T, fc *FakeS3Client, prefix string) *RunReport {
+	var report *RunReport
+	for key, obj := range fc.Objects {
+		if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, ".json") {
+			continue
+		}
+		if report != nil {
+			t.Fatalf("Expected one run report under %s", prefix)
+		}
+		report = &RunReport{}
+		err := json.Unmarshal(obj, report)
+		if err != nil {
+			t.Fatalf("Error parsing run report %s: %s", key, err)
+		}
+		if _, ok := fc.Objects[strings.TrimSuffix(key, ".json")+".csv"]; !ok {
+			t.Fatalf("Expected a CSV copy of run report %s", key)
+		}
+	}
+	if report == nil {
+		t.Fatalf("Expected a run report under %s", prefix)
+	}
+	return report
+}
+
+// Get the metrics in EMF lines by environment, summing repeated values
+func getMetrics(t *testing.T, emf *lockedBuffer) map[Environment]map[string]float64 {
+	envToMetrics := map[Environment]map[string]float64{}
+	for _, line := range strings.Split(strings.TrimSpace(emf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		values := map[string]interface{}{}
+		err := json.Unmarshal([]byte(line), &values)
+		if err != nil {
+			t.Fatalf("Error parsing EMF line %q: %s", line, err)
+		}
+		env, _ := values["Environment"].(string)
+		if envToMetrics[Environment(env)] == nil {
+			envToMetrics[Environment(env)] = map[string]float64{}
+		}
+		for name := range metricUnits {
+			switch v := values[name].(type) {
+			case float64:
+				envToMetrics[Environment(env)][name] += v
+			case []interface{}:
+				envToMetrics[Environment(env)][name] += float64(len(v))
+			}
+		}
+	}
+	return envToMetrics
+}
+
+// lockedBuffer collects log output written from several goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
 type ColumnArrangement struct {
 	Name    string
 	Columns map[Column]int
@@ -772,6 +1280,13 @@ func TestRotate(t *testing.T) {
 			name := fmt.Sprintf("%s - Columns %s", tc.Name, arr.Name)
 			cols := arr.Columns
 			t.Run(name, func(t *testing.T) {
+				logs := &lockedBuffer{}
+				setLogOutput(io.MultiWriter(os.Stderr, logs))
+				defer setLogOutput(os.Stderr)
+				emf := &lockedBuffer{}
+				setMetricsOutput(emf)
+				defer setMetricsOutput(os.Stdout)
+
 				dir, err := os.MkdirTemp(os.TempDir(), "macfin")
 				if err != nil {
 					t.Fatalf("Error making temp dir: %s", err)
@@ -799,18 +1314,24 @@ func TestRotate(t *testing.T) {
 				if tc.SheetInProblem == SheetProblemMACFinEmpty {
 					expectedSheetError = fmt.Errorf("sheet %s in file s3://%s/%s is empty; sheet must include header row", sheetNameMACFin, inputBucket, inputKey)
 				} else {
-					err = f.SetSheetRow(sheetNameMACFin, "A1", &[]string{
+					header := []string{
 						"Module", "User_T", "Region", "State", usernameHeading, passwordHeading,
-					})
+					}
+					if tc.MACFinPolicies != nil {
+						header = append(header, policyHeadings...)
+					}
+					err = f.SetSheetRow(sheetNameMACFin, "A1", &header)
 					if err != nil {
 						panic(err)
 					}
 				}
 
 				for idx, row := range tc.MACFinIn {
-					err := f.SetSheetRow(sheetNameMACFin, fmt.Sprintf("A%d", 2+idx), &[]string{
+					data := []string{
 						"a", "b", "c", "d", row.Username, row.Password,
-					})
+					}
+					data = append(data, tc.MACFinPolicies[row.Username]...)
+					err := f.SetSheetRow(sheetNameMACFin, fmt.Sprintf("A%d", 2+idx), &data)
 					if err != nil {
 						panic(err)
 					}
@@ -822,6 +1343,13 @@ func TestRotate(t *testing.T) {
 				h[cols[ColPrevious]] = headings[ColPrevious]
 				h[cols[ColTimestamp]] = headings[ColTimestamp]
 
+				if tc.PasswordManagerPolicies != nil {
+					h = append(h[:4], policyHeadings...)
+				}
+				if tc.LastLoginIn != nil {
+					h = append(h[:4], ColLastLoginHeading)
+				}
+
 				if tc.SheetInProblem == SheetProblemPasswordManagerTooManyHeadings {
 					h[4] = "Extra Heading"
 					expectedSheetError = fmt.Errorf("Expected sheet %s to have %d cols; it has %d cols", sheetNamePasswordManager, len(cols), len(h))
@@ -848,6 +1376,12 @@ func TestRotate(t *testing.T) {
 					data[cols[ColPassword]] = row.Password
 					data[cols[ColPrevious]] = row.Previous
 					data[cols[ColTimestamp]] = format(row.Timestamp)
+					data = append(data, tc.PasswordManagerPolicies[row.Username]...)
+					if d, ok := tc.LastLoginIn[row.Username]; ok {
+						data = append(data, format(d))
+					} else if tc.LastLoginIn != nil {
+						data = append(data, "")
+					}
 					err := f.SetSheetRow(sheetNamePasswordManager, fmt.Sprintf("A%d", 2+idx), &data)
 					if err != nil {
 						panic(err)
@@ -859,10 +1393,16 @@ func TestRotate(t *testing.T) {
 				handler := &AuthServer{
 					UserToPassword: make(map[string]string),
 					Errors:         tc.ServerErrors,
+					Policies:       tc.ServerPolicies,
+					Statuses:       make(map[string]string),
 				}
 				for _, row := range tc.PasswordManagerIn {
 					handler.UserToPassword[row.Username] = row.Password
 				}
+				// the server clears a status once the password is changed
+				for username, status := range tc.ServerStatuses {
+					handler.Statuses[username] = status
+				}
 				if tc.UntrackedPasswords != nil {
 					for username, password := range tc.UntrackedPasswords {
 						handler.UserToPassword[strings.ToLower(username)] = password
@@ -891,6 +1431,12 @@ func TestRotate(t *testing.T) {
 							PortalSheetName:    sheetNameMACFin,
 						},
 					},
+					Policies: map[Environment]UserPolicy{dev: {HeartbeatDays: tc.HeartbeatDays}},
+					Workers:  3,
+					// batches failed logins; each new password is still uploaded alone
+					UploadBatchSize: 3,
+					ReportPrefix:    "reports/",
+					RunID:           "test",
 				}
 
 				envToPortal := map[Environment]*Portal{
@@ -898,6 +1444,8 @@ func TestRotate(t *testing.T) {
 						Hostname:    portalServer,
 						IDMHostname: idmServer,
 						Scheme:      "http://",
+						env:         dev,
+						limiter:     newRateLimiter(1000),
 					},
 				}
 
@@ -912,13 +1460,68 @@ func TestRotate(t *testing.T) {
 					UsernameHeader:               input.UsernameHeader,
 					PasswordHeader:               input.PasswordHeader,
 				}
-				err = rotate(input, envToPortal, fc)
+				if tc.JournalIn != nil {
+					j := &Journal{}
+					for username, password := range tc.JournalIn {
+						encrypted, err := encryptSecret(input.AutomatedSheetPassword, password)
+						if err != nil {
+							t.Fatalf("Error encrypting journal entry: %s", err)
+						}
+						j.Entries = append(j.Entries, JournalEntry{
+							Environment: dev,
+							Username:    username,
+							Password:    encrypted,
+						})
+					}
+					b, err := json.Marshal(j)
+					if err != nil {
+						t.Fatalf("Error marshalling journal: %s", err)
+					}
+					fc.Objects = map[string][]byte{journalKey(input.Key): b}
+				}
+				err = rotate(context.Background(), input, envToPortal, fc)
 				server.Shutdown(context.Background())
 
+				runMetrics := getMetrics(t, emf)
+				if succeeded := runMetrics[allEnvironments][metricRunSucceeded]; succeeded != 1 && err == nil || succeeded != 0 && err != nil {
+					t.Fatalf("Expected RunSucceeded to match error %v; got %v", err, succeeded)
+				}
+				if succeeded := runMetrics[dev][metricRunSucceeded]; succeeded != runMetrics[allEnvironments][metricRunSucceeded] {
+					t.Fatalf("Expected RunSucceeded %v for dev, the only environment; got %v", runMetrics[allEnvironments][metricRunSucceeded], succeeded)
+				}
+
+				// the test's own passwords, such as "x", are ordinary text;
+				// generated ones must never appear
+				inputPasswords := map[string]bool{}
+				for _, row := range tc.PasswordManagerIn {
+					inputPasswords[row.Password] = true
+					inputPasswords[row.Previous] = true
+				}
+				for _, row := range tc.MACFinIn {
+					inputPasswords[row.Password] = true
+				}
+				for _, password := range tc.UntrackedPasswords {
+					inputPasswords[password] = true
+				}
+				generated := []string{}
+				for _, password := range handler.SentPasswords {
+					if !inputPasswords[password] {
+						generated = append(generated, password)
+					}
+				}
+				for _, password := range generated {
+					if strings.Contains(logs.String(), password) {
+						t.Fatalf("Password %q appears in the log output", password)
+					}
+				}
+
 				if err != nil {
 					if tc.SheetInProblem != NoSheetProblem {
 						// check for input error
 						if err.Error() == expectedSheetError.Error() {
+							if report := getRunReport(t, fc, input.ReportPrefix); report.Error == "" {
+								t.Fatalf("Expected the run report to record the error %q", err)
+							}
 							t.Logf("Error in input file: %s", err)
 							return
 						} else {
@@ -948,6 +1551,7 @@ func TestRotate(t *testing.T) {
 						sheetNamePasswordManager, len(tc.PasswordManagerOut), len(pmRows))
 				}
 				userToPassword := map[string]string{}
+				lastLoginX, hasLastLogin := getHeaderToXCoord(pmRows[0])[ColLastLoginHeading]
 				for rowIdx, expected := range tc.PasswordManagerOut {
 					gotRow := pmRows[rowIdx+1]
 					gotUsername := gotRow[input.AutomatedSheetColNameToIndex[ColUser]]
@@ -989,11 +1593,99 @@ func TestRotate(t *testing.T) {
 							sheetNamePasswordManager, rowIdx+1, expectedTimestamp, gotTS)
 					}
 					userToPassword[gotUsername] = gotPassword
+
+					// a new password or heartbeat records the login
+					gotLastLogin := ""
+					if hasLastLogin && lastLoginX < len(gotRow) {
+						gotLastLogin = gotRow[lastLoginX]
+					}
+					changed := expected.Password == newPasswordMarker
+					for _, in := range tc.PasswordManagerIn {
+						if in.Username == expected.Username && in.Password != expected.Password {
+							changed = true
+						}
+					}
+					if changed || tc.Heartbeats[expected.Username] == actionHeartbeat {
+						lastLogin, err := time.Parse(time.UnixDate, gotLastLogin)
+						if err != nil || now.Sub(lastLogin) > time.Hour || lastLogin.Sub(now) > time.Hour {
+							t.Fatalf("%s Row %d: expected Last Login~=%s but got %q", sheetNamePasswordManager, rowIdx+1, now, gotLastLogin)
+						}
+					} else if d, ok := tc.LastLoginIn[expected.Username]; ok && gotLastLogin != format(d) || !ok && gotLastLogin != "" {
+						t.Fatalf("%s Row %d: expected Last Login unchanged; got %q", sheetNamePasswordManager, rowIdx+1, gotLastLogin)
+					}
 				}
 				if len(handler.UserToNewPassword) != 0 {
 					t.Fatalf("Passwords were updated for users not in the manager: %v", handler.UserToNewPassword)
 				}
 
+				j := &Journal{}
+				if b, ok := fc.Objects[journalKey(input.Key)]; ok {
+					err = json.Unmarshal(b, j)
+					if err != nil {
+						t.Fatalf("Error parsing journal: %s", err)
+					}
+				}
+				for _, entry := range j.Entries {
+					if entry.Committed {
+						continue
+					}
+					if path := tc.ServerErrors[entry.Username]; path != changePasswordPath && path != expiredPasswordPath {
+						t.Fatalf("Journal entry for %s was not reconciled", entry.Username)
+					}
+				}
+
+				rotated := 0
+				for _, expected := range tc.PasswordManagerOut {
+					if expected.Password == newPasswordMarker {
+						rotated++
+					}
+				}
+				if got := runMetrics[dev][metricRotationsSucceeded]; got != float64(rotated) {
+					t.Fatalf("Expected RotationsSucceeded %d; got %v", rotated, got)
+				}
+				if got := runMetrics[dev][metricHeartbeatsAttempted]; got != float64(len(tc.Heartbeats)) {
+					t.Fatalf("Expected HeartbeatsAttempted %d; got %v", len(tc.Heartbeats), got)
+				}
+				if runMetrics[allEnvironments][metricS3Uploads] < 1 || runMetrics[allEnvironments][metricS3UploadBytes] < 1 {
+					t.Fatalf("Expected S3 upload metrics of the run report; got %v", runMetrics[allEnvironments])
+				}
+				if rotated > 0 && (runMetrics[dev][metricS3Uploads] < 1 || runMetrics[dev][metricS3UploadBytes] < 1) {
+					t.Fatalf("Expected S3 upload metrics of the rotations in dev; got %v", runMetrics[dev])
+				}
+
+				report := getRunReport(t, fc, input.ReportPrefix)
+				for _, expected := range tc.PasswordManagerOut {
+					records := 0
+					for _, rec := range report.Records {
+						if rec.Environment != dev || rec.User != expected.Username {
+							continue
+						}
+						records++
+						if action, ok := tc.Heartbeats[expected.Username]; ok && rec.Action != action || !ok && strings.HasPrefix(rec.Action, actionHeartbeat) {
+							t.Fatalf("Run report has %+v for %s; expected heartbeat action %q", rec, expected.Username, action)
+						}
+						changed := rec.Action == actionRotated || rec.Action == actionAdded || rec.Action == actionRecovered
+						// a password recovered from the journal changes without a new password
+						if expected.Password == newPasswordMarker && !changed || expected.Password != newPasswordMarker && rec.Action == actionRotated ||
+							changed && rec.NewTimestamp == "" {
+							t.Fatalf("Run report has %+v for %s, whose expected password is %q", rec, expected.Username, expected.Password)
+						}
+					}
+					if records != 1 {
+						t.Fatalf("Expected 1 run report record for %s; got %d", expected.Username, records)
+					}
+				}
+				for key, obj := range fc.Objects {
+					if !strings.HasPrefix(key, input.ReportPrefix) {
+						continue
+					}
+					for _, password := range generated {
+						if strings.Contains(string(obj), password) {
+							t.Fatalf("Password %q appears in run report %s", password, key)
+						}
+					}
+				}
+
 				macFinUsers := map[string]struct{}{}
 				for _, row := range tc.MACFinIn {
 					if row.Username != "" {
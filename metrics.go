@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	defaultMetricsNamespace = "portal-test-user-manager"
+
+	// most values of one metric in an EMF line
+	maxMetricValues = 100
+
+	// the Environment dimension of metrics of the run as a whole
+	allEnvironments Environment = "all"
+)
+
+// metric names
+const (
+	metricRotationsAttempted   = "RotationsAttempted"
+	metricRotationsSucceeded   = "RotationsSucceeded"
+	metricRotationsFailed      = "RotationsFailed"
+	metricAccountsSkipped      = "AccountsSkipped"
+	metricAccountsLocked       = "AccountsLocked"
+	metricAccountsQuarantined  = "AccountsQuarantined"
+	metricHeartbeatsAttempted  = "HeartbeatsAttempted"
+	metricHeartbeatsFailed     = "HeartbeatsFailed"
+	metricPortalRequestLatency = "PortalRequestLatency"
+	metricRunDuration          = "RunDuration"
+	metricRunSucceeded         = "RunSucceeded"
+	metricS3Uploads            = "S3Uploads"
+	metricS3UploadBytes        = "S3UploadBytes"
+	metricVerificationsFailed  = "VerificationsFailed"
+	metricVerifyDuration       = "VerifyDuration"
+	metricVerifySucceeded      = "VerifySucceeded"
+)
+
+var metricUnits = map[string]string{
+	metricRotationsAttempted:   "Count",
+	metricRotationsSucceeded:   "Count",
+	metricRotationsFailed:      "Count",
+	metricAccountsSkipped:      "Count",
+	metricAccountsLocked:       "Count",
+	metricAccountsQuarantined:  "Count",
+	metricHeartbeatsAttempted:  "Count",
+	metricHeartbeatsFailed:     "Count",
+	metricPortalRequestLatency: "Milliseconds",
+	metricRunDuration:          "Milliseconds",
+	metricRunSucceeded:         "Count",
+	metricS3Uploads:            "Count",
+	metricS3UploadBytes:        "Bytes",
+	metricVerificationsFailed:  "Count",
+	metricVerifyDuration:       "Milliseconds",
+	metricVerifySucceeded:      "Count",
+}
+
+// Metrics collects a run's metrics and writes them to stdout in CloudWatch
+// Embedded Metric Format, dimensioned by Environment. Those of the run as a
+// whole, recorded with an empty environment, have the Environment "all".
+type Metrics struct {
+	mu        sync.Mutex
+	namespace string
+	counts    map[Environment]map[string]float64
+	samples   map[Environment]map[string][]float64
+}
+
+var metrics = newMetrics(defaultMetricsNamespace)
+
+var metricsOutput = &logOutput{w: os.Stdout}
+
+func newMetrics(namespace string) *Metrics {
+	return &Metrics{
+		namespace: namespace,
+		counts:    map[Environment]map[string]float64{},
+		samples:   map[Environment]map[string][]float64{},
+	}
+}
+
+// Add to a metric that is summed over the run
+func (m *Metrics) add(env Environment, name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counts[env] == nil {
+		m.counts[env] = map[string]float64{}
+	}
+	m.counts[env][name] += value
+}
+
+// Record one value of a metric whose every value is kept, such as a latency
+func (m *Metrics) observe(env Environment, name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.samples[env] == nil {
+		m.samples[env] = map[string][]float64{}
+	}
+	m.samples[env][name] = append(m.samples[env][name], value)
+}
+
+// emfMetric is a metric definition in the _aws member of an EMF line.
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// Get the EMF lines for the metrics recorded so far, one environment at a
+// time. Metrics with more values than an EMF line holds continue on further
+// lines. Called with m.mu held.
+func (m *Metrics) lines(now time.Time) ([][]byte, error) {
+	seen := map[Environment]bool{}
+	for env := range m.counts {
+		seen[env] = true
+	}
+	for env := range m.samples {
+		seen[env] = true
+	}
+	envs := []Environment{}
+	for env := range seen {
+		envs = append(envs, env)
+	}
+	sort.Slice(envs, func(i, j int) bool { return envs[i] < envs[j] })
+
+	lines := [][]byte{}
+	for _, env := range envs {
+		for chunk := 0; ; chunk++ {
+			values := map[string]interface{}{}
+			if chunk == 0 {
+				for name, v := range m.counts[env] {
+					values[name] = v
+				}
+			}
+			more := false
+			for name, samples := range m.samples[env] {
+				start := chunk * maxMetricValues
+				if start >= len(samples) {
+					continue
+				}
+				end := start + maxMetricValues
+				if end < len(samples) {
+					more = true
+				} else {
+					end = len(samples)
+				}
+				values[name] = samples[start:end]
+			}
+			if len(values) == 0 {
+				break
+			}
+
+			line, err := m.line(env, values, now)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, line)
+			if !more {
+				break
+			}
+		}
+	}
+	return lines, nil
+}
+
+func (m *Metrics) line(env Environment, values map[string]interface{}, now time.Time) ([]byte, error) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if env == "" {
+		env = allEnvironments
+	}
+	directive := emfDirective{Namespace: m.namespace, Dimensions: [][]string{{"Environment"}}}
+	line := map[string]interface{}{"Environment": env}
+	for _, name := range names {
+		directive.Metrics = append(directive.Metrics, emfMetric{Name: name, Unit: metricUnits[name]})
+	}
+	line["_aws"] = emfMetadata{
+		Timestamp:         now.UnixNano() / int64(time.Millisecond),
+		CloudWatchMetrics: []emfDirective{directive},
+	}
+	for name, v := range values {
+		line[name] = v
+	}
+	return json.Marshal(line)
+}
+
+// Write the metrics recorded so far as EMF lines and start over
+func (m *Metrics) flush() error {
+	m.mu.Lock()
+	lines, err := m.lines(time.Now())
+	m.counts = map[Environment]map[string]float64{}
+	m.samples = map[Environment]map[string][]float64{}
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	metricsOutput.mu.Lock()
+	defer metricsOutput.mu.Unlock()
+	for _, line := range lines {
+		_, err = metricsOutput.w.Write(append(line, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send metrics to w
+func setMetricsOutput(w io.Writer) {
+	metricsOutput.mu.Lock()
+	metricsOutput.w = w
+	metricsOutput.mu.Unlock()
+}
+
+// meteredTransport records the latency of each request to an environment's
+// portal.
+type meteredTransport struct {
+	env  Environment
+	next http.RoundTripper
+}
+
+func (t *meteredTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	metrics.observe(t.env, metricPortalRequestLatency, float64(durationMS(start)))
+	return resp, err
+}
+
+// runTimer records whether a run succeeded and how long it took, as a whole
+// and in each environment it covers, as a RunSucceeded and RunDuration or
+// similar pair of metrics.
+type runTimer struct {
+	succeededMetric string
+	durationMetric  string
+
+	start     time.Time
+	envs      []Environment
+	envStart  time.Time
+	durations map[Environment]time.Duration
+	succeeded map[Environment]bool
+}
+
+func newRunTimer(envs []Environment, succeededMetric, durationMetric string) *runTimer {
+	return &runTimer{
+		succeededMetric: succeededMetric,
+		durationMetric:  durationMetric,
+		start:           time.Now(),
+		envs:            envs,
+		durations:       map[Environment]time.Duration{},
+		succeeded:       map[Environment]bool{},
+	}
+}
+
+func (t *runTimer) startEnv() {
+	t.envStart = time.Now()
+}
+
+// Add the time since startEnv to env's duration
+func (t *runTimer) stopEnv(env Environment) {
+	t.durations[env] += time.Since(t.envStart)
+}
+
+// Record whether the run did everything it had to in env
+func (t *runTimer) finishEnv(env Environment, ok bool) {
+	t.succeeded[env] = ok
+}
+
+// Add whether the run succeeded and its duration and write the run's metrics.
+// An environment the run did not finish did not succeed.
+func (t *runTimer) flush(runSucceeded bool) {
+	for _, env := range t.envs {
+		succeeded := 0.0
+		if t.succeeded[env] {
+			succeeded = 1
+		}
+		metrics.add(env, t.succeededMetric, succeeded)
+		if d, ok := t.durations[env]; ok {
+			metrics.add(env, t.durationMetric, float64(d.Milliseconds()))
+		}
+	}
+	succeeded := 0.0
+	if runSucceeded {
+		succeeded = 1
+	}
+	metrics.add("", t.succeededMetric, succeeded)
+	metrics.add("", t.durationMetric, float64(durationMS(t.start)))
+	metricsErr := metrics.flush()
+	if metricsErr != nil {
+		logger.Error("failed to write metrics", metricsErr, nil)
+	}
+}
+
+// meteredS3Client counts uploads and the bytes uploaded, for env or, if it is
+// empty, for the run as a whole.
+type meteredS3Client struct {
+	S3ClientAPI
+	env Environment
+}
+
+// The client to upload an environment's changes with, which counts its
+// uploads for env if client is metered
+func envS3Client(client S3ClientAPI, env Environment) S3ClientAPI {
+	if c, ok := client.(meteredS3Client); ok {
+		return meteredS3Client{S3ClientAPI: c.S3ClientAPI, env: env}
+	}
+	return client
+}
+
+func (c meteredS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	size := bodySize(params.Body)
+	out, err := c.S3ClientAPI.PutObject(ctx, params, optFns...)
+	if err == nil {
+		metrics.add(c.env, metricS3Uploads, 1)
+		metrics.add(c.env, metricS3UploadBytes, float64(size))
+	}
+	return out, err
+}
+
+// The bytes left to read from an upload body, without reading it. Bodies
+// that cannot seek count as 0.
+func bodySize(body io.Reader) int64 {
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return 0
+	}
+	pos, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0
+	}
+	_, err = seeker.Seek(pos, io.SeekStart)
+	if err != nil {
+		return 0
+	}
+	return end - pos
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	buf := &lockedBuffer{}
+	setMetricsOutput(buf)
+	defer setMetricsOutput(os.Stdout)
+
+	m := newMetrics("test-namespace")
+	m.add(prod, metricRotationsFailed, 1)
+	m.add(prod, metricRotationsFailed, 2)
+	for i := 0; i < maxMetricValues+5; i++ {
+		m.observe(prod, metricPortalRequestLatency, float64(i))
+	}
+	m.add("", metricRunSucceeded, 1)
+	err := m.flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected a run line and two prod lines; got %q", buf.String())
+	}
+	type emfLine struct {
+		AWS                  emfMetadata `json:"_aws"`
+		Environment          string
+		RotationsFailed      *float64
+		RunSucceeded         *float64
+		PortalRequestLatency []float64
+	}
+	parsed := make([]emfLine, len(lines))
+	for i, line := range lines {
+		err = json.Unmarshal([]byte(line), &parsed[i])
+		if err != nil {
+			t.Fatalf("Line %d is not JSON: %s: %q", i, err, line)
+		}
+		d := parsed[i].AWS.CloudWatchMetrics[0]
+		if d.Namespace != "test-namespace" || parsed[i].AWS.Timestamp == 0 {
+			t.Fatalf("Line %d: unexpected metadata %+v", i, parsed[i].AWS)
+		}
+	}
+
+	run, first, second := parsed[0], parsed[1], parsed[2]
+	if run.Environment != "all" || run.AWS.CloudWatchMetrics[0].Dimensions[0][0] != "Environment" || run.RunSucceeded == nil || *run.RunSucceeded != 1 {
+		t.Fatalf("Unexpected run line %q", lines[0])
+	}
+	if first.Environment != "prod" || first.AWS.CloudWatchMetrics[0].Dimensions[0][0] != "Environment" ||
+		first.RotationsFailed == nil || *first.RotationsFailed != 3 || len(first.PortalRequestLatency) != maxMetricValues {
+		t.Fatalf("Unexpected first prod line %q", lines[1])
+	}
+	for _, metric := range first.AWS.CloudWatchMetrics[0].Metrics {
+		if metric.Unit != metricUnits[metric.Name] {
+			t.Fatalf("Expected unit %s for %s; got %s", metricUnits[metric.Name], metric.Name, metric.Unit)
+		}
+	}
+	if second.RotationsFailed != nil || len(second.PortalRequestLatency) != 5 || second.PortalRequestLatency[0] != maxMetricValues {
+		t.Fatalf("Unexpected second prod line %q", lines[2])
+	}
+
+	// flushing starts over
+	err = m.flush()
+	if err != nil || len(strings.Split(strings.TrimSpace(buf.String()), "\n")) != 3 {
+		t.Fatalf("Expected no new lines after flushing; got %q, %v", buf.String(), err)
+	}
+
+	body := bytes.NewReader([]byte("0123456789"))
+	body.Seek(4, io.SeekStart)
+	if size := bodySize(body); size != 6 {
+		t.Fatalf("Expected 6 bytes left to upload; got %d", size)
+	}
+	rest, _ := io.ReadAll(body)
+	if string(rest) != "456789" {
+		t.Fatalf("Expected bodySize to leave the body where it was; read %q", rest)
+	}
+}
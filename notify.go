@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Notifier tells people how a run went. Each notifier decides by its own
+// notification policy whether a run is worth telling.
+type Notifier interface {
+	// name for log lines and errors
+	name() string
+	// report a finished run; f is the rotated workbook
+	notify(f *excelize.File, report *RunReport) error
+	// report a run that stopped with an error
+	alert(report *RunReport) error
+}
+
+// mailNotifier emails the workbook through the SMTP relay.
+type mailNotifier struct {
+	input *Input
+}
+
+func (n *mailNotifier) name() string {
+	return "mail"
+}
+
+func (n *mailNotifier) notify(f *excelize.File, report *RunReport) error {
+	return sendEmail(f, n.input, report)
+}
+
+func (n *mailNotifier) alert(report *RunReport) error {
+	return sendAlertEmail(n.input, report)
+}
+
+// Build the configured notifiers, loading their templates
+func newNotifiers(input *Input, client S3ClientAPI) ([]Notifier, error) {
+	notifiers := []Notifier{}
+	if input.Mail.Enabled {
+		templates, err := loadMailTemplates(input.Mail, client)
+		if err != nil {
+			return nil, err
+		}
+		input.MailTemplates = templates
+		notifiers = append(notifiers, &mailNotifier{input: input})
+	}
+	for _, hook := range input.Webhooks {
+		n, err := newWebhookNotifier(hook, client)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: %s", hook.Name, err)
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
+
+// Tell every notifier how a finished run went. Every notifier is tried
+// before an error is returned.
+func notifyRun(f *excelize.File, input *Input, report *RunReport) error {
+	failed := []string{}
+	for _, n := range input.Notifiers {
+		err := n.notify(f, report)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", n.name(), err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Error notifying: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Tell every notifier that the run stopped with an error, logging any
+// notifier that fails
+func notifyAlert(input *Input, report *RunReport) {
+	for _, n := range input.Notifiers {
+		err := n.alert(report)
+		if err != nil {
+			logger.Error("failed to send alert", err, Fields{"notifier": n.name()})
+		}
+	}
+}
@@ -70,7 +70,39 @@ resource "aws_iam_role" "task_role" {
 data "aws_iam_policy_document" "s3_access" {
   statement {
     actions   = ["s3:GetObject", "s3:PutObject"]
-    resources = ["arn:aws:s3:::${var.s3_bucket}/${var.s3_key}", ]
+    resources = ["arn:aws:s3:::${var.s3_bucket}/${var.s3_key}", "arn:aws:s3:::${var.s3_bucket}/${var.s3_key}.journal", ]
+    effect    = "Allow"
+  }
+
+  # run reports
+  statement {
+    actions   = ["s3:PutObject"]
+    resources = ["arn:aws:s3:::${var.s3_bucket}/${var.report_prefix}*", ]
+    effect    = "Allow"
+  }
+
+  dynamic "statement" {
+    for_each = var.config_s3_key == "" ? [] : [var.config_s3_key]
+    content {
+      actions   = ["s3:GetObject"]
+      resources = ["arn:aws:s3:::${var.s3_bucket}/${statement.value}", ]
+      effect    = "Allow"
+    }
+  }
+
+  dynamic "statement" {
+    for_each = length(concat(var.mail_template_s3_keys, var.webhook_template_s3_keys)) == 0 ? [] : [concat(var.mail_template_s3_keys, var.webhook_template_s3_keys)]
+    content {
+      actions   = ["s3:GetObject"]
+      resources = [for key in statement.value : "arn:aws:s3:::${var.s3_bucket}/${key}"]
+      effect    = "Allow"
+    }
+  }
+
+  # lets GetObject report a missing journal as NoSuchKey instead of AccessDenied
+  statement {
+    actions   = ["s3:ListBucket"]
+    resources = ["arn:aws:s3:::${var.s3_bucket}", ]
     effect    = "Allow"
   }
 }
@@ -96,7 +128,8 @@ resource "aws_iam_role" "task_execution_role" {
 data "aws_iam_policy_document" "parameter_store" {
   statement {
     actions   = ["ssm:GetParameters"]
-    resources = ["${aws_ssm_parameter.automated_sheet_password.arn}", "${aws_ssm_parameter.workbook_password.arn}", ]
+    resources = concat(["${aws_ssm_parameter.automated_sheet_password.arn}", "${aws_ssm_parameter.workbook_password.arn}", "${aws_ssm_parameter.smtp_password.arn}", ],
+    [for p in aws_ssm_parameter.webhook_url : p.arn], [for p in aws_ssm_parameter.webhook_secret : p.arn])
     effect    = "Allow"
   }
 }
@@ -159,7 +192,7 @@ resource "aws_cloudwatch_metric_alarm" "run_command" {
 
 resource "aws_cloudwatch_log_metric_filter" "error_count" {
   name           = "${var.app_name}-error-count"
-  pattern        = "?Error ?failed"
+  pattern        = "{ $.level = \"error\" }"
   log_group_name = local.awslogs_group
 
   metric_transformation {
@@ -188,7 +221,7 @@ resource "aws_cloudwatch_metric_alarm" "error_count" {
 
 resource "aws_cloudwatch_log_metric_filter" "info_count" {
   name           = "${var.app_name}-info-count"
-  pattern        = "Info"
+  pattern        = "{ $.level = \"warn\" }"
   log_group_name = local.awslogs_group
 
   metric_transformation {
@@ -200,7 +233,7 @@ resource "aws_cloudwatch_log_metric_filter" "info_count" {
 }
 
 resource "aws_cloudwatch_metric_alarm" "info_count" {
-  alarm_description   = "Detects missing username or password logged by ${var.app_name}"
+  alarm_description   = "Detects workbook problems, such as a missing username or password, logged by ${var.app_name}"
   alarm_name          = "${var.app_name}-info"
   comparison_operator = "GreaterThanOrEqualToThreshold"
   evaluation_periods  = 1
@@ -215,6 +248,52 @@ resource "aws_cloudwatch_metric_alarm" "info_count" {
   ok_actions          = [aws_sns_topic.password_rotation.arn]
 }
 
+# Alarms on the metrics the application writes to stdout in CloudWatch
+# Embedded Metric Format
+
+resource "aws_cloudwatch_metric_alarm" "rotations_failed" {
+  for_each = toset([for name in split(",", var.environments) : trimspace(name)])
+
+  alarm_description   = "Detects failed password rotations in ${each.key}"
+  alarm_name          = "${var.app_name}-rotations-failed-${each.key}"
+  comparison_operator = "GreaterThanOrEqualToThreshold"
+  evaluation_periods  = 1
+  metric_name         = "RotationsFailed"
+  namespace           = var.app_name
+  period              = "300"
+  statistic           = "Sum"
+  threshold           = "1"
+  treat_missing_data  = "notBreaching"
+  datapoints_to_alarm = "1"
+  alarm_actions       = [aws_sns_topic.password_rotation.arn]
+  ok_actions          = [aws_sns_topic.password_rotation.arn]
+
+  dimensions = {
+    Environment = each.key
+  }
+}
+
+resource "aws_cloudwatch_metric_alarm" "no_successful_run" {
+  alarm_description   = "Detects that ${var.app_name} has not completed a run in ${var.successful_run_alarm_hours} hours"
+  alarm_name          = "${var.app_name}-no-successful-run"
+  comparison_operator = "LessThanThreshold"
+  evaluation_periods  = var.successful_run_alarm_hours
+  metric_name         = "RunSucceeded"
+  namespace           = var.app_name
+  period              = "3600"
+  statistic           = "Sum"
+  threshold           = "1"
+  treat_missing_data  = "breaching"
+  datapoints_to_alarm = var.successful_run_alarm_hours
+  alarm_actions       = [aws_sns_topic.password_rotation.arn]
+  ok_actions          = [aws_sns_topic.password_rotation.arn]
+
+  # the run as a whole
+  dimensions = {
+    Environment = "all"
+  }
+}
+
 ## SNS ##
 
 resource "aws_sns_topic" "password_rotation" {
@@ -281,6 +360,9 @@ resource "aws_ecs_task_definition" "scheduled_task_def" {
       password_header                     = var.password_header
       automated_sheet_password_param_name = aws_ssm_parameter.automated_sheet_password.name
       workbook_password_param_name        = aws_ssm_parameter.workbook_password.name
+      smtp_password_param_name            = aws_ssm_parameter.smtp_password.name
+      webhook_url_param_names             = { for name, p in aws_ssm_parameter.webhook_url : upper(name) => p.name }
+      webhook_secret_param_names          = { for name, p in aws_ssm_parameter.webhook_secret : upper(name) => p.name }
 
       portal_sheet_name_dev  = var.portal_sheet_name_dev
       portal_sheet_name_val  = var.portal_sheet_name_val
@@ -297,17 +379,26 @@ resource "aws_ecs_task_definition" "scheduled_task_def" {
       awslogs_group  = local.awslogs_group,
       awslogs_region = data.aws_region.current.name
 
-      smtp_port    = var.smtp_port
-      smtp_host    = var.smtp_host
-      from_address = var.from_address
-      sender_name  = var.sender_name
-      to_addresses = var.to_addresses
-      mail_enabled = var.mail_enabled
+      smtp_port     = var.smtp_port
+      smtp_host     = var.smtp_host
+      from_address  = var.from_address
+      sender_name   = var.sender_name
+      to_addresses  = var.to_addresses
+      mail_enabled  = var.mail_enabled
+      mail_notify   = var.mail_notify
+      smtp_auth     = var.smtp_auth
+      smtp_username = var.smtp_username
+      smtp_tls      = var.smtp_tls
 
       devportal_testing_sheet_names  = var.devportal_testing_sheet_names
       valportal_testing_sheet_names  = var.valportal_testing_sheet_names
       prodportal_testing_sheet_names = var.prodportal_testing_sheet_names
 
+      environments          = var.environments
+      config                = var.config_s3_key == "" ? "" : "s3://${var.s3_bucket}/${var.config_s3_key}"
+      report_prefix         = var.report_prefix
+      metrics_namespace     = var.app_name
+      environment_variables = var.environment_variables
     }
   )
 }
@@ -340,6 +431,40 @@ resource "aws_ssm_parameter" "workbook_password" {
   }
 }
 
+# used when smtp_auth is not none
+resource "aws_ssm_parameter" "smtp_password" {
+  name  = "${var.app_name}-${var.environment}-smtp-password"
+  type  = "SecureString"
+  value = "set_manually_after_creation"
+
+  lifecycle {
+    ignore_changes = [value]
+  }
+}
+
+# one of each per webhook in webhook_names
+resource "aws_ssm_parameter" "webhook_url" {
+  for_each = toset(var.webhook_names)
+  name     = "${var.app_name}-${var.environment}-webhook-${each.key}-url"
+  type     = "SecureString"
+  value    = "set_manually_after_creation"
+
+  lifecycle {
+    ignore_changes = [value]
+  }
+}
+
+resource "aws_ssm_parameter" "webhook_secret" {
+  for_each = toset(var.webhook_names)
+  name     = "${var.app_name}-${var.environment}-webhook-${each.key}-secret"
+  type     = "SecureString"
+  value    = "set_manually_after_creation"
+
+  lifecycle {
+    ignore_changes = [value]
+  }
+}
+
 # S3 bucket
 resource "aws_s3_bucket" "spreadsheet" {
   bucket = var.s3_bucket
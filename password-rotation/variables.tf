@@ -152,6 +152,29 @@ variable "mail_enabled" {
   default = "false"
 }
 
+variable "mail_notify" {
+  description = "When to email the workbook: always, on-change, on-failure or never"
+  type        = string
+  default     = "always"
+}
+
+variable "smtp_auth" {
+  description = "SMTP authentication: none, plain, login or cram-md5; the password is in the smtp-password SSM parameter"
+  type        = string
+  default     = "none"
+}
+
+variable "smtp_username" {
+  type    = string
+  default = ""
+}
+
+variable "smtp_tls" {
+  description = "SMTP TLS: opportunistic, starttls or implicit"
+  type        = string
+  default     = "opportunistic"
+}
+
 variable "devportal_testing_sheet_names" {
   description = "comma-separated sheet names"
   type        = string
@@ -170,3 +193,50 @@ variable "prodportal_testing_sheet_names" {
   default     = ""
 }
 
+variable "environments" {
+  description = "comma-separated names of the portal environments to rotate, for ex: \"dev,val,prod\""
+  type        = string
+  default     = "dev,val,prod"
+}
+
+variable "environment_variables" {
+  description = "additional environment variables for the task, such as the hostnames and sheet names of environments other than dev, val and prod"
+  type        = map(string)
+  default     = {}
+}
+
+variable "config_s3_key" {
+  description = "key of an optional YAML or JSON configuration file in the S3 bucket; task environment variables override it"
+  type        = string
+  default     = ""
+}
+
+variable "mail_template_s3_keys" {
+  description = "keys of mail templates in the S3 bucket that the task may read"
+  type        = list(string)
+  default     = []
+}
+
+variable "webhook_names" {
+  description = "names of the webhooks in the configuration file, each given SSM parameters for its URL and secret"
+  type        = list(string)
+  default     = []
+}
+
+variable "webhook_template_s3_keys" {
+  description = "keys of webhook payload templates in the S3 bucket that the task may read"
+  type        = list(string)
+  default     = []
+}
+
+variable "report_prefix" {
+  description = "key prefix in the S3 bucket under which each run writes its report as JSON and CSV"
+  type        = string
+  default     = "reports/"
+}
+
+variable "successful_run_alarm_hours" {
+  description = "hours without a successful run before the no-successful-run alarm fires; at most 168"
+  type        = number
+  default     = 48
+}
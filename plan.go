@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/xuri/excelize/v2"
+)
+
+// Plan lists the changes a rotation would make without logging in to the
+// portal or uploading the workbook.
+type Plan struct {
+	Bucket       string            `json:"bucket"`
+	Key          string            `json:"key"`
+	Environments []EnvironmentPlan `json:"environments"`
+}
+
+type EnvironmentPlan struct {
+	Environment       string       `json:"environment"`
+	AutomatedSheet    string       `json:"automatedSheet"`
+	PortalSheet       string       `json:"portalSheet"`
+	Replayed          []string     `json:"replayed"` // uncommitted journal entries recovered before anything else
+	Added             []string     `json:"added"`
+	Deleted           []string     `json:"deleted"`
+	Rotated           []string     `json:"rotated"`
+	Heartbeat         []string     `json:"heartbeat"` // logged in without rotating
+	Skipped           []string     `json:"skipped"`
+	Quarantined       []string     `json:"quarantined"` // not logged in until the Quarantined cell is cleared
+	TestingSheetCells []CellChange `json:"testingSheetCells"`
+}
+
+// CellChange is a testing sheet cell that would receive a new password.
+type CellChange struct {
+	Sheet  string `json:"sheet"`
+	Cell   string `json:"cell"`
+	User   string `json:"user"`
+	Reason string `json:"reason"` // "rotation" or "sync"
+}
+
+// readOnlyS3Client downloads from S3 but never uploads. It lets plan reuse
+// the functions that prepare the workbook, which upload as they go.
+type readOnlyS3Client struct {
+	S3ClientAPI
+}
+
+func (c readOnlyS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	return &s3.PutObjectOutput{}, nil
+}
+
+func sortedUsers(users map[string]bool) []string {
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Build a plan from the workbook in S3. The workbook is prepared exactly as
+// rotate prepares it, but only the local copy is modified.
+func plan(input *Input, envToPortal map[Environment]*Portal, client S3ClientAPI) (*Plan, error) {
+	client = readOnlyS3Client{client}
+
+	f, err := downloadFile(input, client)
+	if err != nil {
+		return nil, err
+	}
+	defer closeWorkbook(f)
+
+	err = validateSheets(f, input)
+	if err != nil {
+		return nil, err
+	}
+
+	// rotate replays the journal before the sheets are synchronized
+	journal, err := loadJournal(input, client)
+	if err != nil {
+		return nil, err
+	}
+	envToReplayed := map[Environment][]string{}
+	for env := range envToPortal {
+		replayed, err := planReplay(f, input, journal, env)
+		if err != nil {
+			return nil, err
+		}
+		envToReplayed[env] = replayed
+	}
+
+	err = removeDupsFromMACFinSheets(f, input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Plan{
+		Bucket: input.Bucket,
+		Key:    input.Key,
+	}
+	for _, env := range sortedEnvironments(envToPortal) {
+		ep, err := planEnvironment(f, input, client, env)
+		if err != nil {
+			return nil, err
+		}
+		ep.Replayed = envToReplayed[env]
+		p.Environments = append(p.Environments, *ep)
+	}
+
+	return p, nil
+}
+
+// Users whose uncommitted journal entries the next run would try against the
+// portal. Entries for users no longer in the sheet are dropped, not replayed.
+func planReplay(f *excelize.File, input *Input, journal *Journal, env Environment) ([]string, error) {
+	pending := journal.pendingUsers(env)
+	if len(pending) == 0 {
+		return nil, nil
+	}
+	userToPasswordRow, err := getManagedUsers(f, input, env)
+	if err != nil {
+		return nil, err
+	}
+	for name := range pending {
+		if _, ok := userToPasswordRow[name]; !ok {
+			delete(pending, name)
+		}
+	}
+	return sortedUsers(pending), nil
+}
+
+func planEnvironment(f *excelize.File, input *Input, client S3ClientAPI, env Environment) (*EnvironmentPlan, error) {
+	group := input.SheetGroups[env]
+	ep := &EnvironmentPlan{
+		Environment:    env.String(),
+		AutomatedSheet: group.AutomatedSheetName,
+		PortalSheet:    group.PortalSheetName,
+	}
+
+	added, deleted, err := syncChanges(f, input, env)
+	if err != nil {
+		return nil, err
+	}
+	ep.Added = sortedUsers(added)
+	ep.Deleted = sortedUsers(deleted)
+
+	err = syncPasswordManagerUsersToMACFinUsers(f, input, client, env)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := f.GetRows(group.AutomatedSheetName)
+	if err != nil {
+		return nil, err
+	}
+	colUser := input.AutomatedSheetColNameToIndex[ColUser]
+	colPassword := input.AutomatedSheetColNameToIndex[ColPassword]
+	colTimestamp := input.AutomatedSheetColNameToIndex[ColTimestamp]
+	header := getHeaderToXCoord(rows[0])
+	colLastLogin, hasLastLogin := header[ColLastLoginHeading]
+
+	userToPolicy, err := getUserPolicies(f, input, env)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	rotated := map[string]bool{}
+	userToPassword := map[string]string{}
+	for i, row := range rows[input.RowOffset:] {
+		name := row[colUser]
+		userToPassword[name] = row[colPassword]
+		policy, ok := userToPolicy[name]
+		if !ok {
+			policy = input.policy(env)
+		}
+		due, err := rotationDue(row[colTimestamp], now, policy.MaxAgeDays)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing timestamp from row %d for user %s: %s", toSheetCoord(i+input.RowOffset), name, err)
+		}
+		lastLogin := ""
+		if hasLastLogin && colLastLogin < len(row) {
+			lastLogin = row[colLastLogin]
+		}
+		if readLockout(header, row).quarantined != "" {
+			ep.Quarantined = append(ep.Quarantined, name)
+		} else if due {
+			rotated[name] = true
+			ep.Rotated = append(ep.Rotated, name)
+		} else if heartbeatDue(lastLogin, row[colTimestamp], now, policy.HeartbeatDays) {
+			ep.Heartbeat = append(ep.Heartbeat, name)
+		} else {
+			ep.Skipped = append(ep.Skipped, name)
+		}
+	}
+
+	sheetList := f.GetSheetList()
+	for _, sh := range group.TestingSheetNames {
+		sheet := strings.TrimSpace(sh)
+		if !contains(sheetList, sheet) {
+			continue
+		}
+
+		rows, userX, passwordX, err := getTestingSheetRows(f, input, sheet)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			continue
+		}
+
+		for i, row := range rows[input.RowOffset:] {
+			if len(row) < userX+1 || len(row) < passwordX+1 {
+				continue
+			}
+			username := strings.ToLower(row[userX])
+			password, ok := userToPassword[username]
+			if !ok {
+				continue
+			}
+
+			reason := ""
+			if rotated[username] {
+				reason = "rotation"
+			} else if row[passwordX] != password {
+				reason = "sync"
+			} else {
+				continue
+			}
+
+			cell, err := excelize.CoordinatesToCellName(toSheetCoord(passwordX), toSheetCoord(i+input.RowOffset))
+			if err != nil {
+				return nil, err
+			}
+			ep.TestingSheetCells = append(ep.TestingSheetCells, CellChange{
+				Sheet:  sheet,
+				Cell:   cell,
+				User:   username,
+				Reason: reason,
+			})
+		}
+	}
+
+	return ep, nil
+}
+
+func (p *Plan) log() {
+	for _, ep := range p.Environments {
+		planLog := logger.With(Fields{"env": ep.Environment, "sheet": ep.AutomatedSheet})
+		planLog.Info("plan", Fields{
+			"replay":              len(ep.Replayed),
+			"add":                 len(ep.Added),
+			"delete":              len(ep.Deleted),
+			"rotate":              len(ep.Rotated),
+			"heartbeat":           len(ep.Heartbeat),
+			"skip":                len(ep.Skipped),
+			"quarantined":         len(ep.Quarantined),
+			"testing_sheet_cells": len(ep.TestingSheetCells),
+		})
+		for _, user := range ep.Replayed {
+			planLog.Info("plan: recover journal entry for user", Fields{"user": user})
+		}
+		for _, user := range ep.Added {
+			planLog.Info("plan: add user", Fields{"user": user})
+		}
+		for _, user := range ep.Deleted {
+			planLog.Info("plan: delete user", Fields{"user": user})
+		}
+		for _, user := range ep.Rotated {
+			planLog.Info("plan: rotate user", Fields{"user": user})
+		}
+		for _, user := range ep.Heartbeat {
+			planLog.Info("plan: heartbeat user", Fields{"user": user})
+		}
+		for _, user := range ep.Skipped {
+			planLog.Info("plan: skip user", Fields{"user": user})
+		}
+		for _, user := range ep.Quarantined {
+			planLog.Info("plan: skip quarantined user", Fields{"user": user})
+		}
+		for _, c := range ep.TestingSheetCells {
+			planLog.Info("plan: update testing sheet cell", Fields{"user": c.User, "cell": c.Sheet + "!" + c.Cell, "reason": c.Reason})
+		}
+	}
+}
+
+func (p *Plan) writeJSON(filename string) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error marshalling plan: %s", err)
+	}
+	err = os.WriteFile(filename, b, 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing plan to %s: %s", filename, err)
+	}
+	return nil
+}
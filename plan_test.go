@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/xuri/excelize/v2"
+)
+
+type countingS3Client struct {
+	*FakeS3Client
+	Puts int
+}
+
+func (c *countingS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	c.Puts++
+	return c.FakeS3Client.PutObject(ctx, params, optFns...)
+}
+
+func TestPlan(t *testing.T) {
+	dir := t.TempDir()
+	filename := path.Join(dir, localS3Filename)
+	testingSheet := "Testing"
+
+	f := excelize.NewFile()
+	f.SetSheetName("Sheet1", sheetNameMACFin)
+	f.NewSheet(sheetNamePasswordManager)
+	f.NewSheet(testingSheet)
+	sheetRows := map[string][][]string{
+		sheetNameMACFin: {
+			{headingMACFinUsername, headingMACFinPassword},
+			{"ben", "x"},
+			{"chris", "foo"},
+			{"James", "baz"},
+		},
+		sheetNamePasswordManager: {
+			{ColUserHeading, ColPasswordHeading, ColPreviousHeading, ColTimestampHeading},
+			{"ben", "x", "", format(-80 * Day)},
+			{"chris", "foo", "", format(-20 * Day)},
+			{"leslie", "bar", "", format(-90 * Day)},
+		},
+		testingSheet: {
+			{headingMACFinUsername, headingMACFinPassword},
+			{"ben", "x"},
+			{"chris", "stale"},
+			{"chris", "foo"},
+			{"nobody", "z"},
+		},
+	}
+	for sheet, rows := range sheetRows {
+		for idx, row := range rows {
+			row := row
+			err := f.SetSheetRow(sheet, fmt.Sprintf("A%d", 1+idx), &row)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err := f.SaveAs(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := &Input{
+		UsernameHeader:                 headingMACFinUsername,
+		PasswordHeader:                 headingMACFinPassword,
+		Bucket:                         inputBucket,
+		Key:                            inputKey,
+		AutomatedSheetColNameToIndex:   columnArrangements[0].Columns,
+		AutomatedSheetColNameToHeading: headings,
+		RowOffset:                      1,
+		SheetGroups: map[Environment]SheetGroup{
+			dev: {
+				AutomatedSheetName: sheetNamePasswordManager,
+				PortalSheetName:    sheetNameMACFin,
+				TestingSheetNames:  []string{testingSheet, "Missing"},
+			},
+		},
+	}
+	envToPortal := map[Environment]*Portal{
+		// nothing listens here; plan must not contact the portal
+		dev: {Hostname: portalServer, IDMHostname: idmServer, Scheme: "http://"},
+	}
+	journal, err := json.Marshal(&Journal{Entries: []JournalEntry{
+		{Environment: dev, Username: "chris", Committed: true},
+		{Environment: dev, Username: "leslie"},
+		{Environment: dev, Username: "gone"},
+		{Environment: "impl", Username: "ben"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := &countingS3Client{FakeS3Client: &FakeS3Client{
+		Bucket:    input.Bucket,
+		Key:       input.Key,
+		LocalPath: filename,
+		Objects:   map[string][]byte{journalKey(input.Key): journal},
+	}}
+
+	p, err := plan(input, envToPortal, fc)
+	if err != nil {
+		t.Fatalf("Error running plan(): %s", err)
+	}
+	if fc.Puts != 0 {
+		t.Fatalf("plan() uploaded the workbook %d times", fc.Puts)
+	}
+	after, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(original) {
+		t.Fatalf("plan() modified s3://%s/%s", input.Bucket, input.Key)
+	}
+
+	expected := []EnvironmentPlan{
+		{
+			Environment:    "dev",
+			AutomatedSheet: sheetNamePasswordManager,
+			PortalSheet:    sheetNameMACFin,
+			Replayed:       []string{"leslie"},
+			Added:          []string{"james"},
+			Deleted:        []string{"leslie"},
+			Rotated:        []string{"ben", "james"},
+			Skipped:        []string{"chris"},
+			TestingSheetCells: []CellChange{
+				{Sheet: testingSheet, Cell: "B2", User: "ben", Reason: "rotation"},
+				{Sheet: testingSheet, Cell: "B3", User: "chris", Reason: "sync"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(p.Environments, expected) {
+		t.Fatalf("expected plan %+v; got %+v", expected, p.Environments)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const defaultPasswordPolicy = "default"
+
+// character classes a policy can require
+const (
+	ClassDigit   = "digit"
+	ClassUpper   = "upper"
+	ClassLower   = "lower"
+	ClassSpecial = "special"
+)
+
+// maximum number of passwords generated before giving up on one that the
+// validator accepts
+const maxGenerateAttempts = 100
+
+// PasswordPolicy describes the passwords a portal accepts.
+type PasswordPolicy struct {
+	MinLength       int      `yaml:"minLength" json:"minLength"`
+	MaxLength       int      `yaml:"maxLength" json:"maxLength"`
+	RequiredClasses []string `yaml:"requiredClasses" json:"requiredClasses"` // digit, upper, lower, special
+	Specials        string   `yaml:"specials" json:"specials"`               // allowed special characters
+	Exclude         string   `yaml:"exclude" json:"exclude"`                 // characters never used, such as O0lI1
+	NoRepeats       bool     `yaml:"noRepeats" json:"noRepeats"`             // no character used twice
+	MaxClassRun     int      `yaml:"maxClassRun" json:"maxClassRun"`         // consecutive characters of one class; 0 for no limit
+	PreviousOverlap int      `yaml:"previousOverlap" json:"previousOverlap"` // reject sharing this many consecutive characters with the previous password; 0 to allow
+}
+
+// built-in policies, which a configuration file can add to or replace
+var passwordPolicies = map[string]PasswordPolicy{
+	defaultPasswordPolicy: {
+		MinLength:       passwordLength,
+		MaxLength:       passwordLength,
+		RequiredClasses: []string{ClassDigit, ClassUpper, ClassLower, ClassSpecial},
+		Specials:        specials,
+		PreviousOverlap: 4,
+	},
+	"strict": {
+		MinLength:       16,
+		MaxLength:       20,
+		RequiredClasses: []string{ClassDigit, ClassUpper, ClassLower, ClassSpecial},
+		Specials:        specials,
+		Exclude:         "O0lI1",
+		NoRepeats:       true,
+		MaxClassRun:     3,
+		PreviousOverlap: 3,
+	},
+}
+
+func policyNames(policies map[string]PasswordPolicy) []string {
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The characters of class that a password may contain
+func (p PasswordPolicy) classChars(class string) string {
+	var chars string
+	switch class {
+	case ClassDigit:
+		chars = digits
+	case ClassUpper:
+		chars = uppers
+	case ClassLower:
+		chars = lowers
+	case ClassSpecial:
+		chars = p.Specials
+	}
+	return removeChars(chars, p.Exclude)
+}
+
+var charClasses = []string{ClassDigit, ClassUpper, ClassLower, ClassSpecial}
+
+func classOf(c byte) string {
+	switch {
+	case strings.IndexByte(digits, c) >= 0:
+		return ClassDigit
+	case strings.IndexByte(uppers, c) >= 0:
+		return ClassUpper
+	case strings.IndexByte(lowers, c) >= 0:
+		return ClassLower
+	}
+	return ClassSpecial
+}
+
+// Check that passwords satisfying the policy exist
+func (p PasswordPolicy) check() error {
+	if p.MinLength < minPasswordLength || p.MaxLength > maxPasswordLength || p.MinLength > p.MaxLength {
+		return fmt.Errorf("password length %d to %d is not between %d and %d", p.MinLength, p.MaxLength, minPasswordLength, maxPasswordLength)
+	}
+	for _, c := range p.Specials {
+		if c > 127 || classOf(byte(c)) != ClassSpecial || c == ' ' {
+			return fmt.Errorf("special characters %q include %q", p.Specials, c)
+		}
+	}
+	available, classes := 0, 0
+	for _, class := range charClasses {
+		if n := len(p.classChars(class)); n > 0 {
+			available += n
+			classes++
+		}
+	}
+	if available == 0 {
+		return fmt.Errorf("no characters are allowed")
+	}
+	for _, class := range p.RequiredClasses {
+		if !contains(charClasses, class) {
+			return fmt.Errorf("unknown character class %q; use one of %s", class, strings.Join(charClasses, ", "))
+		}
+		if p.classChars(class) == "" {
+			return fmt.Errorf("no %s characters are allowed, but one is required", class)
+		}
+	}
+	if p.NoRepeats && available < p.MaxLength {
+		return fmt.Errorf("%d allowed characters are too few for %d characters without repeats", available, p.MaxLength)
+	}
+	if p.MaxClassRun < 0 {
+		return fmt.Errorf("maximum class run %d is negative", p.MaxClassRun)
+	}
+	if p.MaxClassRun > 0 && p.MaxClassRun < p.MaxLength && classes < 2 {
+		return fmt.Errorf("maximum class run %d needs characters from more than one class", p.MaxClassRun)
+	}
+	if p.PreviousOverlap < 0 {
+		return fmt.Errorf("previous password overlap %d is negative", p.PreviousOverlap)
+	}
+	return nil
+}
+
+// Generate a random password that satisfies the policy. It is built one
+// character at a time, choosing uniformly among the characters that keep the
+// password within the policy.
+func (p PasswordPolicy) Generate() (passwd string, err error) {
+	defer func() {
+		if rerr := recover(); rerr != nil && fmt.Sprint(rerr) == ErrCryptoSourceFailure.Error() {
+			passwd, err = "", ErrCryptoSourceFailure
+		} else if rerr != nil {
+			panic(rerr)
+		}
+	}()
+
+	err = p.check()
+	if err != nil {
+		return "", err
+	}
+
+	for attempt := 0; attempt < maxGenerateAttempts; attempt++ {
+		passwd = p.generate()
+		if passwd != "" && p.conforms(passwd) == nil {
+			return passwd, nil
+		}
+	}
+	return "", fmt.Errorf("failed to generate a password for the policy")
+}
+
+// Build one password, or return "" on reaching a dead end
+func (p PasswordPolicy) generate() string {
+	length := p.MinLength + rnd.Intn(p.MaxLength-p.MinLength+1)
+
+	pools := map[string]string{}
+	for _, class := range charClasses {
+		pools[class] = p.classChars(class)
+	}
+	missing := map[string]bool{}
+	for _, class := range p.RequiredClasses {
+		missing[class] = true
+	}
+
+	buf := make([]byte, 0, length)
+	runClass, runLength := "", 0
+	for len(buf) < length {
+		// the remaining places must be kept for required classes
+		mustUseMissing := len(missing) >= length-len(buf)
+
+		candidates := ""
+		for _, class := range charClasses {
+			if mustUseMissing && !missing[class] {
+				continue
+			}
+			if p.MaxClassRun > 0 && class == runClass && runLength >= p.MaxClassRun {
+				continue
+			}
+			candidates += pools[class]
+		}
+		if candidates == "" {
+			return ""
+		}
+
+		c := candidates[rnd.Intn(len(candidates))]
+		class := classOf(c)
+		buf = append(buf, c)
+		delete(missing, class)
+		if class == runClass {
+			runLength++
+		} else {
+			runClass, runLength = class, 1
+		}
+		if p.NoRepeats {
+			pools[class] = removeChars(pools[class], string(c))
+		}
+	}
+	return string(buf)
+}
+
+// Check that a password satisfies the policy's character rules
+func (p PasswordPolicy) conforms(password string) error {
+	if len(password) < p.MinLength || len(password) > p.MaxLength {
+		return fmt.Errorf("length %d is not between %d and %d", len(password), p.MinLength, p.MaxLength)
+	}
+
+	used := map[byte]bool{}
+	classes := map[string]bool{}
+	runLength := 0
+	for i := 0; i < len(password); i++ {
+		c := password[i]
+		class := classOf(c)
+		if strings.IndexByte(p.classChars(class), c) < 0 {
+			return fmt.Errorf("character %q is not allowed", c)
+		}
+		if p.NoRepeats && used[c] {
+			return fmt.Errorf("character %q is repeated", c)
+		}
+		used[c] = true
+		classes[class] = true
+
+		if i > 0 && classOf(password[i-1]) == class {
+			runLength++
+		} else {
+			runLength = 1
+		}
+		if p.MaxClassRun > 0 && runLength > p.MaxClassRun {
+			return fmt.Errorf("more than %d %s characters in a row", p.MaxClassRun, class)
+		}
+	}
+
+	for _, class := range p.RequiredClasses {
+		if !classes[class] {
+			return fmt.Errorf("no %s character", class)
+		}
+	}
+	return nil
+}
+
+// Validate reports why the portal would reject candidate as the new password
+// for username, whose password is previous, or nil if it would not.
+func (p PasswordPolicy) Validate(candidate, username, previous string) error {
+	err := p.conforms(candidate)
+	if err != nil {
+		return err
+	}
+	if username != "" && strings.Contains(strings.ToLower(candidate), strings.ToLower(username)) {
+		return fmt.Errorf("contains the username")
+	}
+	if p.PreviousOverlap > 0 {
+		for i := 0; i+p.PreviousOverlap <= len(previous); i++ {
+			if strings.Contains(candidate, previous[i:i+p.PreviousOverlap]) {
+				return fmt.Errorf("shares %d consecutive characters with the previous password", p.PreviousOverlap)
+			}
+		}
+	}
+	return nil
+}
+
+// Generate a new password for username that the validator accepts
+func (p PasswordPolicy) newPassword(username, previous string) (string, error) {
+	for attempt := 0; attempt < maxGenerateAttempts; attempt++ {
+		password, err := p.Generate()
+		if err != nil {
+			return "", err
+		}
+		if p.Validate(password, username, previous) == nil {
+			registerSecret(password)
+			return password, nil
+		}
+	}
+	return "", fmt.Errorf("failed to generate a password for user %s that the policy accepts", username)
+}
+
+// Apply a user's password length and excluded characters to the policy
+func (p PasswordPolicy) withOverrides(length int, exclude string) PasswordPolicy {
+	if length != 0 {
+		p.MinLength = length
+		p.MaxLength = length
+	}
+	p.Exclude += exclude
+	return p
+}
+
+func removeChars(s, chars string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(chars, r) {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// randomPolicy is a PasswordPolicy that testing/quick can generate.
+type randomPolicy struct {
+	PasswordPolicy
+}
+
+func (randomPolicy) Generate(r *rand.Rand, size int) reflect.Value {
+	pick := func(s string) string {
+		b := []byte{}
+		for i := 0; i < len(s); i++ {
+			if r.Intn(3) == 0 {
+				b = append(b, s[i])
+			}
+		}
+		return string(b)
+	}
+
+	p := PasswordPolicy{
+		MinLength:   minPasswordLength + r.Intn(20),
+		Specials:    pick(specials),
+		Exclude:     pick(digits + uppers + lowers + specials),
+		NoRepeats:   r.Intn(2) == 0,
+		MaxClassRun: r.Intn(5),
+	}
+	p.MaxLength = p.MinLength + r.Intn(10)
+	if n := r.Intn(4); n < len(p.Exclude) {
+		p.Exclude = p.Exclude[:n]
+	}
+	for _, class := range charClasses {
+		if r.Intn(4) != 0 {
+			p.RequiredClasses = append(p.RequiredClasses, class)
+		}
+	}
+	return reflect.ValueOf(randomPolicy{p})
+}
+
+func TestGeneratedPasswordsSatisfyPolicy(t *testing.T) {
+	feasible := 0
+	property := func(rp randomPolicy) bool {
+		p := rp.PasswordPolicy
+		if p.check() != nil {
+			return true
+		}
+		feasible++
+		password, err := p.Generate()
+		if err != nil {
+			t.Logf("Error generating a password for %+v: %s", p, err)
+			return false
+		}
+		err = p.Validate(password, "", "")
+		if err != nil {
+			t.Logf("Password %q does not satisfy %+v: %s", password, p, err)
+			return false
+		}
+		return true
+	}
+	err := quick.Check(property, &quick.Config{MaxCount: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feasible < 1000 {
+		t.Fatalf("Only %d of the random policies can be satisfied", feasible)
+	}
+
+	for name, p := range passwordPolicies {
+		property := func(username, previous string) bool {
+			password, err := p.newPassword(username, previous)
+			if err != nil {
+				t.Logf("Error generating a password with policy %s: %s", name, err)
+				return false
+			}
+			err = p.Validate(password, username, previous)
+			if err != nil {
+				t.Logf("Password %q does not satisfy policy %s: %s", password, name, err)
+				return false
+			}
+			return true
+		}
+		err = quick.Check(property, &quick.Config{MaxCount: 500})
+		if err != nil {
+			t.Fatalf("Policy %s: %s", name, err)
+		}
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	p := passwordPolicies["strict"]
+	for _, tc := range []struct {
+		candidate string
+		username  string
+		previous  string
+		problem   string
+	}{
+		{"aB3$cD4%eF5^gH6*", "ben", "", ""},
+		{"aB3$cD4%eF5^gH6", "ben", "", "length 15 is not between 16 and 20"},
+		{"aB3$cD4%eF5^gH6*a", "ben", "", `character 'a' is repeated`},
+		{"aB3$cD4%eF5^gH6*O", "ben", "", `character 'O' is not allowed`},
+		{"aB3$cD4%eF5^gH6*?", "ben", "", `character '?' is not allowed`},
+		{"aBCDE3$f4%g5^h6*", "ben", "", "more than 3 upper characters in a row"},
+		{"xBeN3$cD4%aF5^gH6*", "ben", "", "contains the username"},
+		{"aB3$cD4%eF5^gH6*", "ben", "zzzD4%eqq", "shares 3 consecutive characters with the previous password"},
+		{"aB3$cD4%eF5^gH6*", "ben", "zzzD4qq", ""},
+		{"aBcDeFgHjKmNpQrS", "ben", "", "no digit character"},
+	} {
+		err := p.Validate(tc.candidate, tc.username, tc.previous)
+		if tc.problem == "" && err != nil {
+			t.Fatalf("Expected %q to be valid; got %s", tc.candidate, err)
+		} else if tc.problem != "" && (err == nil || !strings.Contains(err.Error(), tc.problem)) {
+			t.Fatalf("Expected %q to be rejected with %q; got %v", tc.candidate, tc.problem, err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	redacted = "[REDACTED]"
+
+	// most characters of a response body echoed in an error
+	maxEchoedBody = 300
+)
+
+// token-like values that are redacted wherever they appear, whether or not
+// they were registered
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// JSON fields such as {"sessionToken":"..."} and {"newPassword":"..."}
+	{regexp.MustCompile(`(?i)("(?:[\w-]*token|[\w-]*password)"\s*:\s*")[^"]*"`), "${1}" + redacted + `"`},
+	// query parameters and cookies such as token=..., IDMSession=... and PORTAL-XSRF-TOKEN=...
+	{regexp.MustCompile(`(?i)\b([\w-]*(?:token|session|xsrf|password|_st|sid)[\w-]*=)[^\s;&,"\]]+`), "${1}" + redacted},
+	// headers such as Cookie: ... and portal-xsrf-token: ...
+	{regexp.MustCompile(`(?i)\b((?:cookie|set-cookie|portal-xsrf-token)\s*:\s*)[^\r\n]+`), "${1}" + redacted},
+}
+
+// secretSet holds the passwords and other values that must never be logged.
+type secretSet struct {
+	mu      sync.RWMutex
+	values  map[string]bool
+	ordered []string // longest first, so that no secret is left partly visible
+}
+
+var secrets = &secretSet{values: map[string]bool{}}
+
+// Register values to be redacted from log output and portal errors
+func registerSecret(values ...string) {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	for _, v := range values {
+		if v == "" || secrets.values[v] {
+			continue
+		}
+		secrets.values[v] = true
+		secrets.ordered = append(secrets.ordered, v)
+	}
+	sort.SliceStable(secrets.ordered, func(i, j int) bool {
+		return len(secrets.ordered[i]) > len(secrets.ordered[j])
+	})
+}
+
+// Replace registered secrets and token-like values in s
+func redact(s string) string {
+	secrets.mu.RLock()
+	for _, v := range secrets.ordered {
+		if strings.Contains(s, v) {
+			s = replaceSecret(s, v, redacted)
+		}
+	}
+	secrets.mu.RUnlock()
+
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// Replace the occurrences of v in s. A secret of only letters, digits and
+// underscores shorter than a generated password is replaced only where it is
+// not part of a longer word, so that "abc" leaves words such as "abcde"
+// visible; any other secret is replaced wherever it appears.
+func replaceSecret(s, v, repl string) string {
+	if len(v) >= minPasswordLength || !isWord(v) {
+		return strings.ReplaceAll(s, v, repl)
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, v)
+		if i < 0 {
+			break
+		}
+		j := i + len(v)
+		if i > 0 && isWordByte(s[i-1]) && isWordByte(v[0]) ||
+			j < len(s) && isWordByte(s[j]) && isWordByte(v[len(v)-1]) {
+			b.WriteString(s[:i+1])
+			s = s[i+1:]
+			continue
+		}
+		b.WriteString(s[:i])
+		b.WriteString(repl)
+		s = s[j:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+func isWord(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isWordByte(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c >= 0x80
+}
+
+// Make a response body fit to echo in an error: redacted, on one line and
+// no longer than maxEchoedBody
+func sanitizeBody(body string) string {
+	body = strings.Join(strings.Fields(redact(body)), " ")
+	if len(body) > maxEchoedBody {
+		body = body[:maxEchoedBody] + "... (truncated)"
+	}
+	return body
+}
+
+// redactingWriter redacts everything written through it.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	_, err := rw.w.Write([]byte(redact(string(p))))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Send the standard logger's output through the redactor to w
+func redactLogs(w io.Writer) {
+	log.SetOutput(&redactingWriter{w: w})
+}
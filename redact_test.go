@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	registerSecret("Xy7$kP2!mQ9#", "abc", "!pw", "Kq3Zr8Wm")
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"user bob password Xy7$kP2!mQ9# rejected", "user bob password [REDACTED] rejected"},
+		{`{"sessionToken":"20111h0ZlxjyoB","status":"SUCCESS"}`, `{"sessionToken":"[REDACTED]","status":"SUCCESS"}`},
+		{`{"oldPassword":"old","newPassword":"new"}`, `{"oldPassword":"[REDACTED]","newPassword":"[REDACTED]"}`},
+		{"GET /login/sessionCookieRedirect?token=20111h0Zl&redirectUrl=%2Fhome", "GET /login/sessionCookieRedirect?token=[REDACTED]&redirectUrl=%2Fhome"},
+		{"cookies [IDMSession=1f2e PORTAL-XSRF-TOKEN=9a8b]", "cookies [IDMSession=[REDACTED] PORTAL-XSRF-TOKEN=[REDACTED]]"},
+		{"Set-Cookie: MRHSession=abcd; Path=/", "Set-Cookie: [REDACTED]"},
+		// short secrets are redacted only as whole words
+		{"abc", "[REDACTED]"},
+		{"user bob password abc rejected; abcde and xabc are not secrets", "user bob password [REDACTED] rejected; abcde and xabc are not secrets"},
+		{"old password:abc.", "old password:[REDACTED]."},
+		// other secrets are redacted wherever they appear
+		{"ab!pwcd", "ab[REDACTED]cd"},
+		{"idKq3Zr8Wm2 and pwXy7$kP2!mQ9#z", "id[REDACTED]2 and pw[REDACTED]z"},
+		{"Error changing password: got HTTP status code 400", "Error changing password: got HTTP status code 400"},
+	} {
+		if got := redact(tc.in); got != tc.out {
+			t.Fatalf("redact(%q):\nexpected %q\ngot      %q", tc.in, tc.out, got)
+		}
+	}
+
+	body := sanitizeBody(strings.Repeat("<p>Service\n Unavailable</p> ", 50))
+	if len(body) > maxEchoedBody+len("... (truncated)") || strings.Contains(body, "\n") {
+		t.Fatalf("Expected a short body on one line; got %q", body)
+	}
+}
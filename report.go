@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/xuri/excelize/v2"
+)
+
+const defaultReportPrefix = "reports/"
+
+// actions, for the action of a report record
+const (
+	actionRotated   = "rotated"
+	actionSkipped   = "skipped" // not due for rotation
+	actionAdded     = "added"   // added to the automated sheet, then rotated
+	actionDeleted   = "deleted" // removed from the automated sheet
+	actionFailed    = "failed"
+	actionRecovered = "recovered" // the portal's password differed from the sheet's
+
+	actionHeartbeat       = "heartbeat"        // not due for rotation, so only logged in and out
+	actionHeartbeatFailed = "heartbeat-failed" // the heartbeat login failed
+
+	actionVerified = "verified" // logged in by verify, which sets the status
+
+	actionQuarantined = "quarantined" // not logged in until the Quarantined cell is cleared
+)
+
+// RunReport is what a run did to each user. It holds no passwords.
+type RunReport struct {
+	RunID    string         `json:"runId"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Error    string         `json:"error,omitempty"` // why the run stopped early
+	Records  []ReportRecord `json:"records"`
+}
+
+// ReportRecord is what a run did to one user in one environment. Timestamps
+// are as written in the automated sheet.
+type ReportRecord struct {
+	Environment   Environment `json:"environment"`
+	User          string      `json:"user"`
+	Action        string      `json:"action"`
+	ErrorClass    string      `json:"errorClass,omitempty"`
+	Status        string      `json:"status,omitempty"`      // the result of a verification
+	Quarantined   string      `json:"quarantined,omitempty"` // why the user's logins are stopped
+	OldTimestamp  string      `json:"oldTimestamp,omitempty"`
+	NewTimestamp  string      `json:"newTimestamp,omitempty"`
+	TestingSheets []string    `json:"testingSheets"`
+}
+
+var reportCSVHeader = []string{"environment", "user", "action", "error_class", "old_timestamp", "new_timestamp", "testing_sheets", "status", "quarantined"}
+
+func newRunReport(runID string, started time.Time) *RunReport {
+	return &RunReport{RunID: runID, Started: started, Records: []ReportRecord{}}
+}
+
+func (r *RunReport) find(env Environment, user string) *ReportRecord {
+	for i := range r.Records {
+		if r.Records[i].Environment == env && r.Records[i].User == user {
+			return &r.Records[i]
+		}
+	}
+	return nil
+}
+
+// Add a record, merging it with the user's earlier record. Rotating or
+// skipping a user only replaces a skipped action, so that a user added and
+// then rotated stays added.
+func (r *RunReport) add(rec ReportRecord) {
+	existing := r.find(rec.Environment, rec.User)
+	if existing == nil {
+		if rec.TestingSheets == nil {
+			rec.TestingSheets = []string{}
+		}
+		r.Records = append(r.Records, rec)
+		return
+	}
+
+	if (rec.Action != actionRotated && rec.Action != actionSkipped) || existing.Action == actionSkipped {
+		existing.Action = rec.Action
+	}
+	if existing.OldTimestamp == "" {
+		existing.OldTimestamp = rec.OldTimestamp
+	}
+	if rec.NewTimestamp != "" {
+		existing.NewTimestamp = rec.NewTimestamp
+	}
+	if rec.ErrorClass != "" {
+		existing.ErrorClass = rec.ErrorClass
+	}
+	if rec.Status != "" {
+		existing.Status = rec.Status
+	}
+	if rec.Quarantined != "" {
+		existing.Quarantined = rec.Quarantined
+	}
+}
+
+// Note that a testing sheet was given the user's password
+func (r *RunReport) testingSheetUpdated(env Environment, user, sheet string) {
+	rec := r.find(env, user)
+	if rec == nil {
+		r.add(ReportRecord{Environment: env, User: user, Action: actionSkipped})
+		rec = r.find(env, user)
+	}
+	if !contains(rec.TestingSheets, sheet) {
+		rec.TestingSheets = append(rec.TestingSheets, sheet)
+	}
+}
+
+// Get the users that syncing the automated sheet to the portal sheet adds
+// and deletes
+func syncChanges(f *excelize.File, input *Input, env Environment) (added, deleted map[string]bool, err error) {
+	macFinUsers, err := getMACFinUsers(f, input, env)
+	if err != nil {
+		return nil, nil, err
+	}
+	managedUsers, err := getManagedUsers(f, input, env)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	added = map[string]bool{}
+	for user := range macFinUsers {
+		if _, ok := managedUsers[user]; !ok {
+			added[user] = true
+		}
+	}
+	deleted = map[string]bool{}
+	for user := range managedUsers {
+		if _, ok := macFinUsers[user]; !ok {
+			deleted[user] = true
+		}
+	}
+	return added, deleted, nil
+}
+
+// Record the users that syncing the automated sheet will add and delete. It
+// must be called before syncPasswordManagerUsersToMACFinUsers.
+func (r *RunReport) recordSync(f *excelize.File, input *Input, env Environment) error {
+	added, deleted, err := syncChanges(f, input, env)
+	if err != nil {
+		return err
+	}
+	managedUsers, err := getManagedUsers(f, input, env)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range sortedUsers(added) {
+		r.add(ReportRecord{Environment: env, User: user, Action: actionAdded})
+	}
+	automatedSheet := input.SheetGroups[env].AutomatedSheetName
+	colTimestamp := input.AutomatedSheetColNameToIndex[ColTimestamp]
+	for _, user := range sortedUsers(deleted) {
+		ts, err := getCellValue(f, automatedSheet, colTimestamp, managedUsers[user].Row)
+		if err != nil {
+			return fmt.Errorf("failed to read timestamp of deleted user %s from sheet %s: %s", user, automatedSheet, err)
+		}
+		r.add(ReportRecord{Environment: env, User: user, Action: actionDeleted, OldTimestamp: ts})
+	}
+	return nil
+}
+
+// Mark the report finished, with the error that stopped the run if any
+func (r *RunReport) finish(err error, finished time.Time) {
+	r.Finished = finished
+	if err != nil {
+		r.Error = redact(err.Error())
+	}
+}
+
+func (r *RunReport) csv() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	err := w.Write(reportCSVHeader)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range r.Records {
+		err = w.Write([]string{
+			rec.Environment.String(),
+			rec.User,
+			rec.Action,
+			rec.ErrorClass,
+			rec.OldTimestamp,
+			rec.NewTimestamp,
+			strings.Join(rec.TestingSheets, ";"),
+			rec.Status,
+			rec.Quarantined,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// The key of the report, without an extension. Keys sort by start time.
+func (r *RunReport) key(prefix string) string {
+	return prefix + r.Started.UTC().Format("20060102T150405Z") + "-" + r.RunID
+}
+
+// Write the report as JSON and CSV under the report prefix in the workbook's
+// bucket
+func (r *RunReport) upload(input *Input, client S3ClientAPI) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error marshalling run report: %s", err)
+	}
+	c, err := r.csv()
+	if err != nil {
+		return fmt.Errorf("Error writing run report as CSV: %s", err)
+	}
+
+	key := r.key(input.ReportPrefix)
+	for _, obj := range []struct {
+		key, contentType string
+		body             []byte
+	}{
+		{key + ".json", "application/json", b},
+		{key + ".csv", "text/csv", c},
+	} {
+		_, err = client.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket:      aws.String(input.Bucket),
+			Key:         aws.String(obj.key),
+			Body:        bytes.NewReader(obj.body),
+			ContentType: aws.String(obj.contentType),
+		})
+		if err != nil {
+			return fmt.Errorf("Error uploading run report to %s: %s", s3URI(input.Bucket, obj.key), err)
+		}
+	}
+	logger.Info("uploaded run report", Fields{"file": s3URI(input.Bucket, key+".json"), "records": len(r.Records)})
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunReport(t *testing.T) {
+	started := time.Date(2026, 3, 2, 4, 5, 6, 0, time.UTC)
+	r := newRunReport("abc", started)
+
+	// added, then rotated: stays added
+	r.add(ReportRecord{Environment: dev, User: "ann", Action: actionAdded})
+	r.add(ReportRecord{Environment: dev, User: "ann", Action: actionRotated, OldTimestamp: "Rotate Now", NewTimestamp: "Mon Mar  2 04:05:07 UTC 2026"})
+	// recovered from the journal, then not due: stays recovered
+	r.add(ReportRecord{Environment: dev, User: "ben", Action: actionRecovered, OldTimestamp: "Sun Feb  1 00:00:00 UTC 2026", NewTimestamp: "Mon Mar  2 04:05:07 UTC 2026"})
+	r.add(ReportRecord{Environment: dev, User: "ben", Action: actionSkipped, OldTimestamp: "Mon Mar  2 04:05:07 UTC 2026"})
+	// added, then failed
+	r.add(ReportRecord{Environment: val, User: "ann", Action: actionAdded})
+	r.add(ReportRecord{Environment: val, User: "ann", Action: actionFailed, ErrorClass: "account locked"})
+	r.testingSheetUpdated(dev, "ann", "DEV")
+	r.testingSheetUpdated(dev, "ann", "TEST")
+	r.testingSheetUpdated(dev, "ann", "DEV")
+	r.finish(errors.New("stopped"), started.Add(time.Minute))
+
+	expected := []ReportRecord{
+		{Environment: dev, User: "ann", Action: actionAdded, OldTimestamp: "Rotate Now", NewTimestamp: "Mon Mar  2 04:05:07 UTC 2026", TestingSheets: []string{"DEV", "TEST"}},
+		{Environment: dev, User: "ben", Action: actionRecovered, OldTimestamp: "Sun Feb  1 00:00:00 UTC 2026", NewTimestamp: "Mon Mar  2 04:05:07 UTC 2026", TestingSheets: []string{}},
+		{Environment: val, User: "ann", Action: actionFailed, ErrorClass: "account locked", TestingSheets: []string{}},
+	}
+	if len(r.Records) != len(expected) {
+		t.Fatalf("Expected %d records; got %+v", len(expected), r.Records)
+	}
+	for i, rec := range r.Records {
+		if rec.Environment != expected[i].Environment || rec.User != expected[i].User || rec.Action != expected[i].Action ||
+			rec.ErrorClass != expected[i].ErrorClass || rec.OldTimestamp != expected[i].OldTimestamp ||
+			rec.NewTimestamp != expected[i].NewTimestamp || strings.Join(rec.TestingSheets, ",") != strings.Join(expected[i].TestingSheets, ",") {
+			t.Fatalf("Record %d:\nexpected %+v\ngot      %+v", i, expected[i], rec)
+		}
+	}
+
+	if key := r.key("reports/"); key != "reports/20260302T040506Z-abc" {
+		t.Fatalf("Unexpected report key %s", key)
+	}
+	b, err := r.csv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if lines[0] != "environment,user,action,error_class,old_timestamp,new_timestamp,testing_sheets,status,quarantined" ||
+		lines[1] != "dev,ann,added,,Rotate Now,Mon Mar  2 04:05:07 UTC 2026,DEV;TEST,," || len(lines) != 4 {
+		t.Fatalf("Unexpected CSV:\n%s", b)
+	}
+}
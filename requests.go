@@ -2,13 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 const (
@@ -18,6 +19,8 @@ const (
 	oauth2RedirectUrlPath = "/myportal/"
 	changePasswordPath    = "/myportal/viewprofile/myprofile/credential"
 	logoutPath            = "/myportal/logout"
+	expiredPasswordPath   = "/api/v1/authn/credentials/change_password"
+	factorsPath           = "/api/v1/authn/factors/" // followed by the factor ID and /verify
 	sessionToken          = "sessionToken"
 )
 
@@ -34,6 +37,42 @@ type changePassword struct {
 
 type userData struct {
 	SessionToken string `json:"sessionToken"`
+	Status       string `json:"status"`     // why there is no session token, e.g. LOCKED_OUT
+	StateToken   string `json:"stateToken"` // continues a login that needs another step, such as PASSWORD_EXPIRED
+	Embedded     struct {
+		Factors []factor `json:"factors"` // the user's enrolled factors if the status is MFA_REQUIRED
+	} `json:"_embedded"`
+}
+
+type factor struct {
+	ID         string `json:"id"`
+	FactorType string `json:"factorType"`
+}
+
+type verifyFactor struct {
+	StateToken string `json:"stateToken"`
+	PassCode   string `json:"passCode"`
+}
+
+type changeExpiredPassword struct {
+	StateToken  string `json:"stateToken"`
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+// ExpiredPasswordError is a login refused because the user's password has
+// expired. The password can still be changed with the state token.
+type ExpiredPasswordError struct {
+	*PortalError
+	StateToken string
+}
+
+// IDM (Okta) authentication statuses of a login that did not get a session
+var loginStatusKinds = map[string]error{
+	"LOCKED_OUT":       ErrAccountLocked,
+	"PASSWORD_EXPIRED": ErrPasswordExpired,
+	"MFA_REQUIRED":     ErrMFARequired,
+	"MFA_ENROLL":       ErrMFARequired,
 }
 
 func getCookie(c *http.Client, urlstr, cookieName string) (*http.Cookie, error) {
@@ -50,15 +89,38 @@ func getCookie(c *http.Client, urlstr, cookieName string) (*http.Cookie, error)
 	return nil, fmt.Errorf("failed to find %s in cookie jar", cookieName)
 }
 
-func sendRequest(client *http.Client, method, urlstr string, customHeaders map[string][]string, body []byte, userData interface{}) error {
+// Send a request, retrying transient failures with backoff. Each attempt is
+// limited to requestTimeout. A failure is returned as a *PortalError unless
+// the run is cancelled.
+func sendRequest(ctx context.Context, client *http.Client, method, urlstr string, customHeaders map[string][]string, body []byte, userData interface{}) error {
+	if method != http.MethodGet && method != http.MethodPost {
+		return errors.New("unsupported method type")
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = sendRequestOnce(ctx, client, method, urlstr, customHeaders, body, userData)
+		if err == nil || attempt >= maxRequestAttempts || !retryable(method, err) {
+			return err
+		}
+		delay := retryDelay(attempt)
+		logger.Info("retrying portal request", Fields{"method": method, "url": urlWithoutQuery(urlstr), "attempt": attempt, "delay_ms": delay.Milliseconds(), "error": err})
+		if serr := sleep(ctx, delay); serr != nil {
+			return err
+		}
+	}
+}
+
+func sendRequestOnce(ctx context.Context, client *http.Client, method, urlstr string, customHeaders map[string][]string, body []byte, userData interface{}) error {
+	reqCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
 	var req *http.Request
 	var err error
 	if method == http.MethodGet {
-		req, err = http.NewRequest(http.MethodGet, urlstr, nil)
-	} else if method == http.MethodPost {
-		req, err = http.NewRequest(http.MethodPost, urlstr, bytes.NewReader(body))
+		req, err = http.NewRequestWithContext(reqCtx, http.MethodGet, urlstr, nil)
 	} else {
-		return errors.New("unsupported method type")
+		req, err = http.NewRequestWithContext(reqCtx, http.MethodPost, urlstr, bytes.NewReader(body))
 	}
 
 	if err != nil {
@@ -77,7 +139,7 @@ func sendRequest(client *http.Client, method, urlstr string, customHeaders map[s
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("Error sending request: %s", err)
+		return classifyTransportError(ctx, err)
 	}
 
 	defer resp.Body.Close()
@@ -85,24 +147,25 @@ func sendRequest(client *http.Client, method, urlstr string, customHeaders map[s
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		b, err := io.ReadAll(resp.Body)
 		if err != nil {
-			log.Printf("failed to read response body: %s", err)
+			logger.Info("failed to read response body", Fields{"url": urlWithoutQuery(urlstr), "error": err})
 		}
-		return fmt.Errorf("got HTTP status code %d with body: \n%s", resp.StatusCode, string(b))
+		return classifyResponse(resp.StatusCode, string(b))
 	}
 
 	if userData != nil {
 		err = json.NewDecoder(resp.Body).Decode(userData)
 		if err != nil {
-			return fmt.Errorf("Error decoding response body: %s", err)
+			return classifyTransportError(ctx, fmt.Errorf("Error decoding response body: %s", err))
 		}
 	}
 
 	return nil
 }
 
-func loginStep(client *http.Client, portal *Portal, username, password string) error {
+// Log in as a user, answering an MFA challenge with a TOTP code if the user
+// has a TOTP secret
+func loginStep(ctx context.Context, client *http.Client, portal *Portal, username, password, totpSecret string) error {
 	hostname := portal.Hostname
-	idmHostname := portal.IDMHostname
 
 	// GET loginClearPath adds 4 cookies to the jar:
 	// portal.cms.gov: dc, DC, akavpau_default, IDMSession
@@ -115,14 +178,15 @@ func loginStep(client *http.Client, portal *Portal, username, password string) e
 		"referer":        {portal.Scheme + hostname},
 	}
 
-	err := sendRequest(client, http.MethodGet, portal.Scheme+hostname+loginClearPath, headers, nil, nil)
+	err := sendRequest(ctx, client, http.MethodGet, portal.Scheme+hostname+loginClearPath, headers, nil, nil)
 	if err != nil {
-		return fmt.Errorf("Error sending request: %s", err)
+		return fmt.Errorf("Error sending request: %w", err)
 	}
 
 	// POST loginSubmitPath returns a sessionToken in the response body
 	// sessionToken is a query parameter in the GET to oauth2RedirectUrlPath
 	// Returns no new cookies.
+	registerSecret(password)
 	creds := loginDetails{
 		Username: username,
 		Password: password,
@@ -144,21 +208,47 @@ func loginStep(client *http.Client, portal *Portal, username, password string) e
 	}
 
 	userData := &userData{}
-	err = sendRequest(client, http.MethodPost, portal.Scheme+hostname+loginSubmitPath, headers, body, userData)
+	err = sendRequest(ctx, client, http.MethodPost, portal.Scheme+hostname+loginSubmitPath, headers, body, userData)
 	if err != nil {
-		return fmt.Errorf("Error sending request: %s", err)
+		return fmt.Errorf("Error sending request: %w", err)
+	}
+
+	if userData.SessionToken == "" && userData.Status == "MFA_REQUIRED" && totpSecret != "" {
+		for _, f := range userData.Embedded.Factors {
+			if f.FactorType == totpFactorType {
+				return verifyTOTPStep(ctx, client, portal, userData.StateToken, f.ID, totpSecret)
+			}
+		}
 	}
 
 	if userData.SessionToken == "" {
-		return fmt.Errorf("Error no session token: %s", errors.New("missing sessionToken in response body; user might be locked out of portal"))
+		kind, ok := loginStatusKinds[userData.Status]
+		if !ok {
+			kind = ErrUnexpected
+		}
+		portalErr := &PortalError{Kind: kind, StatusCode: http.StatusOK, Code: userData.Status,
+			Body: fmt.Sprintf("missing sessionToken in response body with status %q; user might be locked out of portal", userData.Status)}
+		if kind == ErrPasswordExpired && userData.StateToken != "" {
+			registerSecret(userData.StateToken)
+			return fmt.Errorf("Error no session token: %w", &ExpiredPasswordError{PortalError: portalErr, StateToken: userData.StateToken})
+		}
+		return fmt.Errorf("Error no session token: %w", portalErr)
 	}
 
+	return startSession(ctx, client, portal, userData.SessionToken)
+}
+
+// Exchange a session token for portal session cookies
+func startSession(ctx context.Context, client *http.Client, portal *Portal, token string) error {
+	hostname := portal.Hostname
+	idmHostname := portal.IDMHostname
+
 	// Start the oauth2 process between client and server
 	// GET to oauth2RedirectUrlPath
 	// Response returns 12 cookies: 4 existing cookies and 8 new ones
 	// New cookies for portal.cms.gov: F5_ST, LastMRH_Session, MRHSession, PORTAL-XSRF-TOKEN
 	// New cookies for idm.cms.gov: t, DT, JSESSIONID, sid
-	token := userData.SessionToken
+	registerSecret(token)
 	params := url.Values{}
 	params.Add("token", token)
 	params.Add("redirectUrl", fmt.Sprintf("%s%s%s", portal.Scheme, hostname, oauth2RedirectUrlPath))
@@ -167,7 +257,7 @@ func loginStep(client *http.Client, portal *Portal, username, password string) e
 		return fmt.Errorf("Error logging in: %s", err)
 	}
 	urlObj.RawQuery = params.Encode()
-	headers = map[string][]string{
+	headers := map[string][]string{
 		"upgrade-insecure-requests": {"1"},
 		"sec-fetch-site":            {"same-site"},
 		"sec-fetch-mode":            {"navigate"},
@@ -176,15 +266,102 @@ func loginStep(client *http.Client, portal *Portal, username, password string) e
 		"referer":                   {portal.Scheme + hostname},
 		"origin":                    {hostname},
 	}
-	err = sendRequest(client, http.MethodGet, urlObj.String(), headers, nil, nil)
+	err = sendRequest(ctx, client, http.MethodGet, urlObj.String(), headers, nil, nil)
 	if err != nil {
-		return fmt.Errorf("Error sending request: %s", err)
+		return fmt.Errorf("Error sending request: %w", err)
 	}
 
 	return nil
 }
 
-func changePasswordStep(client *http.Client, portal *Portal, oldPassword, newPassword string) error {
+// Answer a login's MFA challenge with the TOTP factor and start the session
+func verifyTOTPStep(ctx context.Context, client *http.Client, portal *Portal, stateToken, factorID, totpSecret string) error {
+	idmHostname := portal.IDMHostname
+
+	headers := map[string][]string{
+		"sec-fetch-site": {"same-site"},
+		"sec-fetch-mode": {"cors"},
+		"sec-fetch-dest": {"empty"},
+		"referer":        {portal.Scheme + portal.Hostname + "/portal/"},
+		"origin":         {portal.Scheme + portal.Hostname},
+	}
+
+	// POST to the factor's verify path on IDM with the state token of the
+	// login and the current code
+	// Returns a sessionToken like a login if the code is accepted
+	userData := &userData{}
+	for attempt := 1; ; attempt++ {
+		passCode, err := nextTOTPCode(totpSecret)
+		if err != nil {
+			return fmt.Errorf("Error generating TOTP code: %w", err)
+		}
+		body, err := json.Marshal(verifyFactor{StateToken: stateToken, PassCode: passCode})
+		if err != nil {
+			return fmt.Errorf("Error marshalling factor: %s", err)
+		}
+
+		err = sendRequest(ctx, client, http.MethodPost, portal.Scheme+idmHostname+factorsPath+url.PathEscape(factorID)+"/verify", headers, body, userData)
+		// a code IDM finds invalid (E0000068), unlike one it has seen
+		// (E0000082), may be from a clock a step behind IDM's, so the next
+		// step's code is sent once
+		var portalErr *PortalError
+		if attempt == 1 && errors.As(err, &portalErr) && portalErr.Code == "E0000068" {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Error verifying TOTP factor: %w", err)
+		}
+		break
+	}
+	if userData.SessionToken == "" {
+		return fmt.Errorf("Error no session token: %w", &PortalError{Kind: ErrMFARequired, StatusCode: http.StatusOK,
+			Body: fmt.Sprintf("missing sessionToken in response body with status %q after verifying TOTP factor", userData.Status)})
+	}
+
+	return startSession(ctx, client, portal, userData.SessionToken)
+}
+
+// Change an expired password, which IDM requires before it starts a session,
+// and start the session
+func changeExpiredPasswordStep(ctx context.Context, client *http.Client, portal *Portal, stateToken, oldPassword, newPassword string) error {
+	idmHostname := portal.IDMHostname
+
+	// POST to expiredPasswordPath on IDM with the state token of the login
+	// Returns a sessionToken like a login if the new password is accepted
+	registerSecret(oldPassword, newPassword)
+	creds := changeExpiredPassword{
+		StateToken:  stateToken,
+		OldPassword: oldPassword,
+		NewPassword: newPassword,
+	}
+
+	body, err := json.Marshal(creds)
+	if err != nil {
+		return fmt.Errorf("Error marshalling creds: %s", err)
+	}
+
+	headers := map[string][]string{
+		"sec-fetch-site": {"same-site"},
+		"sec-fetch-mode": {"cors"},
+		"sec-fetch-dest": {"empty"},
+		"referer":        {portal.Scheme + portal.Hostname + "/portal/"},
+		"origin":         {portal.Scheme + portal.Hostname},
+	}
+
+	userData := &userData{}
+	err = sendRequest(ctx, client, http.MethodPost, portal.Scheme+idmHostname+expiredPasswordPath, headers, body, userData)
+	if err != nil {
+		return fmt.Errorf("Error sending request: %w", err)
+	}
+	if userData.SessionToken == "" {
+		return fmt.Errorf("Error no session token: %w", &PortalError{Kind: ErrUnexpected, StatusCode: http.StatusOK,
+			Body: fmt.Sprintf("missing sessionToken in response body with status %q after changing expired password", userData.Status)})
+	}
+
+	return startSession(ctx, client, portal, userData.SessionToken)
+}
+
+func changePasswordStep(ctx context.Context, client *http.Client, portal *Portal, oldPassword, newPassword string) error {
 	hostname := portal.Hostname
 
 	// POST to changePasswordPath
@@ -192,6 +369,7 @@ func changePasswordStep(client *http.Client, portal *Portal, oldPassword, newPas
 	// Request body contains credentials
 	// If request succeeds, then password is reset
 	// No new cookies added.
+	registerSecret(oldPassword, newPassword)
 	creds := changePassword{
 		OldPassword: oldPassword,
 		NewPassword: newPassword,
@@ -206,6 +384,7 @@ func changePasswordStep(client *http.Client, portal *Portal, oldPassword, newPas
 	if err != nil {
 		return fmt.Errorf("Error getting cookie from jar: %s", err)
 	}
+	registerSecret(portalXsrfTokenCookie.Value)
 	headers := map[string][]string{
 		"sec-fetch-site":    {"same-origin"},
 		"sec-fetch-mode":    {"cors"},
@@ -217,37 +396,114 @@ func changePasswordStep(client *http.Client, portal *Portal, oldPassword, newPas
 		"portal-xsrf-token": {portalXsrfTokenCookie.Value},
 	}
 
-	err = sendRequest(client, http.MethodPost, portal.Scheme+hostname+changePasswordPath, headers, body, nil)
+	err = sendRequest(ctx, client, http.MethodPost, portal.Scheme+hostname+changePasswordPath, headers, body, nil)
+	var portalErr *PortalError
+	if errors.As(err, &portalErr) && portalErr.Kind == ErrUnexpected && portalErr.StatusCode == http.StatusBadRequest {
+		// IDM rejects a new password it does not accept with 400
+		portalErr.Kind = ErrPasswordPolicyRejected
+	}
 	if err != nil {
-		return fmt.Errorf("Error sending request: %s", err)
+		return fmt.Errorf("Error sending request: %w", err)
 	}
 	return nil
 }
 
-func changeUserPassword(client *http.Client, portal *Portal, username, oldPassword, newPassword string) error {
-	err := loginStep(client, portal, username, oldPassword)
-	if err != nil {
-		return fmt.Errorf("Error logging in: %s", err)
+// LoginError is returned by changeUserPassword when the user could not log
+// in, so the password was not changed. Err says why; ErrInvalidCredentials
+// means the old password is wrong.
+type LoginError struct {
+	Err error
+}
+
+func (e *LoginError) Error() string {
+	return fmt.Sprintf("Error logging in: %s", e.Err)
+}
+
+func (e *LoginError) Unwrap() error {
+	return e.Err
+}
+
+func changeUserPassword(ctx context.Context, client *http.Client, portal *Portal, username, oldPassword, newPassword, totpSecret string) error {
+	stepLog := logger.With(Fields{"env": portal.env, "user": username, "portal": portal.Hostname})
+	err := timedStep(stepLog, stepLogin, func() error {
+		return loginStep(ctx, client, portal, username, oldPassword, totpSecret)
+	})
+
+	// an expired password is changed as part of logging in
+	var expired *ExpiredPasswordError
+	if errors.As(err, &expired) {
+		err = timedStep(stepLog, stepChangeExpired, func() error {
+			return changeExpiredPasswordStep(ctx, client, portal, expired.StateToken, oldPassword, newPassword)
+		})
+		if err != nil {
+			logoutStep(ctx, client, portal)
+			return fmt.Errorf("Error changing expired password: %w", err)
+		}
+		stepLog.Info("changed expired password", nil)
+	} else if err != nil {
+		// end the partial session so that a retry starts clean
+		logoutStep(ctx, client, portal)
+		return &LoginError{err}
+	} else {
+		err = timedStep(stepLog, stepChange, func() error {
+			return changePasswordStep(ctx, client, portal, oldPassword, newPassword)
+		})
+		if err != nil {
+			return fmt.Errorf("Error changing password: %w", err)
+		}
 	}
 
-	err = changePasswordStep(client, portal, oldPassword, newPassword)
+	err = timedStep(stepLog, stepLogout, func() error {
+		return logoutStep(ctx, client, portal)
+	})
 	if err != nil {
-		return fmt.Errorf("Error changing password: %s", err)
+		return fmt.Errorf("Error logging out: %w", err)
 	}
+	return nil
+}
 
-	err = logoutStep(client, portal)
+func logoutStep(ctx context.Context, client *http.Client, portal *Portal) (err error) {
+	hostname := portal.Hostname
+	err = sendRequest(ctx, client, http.MethodGet, portal.Scheme+hostname+logoutPath, nil, nil, nil)
 	if err != nil {
-		return fmt.Errorf("Error logging out: %s", err)
+		return fmt.Errorf("Error sending request: %w", err)
 	}
+
 	return nil
 }
 
-func logoutStep(client *http.Client, portal *Portal) (err error) {
-	hostname := portal.Hostname
-	err = sendRequest(client, http.MethodGet, portal.Scheme+hostname+logoutPath, nil, nil, nil)
+// Run a step of a password change, logging its outcome and duration
+func timedStep(stepLog *Logger, step string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	fields := Fields{"step": step, "outcome": outcomeSuccess, "duration_ms": durationMS(start)}
 	if err != nil {
-		return fmt.Errorf("Error sending request: %s", err)
+		fields["outcome"] = outcomeFail
+		fields["error_class"] = errorClass(err)
+		fields["error"] = err
 	}
+	stepLog.Info("portal step", fields)
+	return err
+}
 
+// Strip the query, which can hold a session token, from a URL
+func urlWithoutQuery(urlstr string) string {
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return ""
+	}
+	u.RawQuery = ""
+	return u.String()
+}
+
+// Log in and out with a fresh session to check whether the portal accepts a
+// password.
+func tryLogin(ctx context.Context, portal *Portal, username, password, totpSecret string) error {
+	client := portalClient(portal)
+	err := loginStep(ctx, client, portal, username, password, totpSecret)
+	logoutStep(ctx, client, portal)
+	if err != nil {
+		return &LoginError{err}
+	}
 	return nil
 }
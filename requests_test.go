@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClassifyResponse(t *testing.T) {
+	for _, tc := range []struct {
+		statusCode int
+		body       string
+		kind       error
+	}{
+		{http.StatusServiceUnavailable, "<html>Service Unavailable</html>", ErrTransient},
+		{http.StatusTooManyRequests, "", ErrTransient},
+		{http.StatusUnauthorized, `{"errorCode":"E0000004","errorSummary":"Authentication failed"}`, ErrInvalidCredentials},
+		{http.StatusForbidden, "Bad password", ErrInvalidCredentials},
+		{http.StatusUnauthorized, `{"errorCode":"E0000069","errorSummary":"User Locked"}`, ErrAccountLocked},
+		{http.StatusUnauthorized, `{"status":"LOCKED_OUT"}`, ErrAccountLocked},
+		{http.StatusForbidden, "<html>Access Denied: your request was blocked</html>", ErrInvalidCredentials},
+		{http.StatusBadRequest, "password does not meet complexity requirements", ErrUnexpected},
+		{http.StatusBadRequest, `{"errorCode":"E0000080","errorSummary":"The password does not meet the complexity requirements"}`, ErrPasswordPolicyRejected},
+		{http.StatusForbidden, `{"errorCode":"E0000068","errorSummary":"Invalid Passcode/Answer"}`, ErrMFARequired},
+		{http.StatusInternalServerError, "Error triggered for test", ErrUnexpected},
+	} {
+		err := classifyResponse(tc.statusCode, tc.body)
+		if !errors.Is(err, tc.kind) {
+			t.Fatalf("Expected %d %q to be classified %q; got %q", tc.statusCode, tc.body, tc.kind, err.Kind)
+		}
+	}
+}
+
+func shortenRetries(t *testing.T, timeout time.Duration) {
+	oldTimeout, oldBase, oldMax := requestTimeout, retryBaseDelay, retryMaxDelay
+	requestTimeout, retryBaseDelay, retryMaxDelay = timeout, time.Millisecond, 5*time.Millisecond
+	t.Cleanup(func() {
+		requestTimeout, retryBaseDelay, retryMaxDelay = oldTimeout, oldBase, oldMax
+	})
+}
+
+func TestSendRequestRetries(t *testing.T) {
+	shortenRetries(t, 50*time.Millisecond)
+
+	var mu sync.Mutex
+	attempts := 0
+	status := http.StatusServiceUnavailable
+	delay := time.Duration(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		n, d, code := attempts, delay, status
+		mu.Unlock()
+		time.Sleep(d)
+		if n < maxRequestAttempts {
+			http.Error(w, "Service Unavailable", code)
+		}
+	}))
+	defer server.Close()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts
+	}
+
+	// a transient failure is retried
+	err := sendRequest(context.Background(), server.Client(), http.MethodPost, server.URL, nil, []byte("{}"), nil)
+	if err != nil || count() != maxRequestAttempts {
+		t.Fatalf("Expected success after %d attempts; got %v after %d", maxRequestAttempts, err, count())
+	}
+
+	// other failures are not
+	mu.Lock()
+	attempts, status = 0, http.StatusForbidden
+	mu.Unlock()
+	err = sendRequest(context.Background(), server.Client(), http.MethodGet, server.URL, nil, nil, nil)
+	if !errors.Is(err, ErrInvalidCredentials) || count() != 1 {
+		t.Fatalf("Expected invalid credentials after 1 attempt; got %v after %d", err, count())
+	}
+
+	// a POST that timed out might have been processed
+	mu.Lock()
+	attempts, delay = 0, 100*time.Millisecond
+	mu.Unlock()
+	err = sendRequest(context.Background(), server.Client(), http.MethodPost, server.URL, nil, []byte("{}"), nil)
+	if !errors.Is(err, ErrTransient) || count() != 1 {
+		t.Fatalf("Expected a transient error after 1 attempt; got %v after %d", err, count())
+	}
+
+	// a GET that timed out is retried until the attempts run out
+	mu.Lock()
+	attempts = 0
+	mu.Unlock()
+	err = sendRequest(context.Background(), server.Client(), http.MethodGet, server.URL, nil, nil, nil)
+	if !errors.Is(err, ErrTransient) || count() != maxRequestAttempts {
+		t.Fatalf("Expected a transient error after %d attempts; got %v after %d", maxRequestAttempts, err, count())
+	}
+
+	// cancelling the run is not a portal error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = sendRequest(ctx, server.Client(), http.MethodGet, server.URL, nil, nil, nil)
+	if err != context.Canceled {
+		t.Fatalf("Expected %s; got %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	defaultUploadInterval = 10 * time.Second
+)
+
+// rotationJob is a user whose password is due to be rotated.
+type rotationJob struct {
+	row            int // row in the automated sheet
+	name           string
+	password       string
+	previous       string
+	timestamp      string
+	portalPassword string
+	portalRow      int
+	inPortalSheet  bool
+	policy         UserPolicy
+	lockout        lockoutState
+	totpSecret     string // empty unless the user answers MFA challenges
+}
+
+// rotationResult is what happened to a user's password in the portal.
+type rotationResult struct {
+	job         rotationJob
+	newPassword string // set if the portal accepted a new password
+	recovered   string // the portal's password, if it was not the one in the sheet
+	err         error  // the user's password was not rotated
+	fatal       error  // the run must stop
+	at          time.Time
+
+	failedLogins int // logins that count toward IDM locking the account
+}
+
+// the result must be written to the workbook before the user's slot is freed
+func (res rotationResult) holdsSlot() bool {
+	return res.newPassword != "" || res.recovered != ""
+}
+
+type rotationStats struct {
+	success   int
+	recovered int
+	fail      int
+	causes    map[string]int // failures by errorClass
+	records   []ReportRecord
+}
+
+func (input *Input) workers() int {
+	if input.Workers < 1 {
+		return 1
+	}
+	return input.Workers
+}
+
+func (input *Input) uploadBatchSize() int {
+	if input.UploadBatchSize < 1 {
+		return 1
+	}
+	return input.UploadBatchSize
+}
+
+func (input *Input) uploadInterval() time.Duration {
+	if input.UploadInterval <= 0 {
+		return defaultUploadInterval
+	}
+	return input.UploadInterval
+}
+
+// Rotate the users' passwords with a pool of workers. The workbook is only
+// changed and uploaded by the calling goroutine.
+//
+// A worker takes the single slot before changing a password in the portal and
+// the slot is freed once the workbook holding the password is uploaded, so at
+// most one password is ever missing from S3. Only failed logins written to
+// the workbook are batched.
+func rotateUsers(ctx context.Context, f *excelize.File, input *Input, portal *Portal, s3Client S3ClientAPI, env Environment, journal *Journal, jobs []rotationJob) (rotationStats, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	slots := make(chan struct{}, 1)
+	jobCh := make(chan rotationJob)
+	results := make(chan rotationResult)
+
+	go func() {
+		defer close(jobCh)
+		for _, job := range jobs {
+			select {
+			case jobCh <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < input.workers() && w < len(jobs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobCh {
+				results <- rotateUser(ctx, portal, env, journal, slots, job)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return writeRotations(cancel, f, input, s3Client, env, journal, slots, results)
+}
+
+// Change a user's password in the portal, trying the other passwords we know
+// if the one in the sheet is rejected
+func rotateUser(ctx context.Context, portal *Portal, env Environment, journal *Journal, slots chan struct{}, job rotationJob) rotationResult {
+	res := rotationResult{job: job}
+	newPassword, err := job.policy.Password.newPassword(job.name, job.password)
+	if err != nil {
+		res.fatal = err
+		return res
+	}
+
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		res.err = ctx.Err()
+		return res
+	}
+
+	err = journal.record(env, job.name, newPassword)
+	if err != nil {
+		<-slots
+		res.fatal = err
+		return res
+	}
+	err = changeUserPassword(ctx, portalClient(portal), portal, job.name, job.password, newPassword, job.totpSecret)
+	if isFailedLogin(err) {
+		res.failedLogins++
+	}
+
+	// the password in the sheet might be stale if an earlier run changed it
+	// in the portal but did not upload the workbook, so try the others we
+	// know, as long as the user is not quarantined by trying them
+	var loginErr *LoginError
+	if errors.As(err, &loginErr) && errors.Is(err, ErrInvalidCredentials) {
+		known := append(journal.pending(env, job.name), job.previous, job.portalPassword)
+		for _, candidate := range passwordCandidates(job.password, known...) {
+			if candidate == newPassword {
+				// journaled above; the portal cannot have it yet
+				continue
+			}
+			if !loginAllowed(job.lockout, res.failedLogins, job.policy.QuarantineAfter) {
+				break
+			}
+			err = changeUserPassword(ctx, portalClient(portal), portal, job.name, candidate, newPassword, job.totpSecret)
+			if isFailedLogin(err) {
+				res.failedLogins++
+			}
+			if errors.As(err, &loginErr) {
+				if errors.Is(err, ErrInvalidCredentials) {
+					continue
+				}
+				// locked out or unreachable; trying more passwords will not help
+				break
+			}
+
+			// the candidate is the portal's current password
+			logger.Info("recovered password from sheet history", Fields{"env": env, "user": job.name})
+			res.recovered = candidate
+			break
+		}
+	}
+	res.at = time.Now().UTC()
+
+	if err != nil {
+		res.err = err
+		if errors.As(err, &loginErr) {
+			// the password was not changed
+			res.fatal = journal.discard(env, job.name)
+		}
+	} else {
+		res.newPassword = newPassword
+	}
+	if !res.holdsSlot() {
+		<-slots
+	}
+	return res
+}
+
+// Write results to the workbook as they arrive. A new password is uploaded at
+// once; failed logins are uploaded with it, or when a batch of them is full or
+// the upload interval passes. After an error, remaining results are drained
+// and discarded; the journal keeps their passwords for the next run.
+func writeRotations(cancel context.CancelFunc, f *excelize.File, input *Input, s3Client S3ClientAPI, env Environment, journal *Journal, slots chan struct{}, results chan rotationResult) (rotationStats, error) {
+	stats := rotationStats{causes: map[string]int{}}
+	envLog := envLogger(input, env)
+	var runErr error
+	pending := []rotationResult{}
+	unsaved := 0 // results with failed logins written and not yet uploaded
+
+	fail := func(err error) {
+		if runErr == nil {
+			runErr = err
+			cancel()
+		}
+	}
+
+	flush := func() error {
+		if len(pending) == 0 && unsaved == 0 {
+			return nil
+		}
+		defer func() {
+			for range pending {
+				<-slots
+			}
+			pending = pending[:0]
+		}()
+
+		start := time.Now()
+		err := uploadFile(f, input.Bucket, input.Key, s3Client)
+		users := []string{}
+		for _, res := range pending {
+			users = append(users, res.job.name)
+		}
+		fields := Fields{"step": stepUpload, "users": users, "duration_ms": durationMS(start), "outcome": outcomeSuccess}
+		if err != nil {
+			fields["outcome"] = outcomeFail
+			envLog.Error("failed to upload workbook", err, fields)
+			return fmt.Errorf("Error uploading file after successful rotation: %s", err)
+		}
+		envLog.Info("uploaded workbook", fields)
+		unsaved = 0
+		for _, res := range pending {
+			if res.newPassword == "" {
+				continue
+			}
+			err = journal.commit(env, res.job.name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ticker := time.NewTicker(input.uploadInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				if runErr == nil {
+					runErr = flush()
+				}
+				return stats, runErr
+			}
+			if runErr == nil && res.fatal != nil {
+				fail(res.fatal)
+			}
+			if runErr != nil {
+				if res.holdsSlot() {
+					<-slots
+				}
+				continue
+			}
+
+			err := applyRotation(f, input, env, res, &stats)
+			if err != nil {
+				fail(err)
+				if res.holdsSlot() {
+					<-slots
+				}
+				continue
+			}
+			if res.err != nil && recordsFailedLogins(res.failedLogins, res.job.policy.QuarantineAfter) {
+				unsaved++
+			}
+			if res.holdsSlot() {
+				pending = append(pending, res)
+			}
+			if len(pending) > 0 || unsaved >= input.uploadBatchSize() {
+				err = flush()
+				if err != nil {
+					fail(err)
+				}
+			}
+		case <-ticker.C:
+			if runErr == nil {
+				err := flush()
+				if err != nil {
+					fail(err)
+				}
+			}
+		}
+	}
+}
+
+// Write a rotation result to the workbook
+func applyRotation(f *excelize.File, input *Input, env Environment, res rotationResult, stats *rotationStats) error {
+	envLog := envLogger(input, env)
+	automatedSheet := input.SheetGroups[env].AutomatedSheetName
+	colPassword := input.AutomatedSheetColNameToIndex[ColPassword]
+	job := res.job
+
+	if res.recovered != "" {
+		err := writeCell(f, automatedSheet, colPassword, job.row, res.recovered)
+		if err != nil {
+			return fmt.Errorf("failed to write recovered password to sheet %s in row %d for user %s: %v; manually set password for user",
+				automatedSheet, toSheetCoord(job.row), job.name, err)
+		}
+	}
+
+	rec := ReportRecord{Environment: env, User: job.name, OldTimestamp: job.timestamp}
+	if res.err != nil {
+		stats.fail++
+		stats.causes[errorClass(res.err)]++
+		rec.Action = actionFailed
+		rec.ErrorClass = errorClass(res.err)
+		reason, err := recordFailedLogins(f, input, env, job.name, job.row, job.lockout, res.failedLogins, job.policy.QuarantineAfter, res.err, res.at)
+		if err != nil {
+			return err
+		}
+		rec.Quarantined = reason
+		stats.records = append(stats.records, rec)
+		envLog.Error("password reset failed", res.err, Fields{"user": job.name, "outcome": outcomeFail, "error_class": errorClass(res.err)})
+		return nil
+	}
+	if res.recovered != "" {
+		stats.recovered++
+	} else {
+		stats.success++
+	}
+
+	// update password for user in macFin sheet
+	if !job.inPortalSheet {
+		return fmt.Errorf("macFin user %s missing from PasswordManager users; failed to update sheet %s with new password", job.name, input.SheetGroups[env].PortalSheetName)
+	}
+	err := persistRotation(f, input, env, job.name, job.row, job.portalRow, res.newPassword, res.at)
+	if err != nil {
+		return err
+	}
+
+	outcome := outcomeSuccess
+	rec.Action = actionRotated
+	if res.recovered != "" {
+		outcome = outcomeRecovered
+		rec.Action = actionRecovered
+	}
+	rec.NewTimestamp = res.at.Format(time.UnixDate)
+	stats.records = append(stats.records, rec)
+	envLog.Info("rotation complete", Fields{"user": job.name, "outcome": outcome})
+	return nil
+}
+
+// rateLimiter spaces requests evenly at a fixed rate.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(requestsPerSecond float64) *rateLimiter {
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / requestsPerSecond)}
+}
+
+// Wait for the next request's turn
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimitedTransport holds each request until the portal's limiter allows it.
+type rateLimitedTransport struct {
+	limiter *rateLimiter
+	next    http.RoundTripper
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := t.limiter.wait(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
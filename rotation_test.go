@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(50)
+
+	// requests from several workers are spaced 20ms apart
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < 5; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 4; i++ {
+				err := limiter.wait(context.Background())
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 19*20*time.Millisecond {
+		t.Fatalf("Expected 20 requests at 50 per second to take at least 380ms; took %s", elapsed)
+	}
+
+	// a cancelled wait returns at once
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	limiter = newRateLimiter(0.1)
+	limiter.wait(ctx)
+	err := limiter.wait(ctx)
+	if err != context.Canceled {
+		t.Fatalf("Expected a cancelled wait to fail with %s; got %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// rawCell is a cell as stored in the workbook: its type, its unformatted
+// value and its formula. GetRows formats values for display, so numbers,
+// dates and formulas cannot be written back from what it returns.
+type rawCell struct {
+	Type    string // "n" (numbers and dates), "s" (text), "b", "e" or "d"; empty for an empty cell
+	Value   string
+	Formula string
+}
+
+// the parts of the xlsx package read to get the cells of each sheet
+type xlsxWorkbookSheets struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxPackageRels struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxText struct {
+	T string `xml:"t"`
+	R []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	s := t.T
+	for _, r := range t.R {
+		s += r.T
+	}
+	return s
+}
+
+type xlsxSharedStrings struct {
+	SI []xlsxText `xml:"si"`
+}
+
+type xlsxSheetCells struct {
+	Rows []struct {
+		R     int `xml:"r,attr"`
+		Cells []struct {
+			R  string    `xml:"r,attr"`
+			T  string    `xml:"t,attr"`
+			F  *struct{} `xml:"f"`
+			V  string    `xml:"v"`
+			IS *xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// Get the raw cells of every sheet, as rows without trailing empty cells or
+// rows
+func getAllCells(f *excelize.File) (map[string][][]rawCell, error) {
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		return nil, fmt.Errorf("failed writing workbook to read its cells: %s", err)
+	}
+	pkg, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading workbook package: %s", err)
+	}
+	parts := map[string]*zip.File{}
+	for _, part := range pkg.File {
+		parts[part.Name] = part
+	}
+	readPart := func(name string, v interface{}) error {
+		part, ok := parts[name]
+		if !ok {
+			return nil
+		}
+		r, err := part.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		err = xml.NewDecoder(r).Decode(v)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed reading %s: %s", name, err)
+		}
+		return nil
+	}
+
+	workbook := xlsxWorkbookSheets{}
+	rels := xlsxPackageRels{}
+	sst := xlsxSharedStrings{}
+	for name, v := range map[string]interface{}{"xl/workbook.xml": &workbook, "xl/_rels/workbook.xml.rels": &rels, "xl/sharedStrings.xml": &sst} {
+		err = readPart(name, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	targets := map[string]string{}
+	for _, rel := range rels.Relationships {
+		if strings.HasPrefix(rel.Target, "/") {
+			targets[rel.ID] = strings.TrimPrefix(rel.Target, "/")
+		} else {
+			targets[rel.ID] = path.Join("xl", rel.Target)
+		}
+	}
+
+	cells := map[string][][]rawCell{}
+	for _, sheet := range workbook.Sheets {
+		data := xlsxSheetCells{}
+		err = readPart(targets[sheet.RID], &data)
+		if err != nil {
+			return nil, err
+		}
+
+		rows := [][]rawCell{}
+		for i, row := range data.Rows {
+			y := row.R - 1
+			if row.R == 0 {
+				y = i
+			}
+			for j, c := range row.Cells {
+				x := j
+				if c.R != "" {
+					col, _, err := excelize.CellNameToCoordinates(c.R)
+					if err != nil {
+						return nil, fmt.Errorf("failed reading cell %s of %s: %s", c.R, sheet.Name, err)
+					}
+					x = col - 1
+				}
+
+				cell := rawCell{Type: c.T, Value: c.V}
+				switch c.T {
+				case "", "n":
+					cell.Type = "n"
+				case "s":
+					var idx int
+					_, err = fmt.Sscan(c.V, &idx)
+					if err != nil || idx < 0 || idx >= len(sst.SI) {
+						return nil, fmt.Errorf("invalid shared string %q in cell %s of %s", c.V, c.R, sheet.Name)
+					}
+					cell.Value = sst.SI[idx].String()
+				case "inlineStr":
+					cell.Type = "s"
+					if c.IS != nil {
+						cell.Value = c.IS.String()
+					}
+				case "str":
+					cell.Type = "s"
+				}
+				if c.F != nil {
+					// resolves shared formulas
+					cell.Formula, err = f.GetCellFormula(sheet.Name, c.R)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if cell.Value == "" && cell.Formula == "" {
+					continue
+				}
+
+				for len(rows) <= y {
+					rows = append(rows, nil)
+				}
+				for len(rows[y]) <= x {
+					rows[y] = append(rows[y], rawCell{})
+				}
+				rows[y][x] = cell
+			}
+		}
+		cells[sheet.Name] = rows
+	}
+	return cells, nil
+}
+
+// Write a raw cell, keeping the cell's style and replacing any formula
+func setRawCell(f *excelize.File, sheet, cell string, c rawCell) error {
+	var err error
+	switch c.Type {
+	case "n":
+		err = f.SetCellDefault(sheet, cell, c.Value)
+	case "b":
+		err = f.SetCellBool(sheet, cell, c.Value == "1")
+	case "":
+		err = f.SetCellValue(sheet, cell, nil)
+	default:
+		err = f.SetCellStr(sheet, cell, c.Value)
+	}
+	if err != nil {
+		return err
+	}
+	return f.SetCellFormula(sheet, cell, c.Formula)
+}
+
+func rawCellAt(rows [][]rawCell, x, y int) rawCell {
+	if y < len(rows) && x < len(rows[y]) {
+		return rows[y][x]
+	}
+	return rawCell{}
+}
+
+func rawRowLen(rows [][]rawCell, y int) int {
+	if y < len(rows) {
+		return len(rows[y])
+	}
+	return 0
+}
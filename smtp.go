@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTP authentication mechanisms
+const (
+	smtpAuthNone    = "none"
+	smtpAuthPlain   = "plain"
+	smtpAuthLogin   = "login"
+	smtpAuthCRAMMD5 = "cram-md5"
+)
+
+// SMTP TLS modes
+const (
+	smtpTLSOpportunistic = "opportunistic" // STARTTLS if the server offers it
+	smtpTLSStartTLS      = "starttls"      // STARTTLS, or fail
+	smtpTLSImplicit      = "implicit"      // TLS from the start, usually on port 465
+)
+
+const defaultSMTPConnectTimeout = 30 * time.Second
+
+var (
+	smtpAuthMechanisms = []string{smtpAuthNone, smtpAuthPlain, smtpAuthLogin, smtpAuthCRAMMD5}
+	smtpTLSModes       = []string{smtpTLSOpportunistic, smtpTLSStartTLS, smtpTLSImplicit}
+)
+
+// smtpMailer sends mail through an SMTP relay.
+type smtpMailer struct {
+	addr           string
+	host           string
+	tlsMode        string
+	tlsConfig      *tls.Config
+	auth           smtp.Auth // nil for none
+	connectTimeout time.Duration
+}
+
+// Build the mailer for a validated mail configuration
+func newSMTPMailer(c MailConfig) (*smtpMailer, error) {
+	connectTimeout, err := time.ParseDuration(c.SMTPConnectTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP connect timeout %q: %s", c.SMTPConnectTimeout, err)
+	}
+	tlsConfig, err := smtpTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.SMTPSkipVerify {
+		logger.Warn("SMTP server certificates are not verified", nil, Fields{"host": c.SMTPHost})
+	}
+
+	m := &smtpMailer{
+		addr:           net.JoinHostPort(c.SMTPHost, strconv.Itoa(c.SMTPPort)),
+		host:           c.SMTPHost,
+		tlsMode:        c.SMTPTLS,
+		tlsConfig:      tlsConfig,
+		connectTimeout: connectTimeout,
+	}
+	switch c.SMTPAuth {
+	case smtpAuthPlain:
+		m.auth = smtp.PlainAuth("", c.SMTPUsername, c.SMTPPassword, c.SMTPHost)
+	case smtpAuthLogin:
+		m.auth = &loginAuth{username: c.SMTPUsername, password: c.SMTPPassword, host: c.SMTPHost}
+	case smtpAuthCRAMMD5:
+		m.auth = smtp.CRAMMD5Auth(c.SMTPUsername, c.SMTPPassword)
+	}
+	return m, nil
+}
+
+// Get the TLS settings for the relay: the system roots plus any CA bundle,
+// or no verification at all if so configured
+func smtpTLSConfig(c MailConfig) (*tls.Config, error) {
+	config := &tls.Config{ServerName: c.SMTPHost, InsecureSkipVerify: c.SMTPSkipVerify}
+	if c.SMTPCAFile == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(c.SMTPCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading SMTP CA bundle: %s", err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("SMTP CA bundle %s has no PEM certificates", c.SMTPCAFile)
+	}
+	config.RootCAs = roots
+	return config, nil
+}
+
+// Send a message from one address to others
+func (m *smtpMailer) send(from string, to []string, msg []byte) error {
+	dialer := &net.Dialer{Timeout: m.connectTimeout}
+	var conn net.Conn
+	var err error
+	if m.tlsMode == smtpTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", m.addr, m.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", m.addr)
+	}
+	if err != nil {
+		return fmt.Errorf("Error connecting to SMTP server %s: %s", m.addr, err)
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("Error starting SMTP session with %s: %s", m.addr, err)
+	}
+	defer c.Close()
+
+	if m.tlsMode != smtpTLSImplicit {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			err = c.StartTLS(m.tlsConfig)
+			if err != nil {
+				return fmt.Errorf("Error starting TLS with %s: %s", m.addr, err)
+			}
+		} else if m.tlsMode == smtpTLSStartTLS {
+			return fmt.Errorf("SMTP server %s does not offer STARTTLS", m.addr)
+		}
+	}
+
+	if m.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("SMTP server %s does not offer AUTH", m.addr)
+		}
+		err = c.Auth(m.auth)
+		if err != nil {
+			return fmt.Errorf("Error authenticating with %s: %s", m.addr, err)
+		}
+	}
+
+	err = c.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, addr := range to {
+		err = c.Rcpt(addr)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// loginAuth is the LOGIN mechanism, which net/smtp lacks. Like PlainAuth, it
+// only sends credentials over TLS or to localhost.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch {
+	case strings.EqualFold(string(fromServer), "Username:"):
+		return []byte(a.username), nil
+	case strings.EqualFold(string(fromServer), "Password:"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
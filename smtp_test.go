@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	crand "crypto/rand"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// FakeSMTPServer is an SMTP server that records how each session was
+// negotiated and the messages it received.
+type FakeSMTPServer struct {
+	StartTLS    bool     // offer STARTTLS
+	ImplicitTLS bool     // TLS from the start
+	AuthMechs   []string // offered AUTH mechanisms
+	Username    string
+	Password    string
+
+	listener  net.Listener
+	tlsConfig *tls.Config
+
+	mu       sync.Mutex
+	Sessions []*SMTPSession
+}
+
+// SMTPSession is what one connection to a FakeSMTPServer negotiated.
+type SMTPSession struct {
+	TLS      bool   // TLS when the message was sent
+	AuthMech string // mechanism used to authenticate, if any
+	From     string
+	To       []string
+	Data     string
+}
+
+func newFakeSMTPServer(t *testing.T, s *FakeSMTPServer, cert tls.Certificate) *FakeSMTPServer {
+	s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ImplicitTLS {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
+	s.listener = l
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *FakeSMTPServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *FakeSMTPServer) sessions() []*SMTPSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*SMTPSession{}, s.Sessions...)
+}
+
+func (s *FakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	session := &SMTPSession{TLS: s.ImplicitTLS}
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+	authenticated := false
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			lines := []string{"fake"}
+			if s.StartTLS && !session.TLS {
+				lines = append(lines, "STARTTLS")
+			}
+			if len(s.AuthMechs) > 0 {
+				lines = append(lines, "AUTH "+strings.Join(s.AuthMechs, " "))
+			}
+			for i, l := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				tp.PrintfLine("250%s%s", sep, l)
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 ready")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+			tp = textproto.NewConn(conn)
+			session.TLS = true
+		case "AUTH":
+			mech := strings.ToUpper(strings.Fields(arg)[0])
+			if s.auth(tp, mech, arg) {
+				authenticated = true
+				session.AuthMech = mech
+				tp.PrintfLine("235 authenticated")
+			} else {
+				tp.PrintfLine("535 authentication failed")
+			}
+		case "MAIL":
+			if len(s.AuthMechs) > 0 && !authenticated {
+				tp.PrintfLine("530 authentication required")
+				continue
+			}
+			session.From = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			session.To = append(session.To, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			session.Data = string(data)
+			s.mu.Lock()
+			s.Sessions = append(s.Sessions, session)
+			s.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+func (s *FakeSMTPServer) auth(tp *textproto.Conn, mech, arg string) bool {
+	decode := func(line string) string {
+		b, _ := base64.StdEncoding.DecodeString(line)
+		return string(b)
+	}
+	b64 := base64.StdEncoding.EncodeToString
+	switch mech {
+	case "PLAIN":
+		fields := strings.Fields(arg)
+		if len(fields) != 2 {
+			return false
+		}
+		parts := strings.Split(decode(fields[1]), "\x00")
+		return len(parts) == 3 && parts[1] == s.Username && parts[2] == s.Password
+	case "LOGIN":
+		tp.PrintfLine("334 %s", b64([]byte("Username:")))
+		username, _ := tp.ReadLine()
+		tp.PrintfLine("334 %s", b64([]byte("Password:")))
+		password, _ := tp.ReadLine()
+		return decode(username) == s.Username && decode(password) == s.Password
+	case "CRAM-MD5":
+		challenge := "<12345@fake>"
+		tp.PrintfLine("334 %s", b64([]byte(challenge)))
+		response, _ := tp.ReadLine()
+		mac := hmac.New(md5.New, []byte(s.Password))
+		mac.Write([]byte(challenge))
+		return decode(response) == s.Username+" "+hex.EncodeToString(mac.Sum(nil))
+	}
+	return false
+}
+
+// Make a self-signed certificate for 127.0.0.1 and write it to a CA bundle
+func newSMTPCert(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake smtp"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+func TestSMTPMailer(t *testing.T) {
+	cert, caFile := newSMTPCert(t)
+
+	for _, tc := range []struct {
+		name     string
+		server   *FakeSMTPServer // nil for a plain server
+		config   MailConfig
+		err      string // expected in the error, if any
+		tls      bool
+		authMech string
+	}{
+		{
+			name:   "opportunistic without STARTTLS",
+			config: MailConfig{SMTPTLS: smtpTLSOpportunistic, SMTPAuth: smtpAuthNone},
+		},
+		{
+			name:   "opportunistic with STARTTLS",
+			server: &FakeSMTPServer{StartTLS: true},
+			config: MailConfig{SMTPTLS: smtpTLSOpportunistic, SMTPAuth: smtpAuthNone, SMTPCAFile: caFile},
+			tls:    true,
+		},
+		{
+			name:   "required STARTTLS not offered",
+			config: MailConfig{SMTPTLS: smtpTLSStartTLS, SMTPAuth: smtpAuthNone},
+			err:    "does not offer STARTTLS",
+		},
+		{
+			name:     "STARTTLS with PLAIN",
+			server:   &FakeSMTPServer{StartTLS: true, AuthMechs: []string{"PLAIN", "LOGIN"}, Username: "relay", Password: "s3cret"},
+			config:   MailConfig{SMTPTLS: smtpTLSStartTLS, SMTPAuth: smtpAuthPlain, SMTPUsername: "relay", SMTPPassword: "s3cret", SMTPCAFile: caFile},
+			tls:      true,
+			authMech: "PLAIN",
+		},
+		{
+			name:     "STARTTLS with LOGIN",
+			server:   &FakeSMTPServer{StartTLS: true, AuthMechs: []string{"PLAIN", "LOGIN"}, Username: "relay", Password: "s3cret"},
+			config:   MailConfig{SMTPTLS: smtpTLSStartTLS, SMTPAuth: smtpAuthLogin, SMTPUsername: "relay", SMTPPassword: "s3cret", SMTPCAFile: caFile},
+			tls:      true,
+			authMech: "LOGIN",
+		},
+		{
+			name:   "wrong password",
+			server: &FakeSMTPServer{StartTLS: true, AuthMechs: []string{"LOGIN"}, Username: "relay", Password: "s3cret"},
+			config: MailConfig{SMTPTLS: smtpTLSStartTLS, SMTPAuth: smtpAuthLogin, SMTPUsername: "relay", SMTPPassword: "wrong", SMTPCAFile: caFile},
+			err:    "Error authenticating",
+		},
+		{
+			name:     "implicit TLS with CRAM-MD5",
+			server:   &FakeSMTPServer{ImplicitTLS: true, AuthMechs: []string{"CRAM-MD5"}, Username: "relay", Password: "s3cret"},
+			config:   MailConfig{SMTPTLS: smtpTLSImplicit, SMTPAuth: smtpAuthCRAMMD5, SMTPUsername: "relay", SMTPPassword: "s3cret", SMTPCAFile: caFile},
+			tls:      true,
+			authMech: "CRAM-MD5",
+		},
+		{
+			name:   "untrusted certificate",
+			server: &FakeSMTPServer{StartTLS: true},
+			config: MailConfig{SMTPTLS: smtpTLSStartTLS, SMTPAuth: smtpAuthNone},
+			err:    "certificate",
+		},
+		{
+			name:   "unverified certificate",
+			server: &FakeSMTPServer{ImplicitTLS: true},
+			config: MailConfig{SMTPTLS: smtpTLSImplicit, SMTPAuth: smtpAuthNone, SMTPSkipVerify: true},
+			tls:    true,
+		},
+		{
+			name:   "AUTH not offered",
+			config: MailConfig{SMTPTLS: smtpTLSOpportunistic, SMTPAuth: smtpAuthPlain, SMTPUsername: "relay", SMTPPassword: "s3cret"},
+			err:    "does not offer AUTH",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.server == nil {
+				tc.server = &FakeSMTPServer{}
+			}
+			server := newFakeSMTPServer(t, tc.server, cert)
+			tc.config.SMTPHost = "127.0.0.1"
+			tc.config.SMTPPort = server.port()
+			tc.config.SMTPConnectTimeout = "5s"
+
+			mailer, err := newSMTPMailer(tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = mailer.send("rotation@example.com", []string{"a@example.com", "b@example.com"}, []byte("Subject: test\r\n\r\nhello\r\n"))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected an error with %q; got %v", tc.err, err)
+				}
+				if len(server.sessions()) != 0 {
+					t.Fatal("Expected no message to be sent")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sessions := server.sessions()
+			if len(sessions) != 1 {
+				t.Fatalf("Expected one message; got %d", len(sessions))
+			}
+			s := sessions[0]
+			if s.TLS != tc.tls || s.AuthMech != tc.authMech {
+				t.Fatalf("Expected TLS %v and auth %q; got TLS %v and auth %q", tc.tls, tc.authMech, s.TLS, s.AuthMech)
+			}
+			if s.From != "rotation@example.com" || strings.Join(s.To, ",") != "a@example.com,b@example.com" || !strings.Contains(s.Data, "hello") {
+				t.Fatalf("Unexpected message %+v", s)
+			}
+		})
+	}
+}
+
+func TestSendEmail(t *testing.T) {
+	cert, caFile := newSMTPCert(t)
+	server := newFakeSMTPServer(t, &FakeSMTPServer{StartTLS: true, AuthMechs: []string{"LOGIN"}, Username: "relay", Password: "s3cret"}, cert)
+
+	f := excelize.NewFile()
+	f.SetSheetName("Sheet1", "Portal-VAL")
+	f.NewSheet("PROD")
+	f.Path = filepath.Join(t.TempDir(), "workbook.xlsx")
+	input := &Input{
+		WorkbookPassword: "workbook",
+		SheetGroups: map[Environment]SheetGroup{
+			val: {PortalSheetName: "Portal-VAL", AutomatedSheetName: "PasswordManager-VAL", TestingSheetNames: []string{}},
+		},
+		Mail: MailConfig{
+			Enabled: true, SMTPHost: "127.0.0.1", SMTPPort: server.port(),
+			SMTPAuth: smtpAuthLogin, SMTPUsername: "relay", SMTPPassword: "s3cret",
+			SMTPTLS: smtpTLSStartTLS, SMTPCAFile: caFile, SMTPConnectTimeout: "5s",
+			FromAddress: "rotation@example.com", SenderName: "Rotation",
+			ToAddresses: []string{"all@example.com"},
+			Groups:      []MailGroup{{Name: "val", ToAddresses: []string{"val@example.com"}, Environments: []Environment{val}}},
+		},
+	}
+	report := newRunReport("run1", time.Now())
+	report.add(ReportRecord{Environment: val, User: "val-user", Action: actionRotated})
+	report.add(ReportRecord{Environment: prod, User: "prod-user", Action: actionFailed, ErrorClass: "account locked"})
+	err := sendEmail(f, input, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := server.sessions()
+	if len(sessions) != 2 {
+		t.Fatalf("Expected a message for the whole workbook and one for the group; got %d", len(sessions))
+	}
+	for i, s := range sessions {
+		if !s.TLS || s.AuthMech != "LOGIN" {
+			t.Fatalf("Unexpected session %+v", s)
+		}
+		msg := parseMessage(t, s.Data)
+		if len(msg.attachment) == 0 || !strings.Contains(msg.text, "run1") || !strings.Contains(msg.html, "run1") {
+			t.Fatalf("Expected the attachment and a summary of the run; got %+v", msg)
+		}
+		switch i {
+		case 0:
+			if strings.Join(s.To, ",") != "all@example.com" || msg.subject != mailSubject+" (1 failed)" ||
+				!strings.Contains(msg.text, "prod-user: account locked") || !strings.Contains(msg.html, "<li>prod prod-user: account locked</li>") {
+				t.Fatalf("Expected the whole workbook's message to report the prod failure; got %+v", msg)
+			}
+		case 1:
+			if strings.Join(s.To, ",") != "val@example.com" || msg.subject != mailSubject || strings.Contains(s.Data, "prod-user") {
+				t.Fatalf("Expected the val group's message to leave out prod; got %+v", msg)
+			}
+		}
+	}
+
+	// the next group still gets its mail when one fails
+	input.Mail.Groups = append([]MailGroup{{Name: "missing", ToAddresses: []string{"x@example.com"}, Sheets: []string{"Missing"}}}, input.Mail.Groups...)
+	input.Mail.ToAddresses = nil
+	err = sendEmail(f, input, report)
+	if err == nil || !strings.Contains(err.Error(), "mail group missing") {
+		t.Fatalf("Expected an error for the missing group; got %v", err)
+	}
+	if n := len(server.sessions()); n != 3 {
+		t.Fatalf("Expected the val group to be emailed again; got %d messages", n)
+	}
+}
+
+// the parts of a message sent by sendEmail
+type parsedMessage struct {
+	subject, text, html string
+	attachment          []byte
+}
+
+// Parse a message sent by sendEmail, checking its MIME tree. The attachment
+// is optional.
+func parseMessage(t *testing.T, data string) parsedMessage {
+	msg, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := parsedMessage{}
+	parsed.subject, err = new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" || msg.Header.Get("MIME-Version") != "1.0" {
+		t.Fatalf("Expected a MIME multipart/mixed message; got %q, %v", msg.Header.Get("Content-Type"), err)
+	}
+	mixed := multipart.NewReader(msg.Body, params["boundary"])
+
+	// multipart.Reader undoes the quoted-printable encoding
+	part, err := mixed.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ = mime.ParseMediaType(part.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("Expected the alternatives first; got %s", mediaType)
+	}
+	alternative := multipart.NewReader(part, params["boundary"])
+	for _, expected := range []string{"text/plain", "text/html"} {
+		p, err := alternative.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type")); mediaType != expected {
+			t.Fatalf("Expected %s; got %s", expected, mediaType)
+		}
+		b, _ := io.ReadAll(p)
+		if expected == "text/plain" {
+			parsed.text = string(b)
+		} else {
+			parsed.html = string(b)
+		}
+	}
+
+	part, err = mixed.NextPart()
+	if err == io.EOF {
+		return parsed
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.FileName() != AttachedFileName {
+		t.Fatalf("Expected the attachment %s; got %q", AttachedFileName, part.FileName())
+	}
+	encoded, _ := io.ReadAll(part)
+	lines := strings.Fields(string(encoded))
+	for _, line := range lines {
+		if len(line) > 76 {
+			t.Fatalf("Expected base64 lines of at most 76 characters; got %d", len(line))
+		}
+	}
+	parsed.attachment, err = base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mixed.NextPart(); err != io.EOF {
+		t.Fatalf("Expected two parts; got %v", err)
+	}
+	return parsed
+}
+
+func TestAlertEmail(t *testing.T) {
+	cert, caFile := newSMTPCert(t)
+	server := newFakeSMTPServer(t, &FakeSMTPServer{StartTLS: true}, cert)
+
+	fc := &FakeS3Client{Bucket: "bucket", Key: "accounts.xlsx", Objects: map[string][]byte{}}
+	input := &Input{
+		Bucket:       "bucket",
+		Key:          "missing.xlsx",
+		RunID:        "run1",
+		ReportPrefix: "reports/",
+		Mail: MailConfig{
+			Enabled: true, Notify: notifyOnChange, SMTPHost: "127.0.0.1", SMTPPort: server.port(),
+			SMTPTLS: smtpTLSStartTLS, SMTPCAFile: caFile, SMTPConnectTimeout: "5s",
+			FromAddress: "rotation@example.com", SenderName: "Rotation",
+			ToAddresses: []string{"all@example.com"},
+		},
+	}
+	input.Notifiers = []Notifier{&mailNotifier{input: input}}
+
+	// the workbook cannot be downloaded
+	err := rotate(context.Background(), input, map[Environment]*Portal{}, fc)
+	if err == nil {
+		t.Fatal("Expected the run to fail")
+	}
+	sessions := server.sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("Expected an alert; got %d messages", len(sessions))
+	}
+	msg := parseMessage(t, sessions[0].Data)
+	if msg.subject != mailSubject+": rotation failed" || len(msg.attachment) != 0 ||
+		!strings.Contains(msg.text, "Error downloading file: NoSuchKey") || !strings.Contains(msg.html, "Error downloading file: NoSuchKey") {
+		t.Fatalf("Expected an alert with the error and no attachment; got %+v", msg)
+	}
+
+	// never is never
+	input.Mail.Notify = notifyNever
+	rotate(context.Background(), input, map[Environment]*Portal{}, fc)
+	if len(server.sessions()) != 1 {
+		t.Fatal("Expected no alert when mail.notify is never")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// RFC 6238 settings used by IDM's (Okta's) software TOTP factor
+const (
+	totpPeriod     = 30 // seconds
+	totpDigits     = 6
+	totpFactorType = "token:software:totp"
+)
+
+var (
+	ErrInvalidTOTPSecret = fmt.Errorf("TOTP secret is not base32")
+	ErrTOTPCodesSent     = fmt.Errorf("the TOTP codes IDM accepts now were already sent: %w", ErrMFARequired)
+)
+
+// Decode a base32 TOTP secret as authenticator apps show it: any case, with
+// or without spaces and padding
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Join(strings.Fields(secret), ""))
+	secret = strings.TrimRight(secret, "=")
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidTOTPSecret
+	}
+	return key, nil
+}
+
+// The TOTP code of a secret for a time step, the Unix time divided by
+// totpPeriod
+func totpCode(secret string, step int64) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation (RFC 4226 5.3)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus), nil
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// the last time step whose code was sent for each secret; IDM accepts each
+// code only once
+var totpSent = struct {
+	sync.Mutex
+	steps map[string]int64
+}{steps: map[string]int64{}}
+
+// Get a TOTP code that has not been sent yet. IDM accepts the code of the
+// next time step too, so it follows a code already sent in this one; after
+// that, rather than wait for a new step while the login may hold an upload
+// slot, it fails with ErrTOTPCodesSent.
+func nextTOTPCode(secret string) (string, error) {
+	now := totpStep(time.Now())
+	totpSent.Lock()
+	defer totpSent.Unlock()
+	step := now
+	if sent, ok := totpSent.steps[secret]; ok && sent >= step {
+		step = sent + 1
+	}
+	if step > now+1 {
+		return "", ErrTOTPCodesSent
+	}
+	totpSent.steps[secret] = step
+	return totpCode(secret, step)
+}
+
+// Encrypt the TOTP secret on the first line of r for the TOTP Secret column
+func encryptTOTPSecret(input *Input, r io.Reader) (string, error) {
+	secret, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	secret = strings.TrimSpace(secret)
+	_, err = decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	if input.AutomatedSheetPassword == "" {
+		return "", fmt.Errorf("no automated sheet password to encrypt the secret with")
+	}
+	return encryptSecret(input.AutomatedSheetPassword, secret)
+}
+
+// Get the TOTP secrets of an environment's users, keyed by lowercase
+// username, from the automated sheet's optional TOTP Secret column. Each
+// secret is encrypted with the automated sheet password; secrets that cannot
+// be decrypted are logged and ignored.
+func getTOTPSecrets(f *excelize.File, input *Input, env Environment) (map[string]string, error) {
+	automatedSheet := input.SheetGroups[env].AutomatedSheetName
+	rows, err := f.GetRows(automatedSheet)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting rows from %s in s3://%s/%s: %s", automatedSheet, input.Bucket, input.Key, err)
+	}
+	secrets := map[string]string{}
+	if len(rows) == 0 {
+		return secrets, nil
+	}
+	x, ok := getHeaderToXCoord(rows[0])[ColTOTPSecretHeading]
+	if !ok {
+		return secrets, nil
+	}
+	colUser := input.AutomatedSheetColNameToIndex[ColUser]
+
+	for _, row := range rows[input.RowOffset:] {
+		if len(row) <= x || len(row) <= colUser || strings.TrimSpace(row[x]) == "" {
+			continue
+		}
+		username := strings.ToLower(row[colUser])
+		secret, err := decryptSecret(input.AutomatedSheetPassword, strings.TrimSpace(row[x]))
+		if err == nil {
+			_, err = decodeTOTPSecret(secret)
+		}
+		if err != nil {
+			envLogger(input, env).Error("ignoring invalid TOTP secret", err, Fields{"user": username})
+			continue
+		}
+		registerSecret(secret)
+		secrets[username] = secret
+	}
+	return secrets, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA1, truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890"
+	for unix, expected := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		code, err := totpCode(secret, unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != expected {
+			t.Fatalf("Expected code %s at %d; got %s", expected, unix, code)
+		}
+	}
+
+	// as an authenticator app shows it
+	code, err := totpCode("gezd gnbv gy3t qojq gezd gnbv gy3t qojq", 59/totpPeriod)
+	if err != nil || code != "287082" {
+		t.Fatalf("Expected a spaced lowercase secret to give 287082; got %s, %v", code, err)
+	}
+	_, err = totpCode("not base32!", 1)
+	if err != ErrInvalidTOTPSecret {
+		t.Fatalf("Expected ErrInvalidTOTPSecret; got %v", err)
+	}
+
+	// a code is sent once; the next step's follows without waiting, and
+	// then no code is left until the step ends
+	secret = "MFRGGZDFMZTWQ2LK"
+	totpSent.Lock()
+	delete(totpSent.steps, secret)
+	totpSent.Unlock()
+	step := totpStep(time.Now())
+	first, err := nextTOTPCode(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := nextTOTPCode(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = nextTOTPCode(secret)
+	if totpStep(time.Now()) != step {
+		return // the step ended during the test
+	}
+	current, _ := totpCode(secret, step)
+	next, _ := totpCode(secret, step+1)
+	if first != current || second != next {
+		t.Fatalf("Expected codes %s and %s; got %s and %s", current, next, first, second)
+	}
+	if err != ErrTOTPCodesSent || !errors.Is(err, ErrMFARequired) {
+		t.Fatalf("Expected ErrTOTPCodesSent; got %v", err)
+	}
+}
+
+func TestMFALogin(t *testing.T) {
+	dir := t.TempDir()
+	filename := path.Join(dir, localS3Filename)
+
+	input := &Input{
+		UsernameHeader:                 headingMACFinUsername,
+		PasswordHeader:                 headingMACFinPassword,
+		Bucket:                         inputBucket,
+		Key:                            inputKey,
+		AutomatedSheetPassword:         "asfas",
+		AutomatedSheetColNameToIndex:   columnArrangements[0].Columns,
+		AutomatedSheetColNameToHeading: headings,
+		RowOffset:                      1,
+		SheetGroups: map[Environment]SheetGroup{
+			dev: {
+				AutomatedSheetName: sheetNamePasswordManager,
+				PortalSheetName:    sheetNameMACFin,
+			},
+		},
+		Workers:      2,
+		ReportPrefix: "reports/",
+		RunID:        "test",
+	}
+	encrypt := func(secret string) string {
+		encrypted, err := encryptTOTPSecret(input, strings.NewReader(secret+"\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encrypted
+	}
+
+	rows := [][]string{
+		{ColUserHeading, ColPasswordHeading, ColPreviousHeading, ColTimestampHeading, ColTOTPSecretHeading},
+		{"ann", "ann-pw", "", format(-3 * Day), encrypt("jbsw y3dp ehpk 3pxp")},
+		{"ben", "ben-pw", "", format(-3 * Day), ""},
+		{"cat", "cat-pw", "", format(-3 * Day), encrypt("JBSWY3DPEHPK3PXP")},
+		{"dan", "dan-pw", "", format(-3 * Day), "not encrypted"},
+		{"eve", "eve-pw", "", format(-80 * Day), encrypt("KRSXG5CTMVRXEZLU")},
+	}
+	f := excelize.NewFile()
+	f.SetSheetName("Sheet1", sheetNameMACFin)
+	f.NewSheet(sheetNamePasswordManager)
+	f.SetSheetRow(sheetNameMACFin, "A1", &[]string{headingMACFinUsername, headingMACFinPassword})
+	for idx, row := range rows {
+		row := row
+		err := f.SetSheetRow(sheetNamePasswordManager, fmt.Sprintf("A%d", 1+idx), &row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idx > 0 {
+			f.SetSheetRow(sheetNameMACFin, fmt.Sprintf("A%d", 1+idx), &[]string{row[0], row[1]})
+		}
+	}
+	err := f.SaveAs(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &AuthServer{
+		UserToPassword: map[string]string{
+			"ann": "ann-pw",
+			"ben": "ben-pw",
+			"cat": "cat-pw",
+			"dan": "dan-pw",
+			"eve": "eve-pw",
+		},
+		TOTPSecrets: map[string]string{
+			"ann": "JBSWY3DPEHPK3PXP",
+			"ben": "JBSWY3DPEHPK3PXP",
+			"cat": "GEZDGNBVGY3TQOJQ",
+			"dan": "JBSWY3DPEHPK3PXP",
+			"eve": "KRSXG5CTMVRXEZLU",
+		},
+	}
+	server := &http.Server{
+		Addr:    ":3398",
+		Handler: handler,
+	}
+	go func() {
+		log.Printf("Server stopped: %s", server.ListenAndServe())
+	}()
+	defer server.Shutdown(context.Background())
+
+	envToPortal := map[Environment]*Portal{
+		dev: {
+			Hostname:    portalServer,
+			IDMHostname: idmServer,
+			Scheme:      "http://",
+			env:         dev,
+			limiter:     newRateLimiter(1000),
+		},
+	}
+	fc := &FakeS3Client{
+		Bucket:                       input.Bucket,
+		Key:                          input.Key,
+		LocalPath:                    filename,
+		AutomatedSheetName:           sheetNamePasswordManager,
+		AutomatedSheetColNameToIndex: input.AutomatedSheetColNameToIndex,
+		RowOffset:                    input.RowOffset,
+		SheetName:                    sheetNameMACFin,
+		UsernameHeader:               input.UsernameHeader,
+		PasswordHeader:               input.PasswordHeader,
+	}
+
+	// ann answers with the sheet's secret; ben has none, cat's is wrong and dan's
+	// cannot be decrypted
+	failed, err := verify(context.Background(), input, envToPortal, fc, []Environment{dev}, []string{"ann", "ben", "cat", "dan"})
+	if err != nil {
+		t.Fatalf("Error running verify(): %s", err)
+	}
+	if failed != 3 {
+		t.Fatalf("Expected 3 users to fail verification; got %d", failed)
+	}
+	report := getRunReport(t, fc, "reports/")
+	for user, status := range map[string]string{"ann": statusOK, "ben": statusMFARequired, "cat": statusMFARequired, "dan": statusMFARequired} {
+		rec := report.find(dev, user)
+		if rec == nil || rec.Status != status {
+			t.Errorf("Expected %s to be verified with status %s; got %+v", user, status, rec)
+		}
+	}
+	// cat's invalid code is followed by one more
+	userToCodes := map[string]int{}
+	for _, code := range handler.SentCodes {
+		userToCodes[strings.SplitN(code, ":", 2)[0]]++
+	}
+	if len(userToCodes) != 2 || userToCodes["ann"] != 1 || userToCodes["cat"] != 2 {
+		t.Fatalf("Expected one code from ann and two from cat; got %v", handler.SentCodes)
+	}
+
+	// eve's password is rotated through the MFA challenge
+	fc.Objects = nil
+	err = rotate(context.Background(), input, envToPortal, fc)
+	if err != nil {
+		t.Fatalf("Error running rotate(): %s", err)
+	}
+	newPassword, ok := handler.UserToNewPassword["eve"]
+	if !ok || len(handler.UserToNewPassword) != 1 {
+		t.Fatalf("Expected only eve's password to be changed; got %v", handler.UserToNewPassword)
+	}
+	out, err := excelize.OpenFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outRows, err := out.GetRows(sheetNamePasswordManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row := outRows[5]; row[0] != "eve" || row[1] != newPassword || row[4] != rows[5][4] {
+		t.Fatalf("Expected eve's new password with the TOTP secret kept; got %v", row)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// statuses of a verified user, as written to the automated sheet's Status
+// column
+const (
+	statusOK            = "ok"
+	statusWrongPassword = "wrong password"
+	statusLocked        = "locked"
+	statusExpired       = "expired"
+	statusMFARequired   = "mfa required"
+	statusPortalError   = "portal error"
+)
+
+// The status of a user whose login returned err
+func verifyStatus(err error) string {
+	switch {
+	case err == nil:
+		return statusOK
+	case errors.Is(err, ErrInvalidCredentials):
+		return statusWrongPassword
+	case errors.Is(err, ErrAccountLocked):
+		return statusLocked
+	case errors.Is(err, ErrPasswordExpired):
+		return statusExpired
+	case errors.Is(err, ErrMFARequired):
+		return statusMFARequired
+	}
+	return statusPortalError
+}
+
+// Write a user's status to the automated sheet, adding the Status column if
+// the sheet has none
+func recordStatus(f *excelize.File, input *Input, env Environment, name string, row int, status string) error {
+	automatedSheet := input.SheetGroups[env].AutomatedSheetName
+	x, err := optionalCol(f, input, env, ColStatusHeading)
+	if err != nil {
+		return err
+	}
+	err = writeCell(f, automatedSheet, x, row, status)
+	if err != nil {
+		return fmt.Errorf("failed to write status %s to sheet %s in row %d for user %s: %s", status,
+			automatedSheet, toSheetCoord(row), name, err)
+	}
+	return nil
+}
+
+// Get the environments named in a comma-separated list, or every
+// environment if the list is empty
+func verifyEnvironments(names string, envToPortal map[Environment]*Portal) ([]Environment, error) {
+	if names == "" {
+		return sortedEnvironments(envToPortal), nil
+	}
+	envs := []Environment{}
+	for _, name := range splitList(names) {
+		env := Environment(strings.ToLower(name))
+		if _, ok := envToPortal[env]; !ok {
+			return nil, fmt.Errorf("unknown environment %s", name)
+		}
+		envs = append(envs, env)
+	}
+	return envs, nil
+}
+
+// Log in as every user in the automated sheets of envs, or only the given
+// users if there are any, with the stored password. How each login went is
+// written to the Status column and the run report; no password is changed.
+// Returns the number of users whose status is not ok.
+func verify(ctx context.Context, input *Input, envToPortal map[Environment]*Portal, client S3ClientAPI, envs []Environment, users []string) (int, error) {
+	client = meteredS3Client{S3ClientAPI: client}
+	timer := newRunTimer(envs, metricVerifySucceeded, metricVerifyDuration)
+	report := newRunReport(input.RunID, timer.start.UTC())
+	failed, err := verifyWorkbook(ctx, input, envToPortal, client, envs, users, report, timer)
+	report.finish(err, time.Now().UTC())
+
+	reportErr := report.upload(input, client)
+	if reportErr != nil && err != nil {
+		logger.Error("failed to upload run report", reportErr, nil)
+	} else if reportErr != nil {
+		err = reportErr
+	}
+	timer.flush(err == nil && failed == 0)
+	return failed, err
+}
+
+func verifyWorkbook(ctx context.Context, input *Input, envToPortal map[Environment]*Portal, client S3ClientAPI, envs []Environment, users []string, report *RunReport, timer *runTimer) (int, error) {
+	f, err := downloadFile(input, client)
+	if err != nil {
+		return 0, err
+	}
+	defer closeWorkbook(f)
+
+	err = validateSheets(f, input)
+	if err != nil {
+		return 0, err
+	}
+
+	// find every user before logging in as any of them
+	envToJobs := map[Environment][]heartbeatJob{}
+	envToQuarantined := map[Environment][]heartbeatJob{}
+	found := map[string]bool{}
+	for _, env := range envs {
+		jobs, quarantined, err := verifyJobs(f, input, env, users)
+		if err != nil {
+			return 0, err
+		}
+		for _, job := range append(jobs, quarantined...) {
+			found[strings.ToLower(job.name)] = true
+		}
+		envToJobs[env] = jobs
+		envToQuarantined[env] = quarantined
+	}
+	for _, user := range users {
+		if !found[strings.ToLower(user)] {
+			return 0, fmt.Errorf("user %s is not in the automated sheet of environments %v", user, envs)
+		}
+	}
+
+	failed := 0
+	for _, env := range envs {
+		timer.startEnv()
+		// logging in could lock a quarantined user's account
+		for _, job := range envToQuarantined[env] {
+			report.add(ReportRecord{Environment: env, User: job.name, Action: actionQuarantined, OldTimestamp: job.timestamp, Quarantined: job.lockout.quarantined})
+			envLogger(input, env).Warn("user quarantined; not verified", nil, Fields{"user": job.name, "quarantined": job.lockout.quarantined})
+		}
+		envFailed := len(envToQuarantined[env])
+
+		if jobs := envToJobs[env]; len(jobs) > 0 {
+			_, err = optionalCol(f, input, env, ColStatusHeading)
+			if err != nil {
+				return failed, err
+			}
+
+			statuses := map[string]int{}
+			err = loginUsers(ctx, input, envToPortal[env], env, jobs, func(res heartbeatResult) error {
+				status, err := applyVerify(f, input, env, res, report)
+				statuses[status]++
+				return err
+			})
+			if err != nil {
+				return failed, err
+			}
+			envFailed += len(jobs) - statuses[statusOK]
+			metrics.add(env, metricAccountsLocked, float64(statuses[statusLocked]))
+			envLogger(input, env).Info("verification summary", Fields{"verified": len(jobs), "statuses": statuses})
+		}
+
+		failed += envFailed
+		metrics.add(env, metricVerificationsFailed, float64(envFailed))
+		metrics.add(env, metricAccountsQuarantined, float64(len(envToQuarantined[env])))
+		timer.stopEnv(env)
+		timer.finishEnv(env, envFailed == 0)
+	}
+
+	err = uploadFile(f, input.Bucket, input.Key, client)
+	if err != nil {
+		return failed, fmt.Errorf("Error uploading file after verification: %s", err)
+	}
+	logger.Info("uploaded workbook", Fields{"step": stepUpload, "outcome": outcomeSuccess})
+	return failed, nil
+}
+
+// Get the users of an environment to verify, all of them if users is empty,
+// and those of them who are quarantined
+func verifyJobs(f *excelize.File, input *Input, env Environment, users []string) (jobs, quarantined []heartbeatJob, err error) {
+	automatedSheet := input.SheetGroups[env].AutomatedSheetName
+	rows, err := f.GetRows(automatedSheet)
+	if err != nil {
+		return nil, nil, err
+	}
+	userToPolicy, err := getUserPolicies(f, input, env)
+	if err != nil {
+		return nil, nil, err
+	}
+	userToTOTPSecret, err := getTOTPSecrets(f, input, env)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := getHeaderToXCoord(rows[0])
+	colUser := input.AutomatedSheetColNameToIndex[ColUser]
+	colPassword := input.AutomatedSheetColNameToIndex[ColPassword]
+	colTimestamp := input.AutomatedSheetColNameToIndex[ColTimestamp]
+
+	jobs = []heartbeatJob{}
+	for i, row := range rows[input.RowOffset:] {
+		name := row[colUser]
+		if len(users) > 0 && !containsFold(users, name) {
+			continue
+		}
+		policy, ok := userToPolicy[name]
+		if !ok {
+			policy = input.policy(env)
+		}
+		job := heartbeatJob{
+			row:        i + input.RowOffset,
+			name:       name,
+			password:   row[colPassword],
+			timestamp:  row[colTimestamp],
+			policy:     policy,
+			lockout:    readLockout(header, row),
+			totpSecret: userToTOTPSecret[strings.ToLower(name)],
+		}
+		if job.lockout.quarantined != "" {
+			quarantined = append(quarantined, job)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, quarantined, nil
+}
+
+func containsFold(items []string, item string) bool {
+	for _, i := range items {
+		if strings.EqualFold(i, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write a verification result to the workbook and the report. A login
+// cancelled with the run has no status and stops the verification.
+func applyVerify(f *excelize.File, input *Input, env Environment, res heartbeatResult, report *RunReport) (string, error) {
+	job := res.job
+	if errors.Is(res.err, context.Canceled) || errors.Is(res.err, context.DeadlineExceeded) {
+		return "", res.err
+	}
+	status := verifyStatus(res.err)
+	rec := ReportRecord{Environment: env, User: job.name, Action: actionVerified, Status: status, OldTimestamp: job.timestamp}
+	envLog := envLogger(input, env)
+
+	if res.err != nil {
+		rec.ErrorClass = errorClass(res.err)
+		err := recordHeartbeatFailure(f, input, env, res, &rec)
+		if err != nil {
+			return status, err
+		}
+		report.add(rec)
+		envLog.Warn("verification failed", res.err, Fields{"user": job.name, "status": status, "error_class": rec.ErrorClass})
+		return status, recordStatus(f, input, env, job.name, job.row, status)
+	}
+
+	report.add(rec)
+	envLog.Info("verified", Fields{"user": job.name, "status": status})
+	return status, recordLogin(f, input, env, job.name, job.row, res.at)
+}
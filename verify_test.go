@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestVerify(t *testing.T) {
+	emf := &lockedBuffer{}
+	setMetricsOutput(emf)
+	defer setMetricsOutput(os.Stdout)
+	dir := t.TempDir()
+	filename := path.Join(dir, localS3Filename)
+
+	rows := [][]string{
+		{ColUserHeading, ColPasswordHeading, ColPreviousHeading, ColTimestampHeading},
+		{"ann", "ann-pw", "", format(-3 * Day)},
+		{"ben", "stale-pw", "", format(-3 * Day)},
+		{"cat", "cat-pw", "", format(-3 * Day)},
+		{"dan", "dan-pw", "", format(-3 * Day)},
+		{"eve", "eve-pw", "", format(-3 * Day)},
+		{"fay", "fay-pw", "", format(-3 * Day)},
+	}
+	f := excelize.NewFile()
+	f.SetSheetName("Sheet1", sheetNameMACFin)
+	f.NewSheet(sheetNamePasswordManager)
+	f.SetSheetRow(sheetNameMACFin, "A1", &[]string{headingMACFinUsername, headingMACFinPassword})
+	for idx, row := range rows {
+		row := row
+		err := f.SetSheetRow(sheetNamePasswordManager, fmt.Sprintf("A%d", 1+idx), &row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idx > 0 {
+			f.SetSheetRow(sheetNameMACFin, fmt.Sprintf("A%d", 1+idx), &[]string{row[0], row[1]})
+		}
+	}
+	err := f.SaveAs(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &AuthServer{
+		UserToPassword: map[string]string{
+			"ann": "ann-pw",
+			"ben": "new-pw",
+			"cat": "cat-pw",
+			"dan": "dan-pw",
+			"eve": "eve-pw",
+			"fay": "fay-pw",
+		},
+		Statuses: map[string]string{
+			"cat": "LOCKED_OUT",
+			"dan": "PASSWORD_EXPIRED",
+			"eve": "MFA_REQUIRED",
+		},
+		Errors: map[string]string{"fay": loginSubmitPath},
+	}
+	server := &http.Server{
+		Addr:    ":3398",
+		Handler: handler,
+	}
+	go func() {
+		log.Printf("Server stopped: %s", server.ListenAndServe())
+	}()
+	defer server.Shutdown(context.Background())
+
+	input := &Input{
+		UsernameHeader:                 headingMACFinUsername,
+		PasswordHeader:                 headingMACFinPassword,
+		Bucket:                         inputBucket,
+		Key:                            inputKey,
+		AutomatedSheetColNameToIndex:   columnArrangements[0].Columns,
+		AutomatedSheetColNameToHeading: headings,
+		RowOffset:                      1,
+		SheetGroups: map[Environment]SheetGroup{
+			dev: {
+				AutomatedSheetName: sheetNamePasswordManager,
+				PortalSheetName:    sheetNameMACFin,
+			},
+		},
+		Workers:      3,
+		ReportPrefix: "reports/",
+		RunID:        "test",
+	}
+	envToPortal := map[Environment]*Portal{
+		dev: {
+			Hostname:    portalServer,
+			IDMHostname: idmServer,
+			Scheme:      "http://",
+			env:         dev,
+			limiter:     newRateLimiter(1000),
+		},
+	}
+	fc := &FakeS3Client{
+		Bucket:                       input.Bucket,
+		Key:                          input.Key,
+		LocalPath:                    filename,
+		AutomatedSheetName:           sheetNamePasswordManager,
+		AutomatedSheetColNameToIndex: input.AutomatedSheetColNameToIndex,
+		RowOffset:                    input.RowOffset,
+		SheetName:                    sheetNameMACFin,
+		UsernameHeader:               input.UsernameHeader,
+		PasswordHeader:               input.PasswordHeader,
+	}
+
+	envs, err := verifyEnvironments("", envToPortal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err := verify(context.Background(), input, envToPortal, fc, envs, nil)
+	if err != nil {
+		t.Fatalf("Error running verify(): %s", err)
+	}
+	if failed != 5 {
+		t.Fatalf("Expected 5 users to fail verification; got %d", failed)
+	}
+	if handler.UserToNewPassword != nil {
+		t.Fatalf("verify() changed passwords: %v", handler.UserToNewPassword)
+	}
+	runMetrics := getMetrics(t, emf)
+	if m := runMetrics[dev]; m[metricVerificationsFailed] != 5 || m[metricAccountsLocked] != 1 || m[metricVerifySucceeded] != 0 ||
+		m[metricPortalRequestLatency] < 1 {
+		t.Fatalf("Expected dev metrics of 5 failed verifications; got %v", m)
+	}
+	if m := runMetrics[allEnvironments]; m[metricVerifySucceeded] != 0 || m[metricS3Uploads] < 1 {
+		t.Fatalf("Expected a failed run with uploads; got %v", m)
+	}
+
+	expected := map[string]string{
+		"ann": statusOK,
+		"ben": statusWrongPassword,
+		"cat": statusLocked,
+		"dan": statusExpired,
+		"eve": statusMFARequired,
+		"fay": statusPortalError,
+	}
+	checkStatuses := func(expected map[string]string) {
+		t.Helper()
+		out, err := excelize.OpenFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outRows, err := out.GetRows(sheetNamePasswordManager)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := getHeaderToXCoord(outRows[0])
+		statusX, ok := header[ColStatusHeading]
+		if !ok {
+			t.Fatalf("Expected a %s column; got %v", ColStatusHeading, outRows[0])
+		}
+		lastLoginX, ok := header[ColLastLoginHeading]
+		if !ok {
+			t.Fatalf("Expected a %s column; got %v", ColLastLoginHeading, outRows[0])
+		}
+		statuses := map[string]string{}
+		for i, row := range outRows[1:] {
+			if row[1] != rows[i+1][1] || row[3] != rows[i+1][3] {
+				t.Fatalf("verify() changed the password or timestamp of %s: %v", row[0], row)
+			}
+			if len(row) > statusX {
+				statuses[row[0]] = row[statusX]
+			}
+			loggedIn := len(row) > lastLoginX && row[lastLoginX] != ""
+			if loggedIn != (statuses[row[0]] == statusOK) {
+				t.Fatalf("Expected a last login for %s only if the status is ok; got %v", row[0], row)
+			}
+		}
+		if !reflect.DeepEqual(statuses, expected) {
+			t.Fatalf("Expected statuses %v; got %v", expected, statuses)
+		}
+	}
+	checkStatuses(expected)
+
+	report := getRunReport(t, fc, "reports/")
+	if len(report.Records) != len(expected) {
+		t.Fatalf("Expected %d report records; got %+v", len(expected), report.Records)
+	}
+	for _, rec := range report.Records {
+		if rec.Action != actionVerified || rec.Status != expected[rec.User] {
+			t.Fatalf("Expected %s to be verified with status %s; got %+v", rec.User, expected[rec.User], rec)
+		}
+	}
+
+	// a filtered run only touches the given users
+	handler.UserToPassword["ben"] = "stale-pw"
+	fc.Objects = nil
+	failed, err = verify(context.Background(), input, envToPortal, fc, envs, []string{"BEN"})
+	if err != nil || failed != 0 {
+		t.Fatalf("Expected ben to be verified; got %d failed, %v", failed, err)
+	}
+	if succeeded := getMetrics(t, emf)[dev][metricVerifySucceeded]; succeeded != 1 {
+		t.Fatalf("Expected VerifySucceeded 1 in dev over both runs; got %v", succeeded)
+	}
+	expected["ben"] = statusOK
+	checkStatuses(expected)
+
+	_, err = verify(context.Background(), input, envToPortal, fc, envs, []string{"nobody"})
+	if err == nil {
+		t.Fatal("Expected an error verifying a user who is not in the automated sheet")
+	}
+	_, err = verifyEnvironments("dev,qa", envToPortal)
+	if err == nil {
+		t.Fatal("Expected an error verifying an unknown environment")
+	}
+}
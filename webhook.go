@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	texttemplate "text/template"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	defaultWebhookSignatureHeader = "X-Signature-256"
+	defaultWebhookTimeout         = 10 * time.Second
+
+	// the payload is the webhook data itself, whose text field Slack and
+	// Teams show
+	defaultWebhookPayloadTemplate = `{{json .}}`
+)
+
+// WebhookData is what a webhook's payload template is executed with. It
+// summarizes the run in the webhook's environments and never holds
+// passwords.
+type WebhookData struct {
+	Text         string                   `json:"text"` // the summary in a sentence
+	RunID        string                   `json:"runId"`
+	Started      time.Time                `json:"started"`
+	Webhook      string                   `json:"webhook"`
+	Error        string                   `json:"error,omitempty"` // why the run stopped, for an alert
+	Environments []MailEnvironmentSummary `json:"environments"`
+	Users        []WebhookUser            `json:"users"`
+	Failed       int                      `json:"failed"`
+}
+
+// WebhookUser is what happened to a user in the run.
+type WebhookUser struct {
+	Environment Environment `json:"environment"`
+	User        string      `json:"user"`
+	Action      string      `json:"action"`
+	ErrorClass  string      `json:"errorClass,omitempty"`
+}
+
+// webhookNotifier posts a JSON summary of each run to a URL, signed with
+// HMAC-SHA256 if the webhook has a secret.
+type webhookNotifier struct {
+	config   WebhookConfig
+	envs     []Environment // nil for all
+	template *texttemplate.Template
+	client   *http.Client
+}
+
+// Build the notifier for a validated webhook configuration, loading its
+// payload template from a local file or an s3://bucket/key URI
+func newWebhookNotifier(c WebhookConfig, client S3ClientAPI) (*webhookNotifier, error) {
+	timeout, err := time.ParseDuration(c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeout %q: %s", c.Timeout, err)
+	}
+	source := defaultWebhookPayloadTemplate
+	if c.PayloadTemplate != "" {
+		b, err := readFileOrS3(c.PayloadTemplate, client)
+		if err != nil {
+			return nil, fmt.Errorf("payloadTemplate: %s", err)
+		}
+		source = string(b)
+	}
+	t, err := parseWebhookTemplate(source)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &webhookNotifier{
+		config:   c,
+		template: t,
+		client:   &http.Client{Timeout: timeout},
+	}
+	if len(c.Environments) > 0 {
+		n.envs = c.Environments
+	}
+	return n, nil
+}
+
+func parseWebhookTemplate(source string) (*texttemplate.Template, error) {
+	t, err := texttemplate.New("payload").Option("missingkey=error").Funcs(texttemplate.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing payload template: %s", err)
+	}
+
+	// catch references to fields that do not exist before a run needs them
+	_, err = renderWebhookPayload(t, &WebhookData{Started: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Render a payload, which must be JSON
+func renderWebhookPayload(t *texttemplate.Template, data *WebhookData) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := t.Execute(buf, data)
+	if err != nil {
+		return nil, fmt.Errorf("Error rendering payload template: %s", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("payload template does not render JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+func (n *webhookNotifier) name() string {
+	return "webhook " + n.config.Name
+}
+
+func (n *webhookNotifier) notify(f *excelize.File, report *RunReport) error {
+	if !notifies(n.config.Notify, newMailData(report, n.envs, n.config.Name)) {
+		logger.Info("nothing to post", Fields{"notify": n.config.Notify, "webhook": n.config.Name})
+		return nil
+	}
+	err := n.post(report)
+	if err != nil {
+		return err
+	}
+	logger.Info("posted to webhook", Fields{"webhook": n.config.Name})
+	return nil
+}
+
+// Post the error that stopped the run. Only notify never turns the alert
+// off.
+func (n *webhookNotifier) alert(report *RunReport) error {
+	if n.config.Notify == notifyNever {
+		return nil
+	}
+	err := n.post(report)
+	if err != nil {
+		return err
+	}
+	logger.Info("posted alert to webhook", Fields{"webhook": n.config.Name, "error": report.Error})
+	return nil
+}
+
+func (n *webhookNotifier) post(report *RunReport) error {
+	payload, err := renderWebhookPayload(n.template, newWebhookData(report, n.envs, n.config.Name))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("Error creating webhook request: %s", webhookError(err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.config.Secret != "" {
+		req.Header.Set(n.config.SignatureHeader, signWebhookPayload(n.config.Secret, payload))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error posting to webhook: %s", webhookError(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxEchoedBody+1))
+		return fmt.Errorf("webhook responded %s: %s", resp.Status, sanitizeBody(string(body)))
+	}
+	return nil
+}
+
+// Leave the URL, which may hold a token, out of a request error
+func webhookError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+// Sign a payload as sha256=<hex HMAC-SHA256>, which the receiver checks by
+// computing the same over the request body with the shared secret
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Summarize a run report for a webhook. envs limits the summary to some
+// environments, or is nil for all of them.
+func newWebhookData(report *RunReport, envs []Environment, name string) *WebhookData {
+	summary := newMailData(report, envs, name)
+	data := &WebhookData{
+		RunID:        report.RunID,
+		Started:      report.Started,
+		Webhook:      name,
+		Error:        report.Error,
+		Environments: summary.Environments,
+		Users:        []WebhookUser{},
+		Failed:       summary.Failed,
+	}
+	if data.Environments == nil {
+		data.Environments = []MailEnvironmentSummary{}
+	}
+
+	included := map[Environment]bool{}
+	for _, env := range envs {
+		included[env] = true
+	}
+	for _, rec := range report.Records {
+		if envs != nil && !included[rec.Environment] {
+			continue
+		}
+		data.Users = append(data.Users, WebhookUser{
+			Environment: rec.Environment,
+			User:        rec.User,
+			Action:      rec.Action,
+			ErrorClass:  rec.ErrorClass,
+		})
+	}
+
+	if data.Error != "" {
+		data.Text = mailSubject + ": rotation failed: " + data.Error
+		return data
+	}
+	counts := []string{}
+	for _, env := range data.Environments {
+		counts = append(counts, fmt.Sprintf("%s %d rotated, %d recovered, %d added, %d deleted, %d failed",
+			env.Environment, env.Rotated, env.Recovered, env.Added, env.Deleted, env.Failed))
+	}
+	if len(counts) == 0 {
+		counts = append(counts, "no users")
+	}
+	data.Text = mailSubject + ": " + strings.Join(counts, "; ")
+	return data
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// FakeWebhook records the requests posted to it.
+type FakeWebhook struct {
+	*httptest.Server
+	Status int // 200 if unset
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newFakeWebhook(t *testing.T) *FakeWebhook {
+	hook := &FakeWebhook{}
+	hook.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		hook.mu.Lock()
+		hook.requests = append(hook.requests, r)
+		hook.bodies = append(hook.bodies, body)
+		status := hook.Status
+		hook.mu.Unlock()
+		if status != 0 {
+			http.Error(w, "no such channel", status)
+		}
+	}))
+	t.Cleanup(hook.Close)
+	return hook
+}
+
+func (h *FakeWebhook) posts() ([]*http.Request, [][]byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]*http.Request{}, h.requests...), append([][]byte{}, h.bodies...)
+}
+
+func webhookConfig(url string) WebhookConfig {
+	return WebhookConfig{
+		Name:            "ops",
+		URL:             url,
+		SignatureHeader: defaultWebhookSignatureHeader,
+		Notify:          notifyAlways,
+		Timeout:         "5s",
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	hook := newFakeWebhook(t)
+
+	// the workbook holds passwords, which must not be posted
+	f := excelize.NewFile()
+	f.SetCellValue("Sheet1", "A1", "dev-user")
+	f.SetCellValue("Sheet1", "B1", "Fresh-Passw0rd!")
+	report := newRunReport("run1", time.Now())
+	report.add(ReportRecord{Environment: dev, User: "dev-user", Action: actionRotated})
+	report.add(ReportRecord{Environment: prod, User: "prod-user", Action: actionFailed, ErrorClass: "account locked"})
+
+	c := webhookConfig(hook.URL)
+	c.Secret = "signing-key"
+	c.Environments = []Environment{dev}
+	n, err := newWebhookNotifier(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.notify(f, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests, bodies := hook.posts()
+	if len(requests) != 1 {
+		t.Fatalf("Expected one post; got %d", len(requests))
+	}
+	if requests[0].Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected a JSON post; got %q", requests[0].Header.Get("Content-Type"))
+	}
+	if sig := requests[0].Header.Get("X-Signature-256"); sig != signWebhookPayload("signing-key", bodies[0]) || !strings.HasPrefix(sig, "sha256=") {
+		t.Fatalf("Expected the payload signed with the secret; got %q", sig)
+	}
+	if signWebhookPayload("signing-key", []byte(`{}`)) == signWebhookPayload("other-key", []byte(`{}`)) {
+		t.Fatal("Expected the signature to depend on the secret")
+	}
+	if strings.Contains(string(bodies[0]), "Fresh-Passw0rd!") || strings.Contains(string(bodies[0]), "prod") {
+		t.Fatalf("Expected neither passwords nor other environments in the payload; got %s", bodies[0])
+	}
+	payload := WebhookData{}
+	err = json.Unmarshal(bodies[0], &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.RunID != "run1" || payload.Webhook != "ops" || len(payload.Users) != 1 || payload.Users[0].User != "dev-user" ||
+		len(payload.Environments) != 1 || payload.Environments[0].Rotated != 1 ||
+		payload.Text != mailSubject+": dev 1 rotated, 0 recovered, 0 added, 0 deleted, 0 failed" {
+		t.Fatalf("Unexpected payload %+v", payload)
+	}
+
+	// on-failure has nothing to post for dev
+	c.Notify = notifyOnFailure
+	n, err = newWebhookNotifier(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.notify(f, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests, _ := hook.posts(); len(requests) != 1 {
+		t.Fatalf("Expected no post when nothing failed in dev; got %d", len(requests))
+	}
+
+	// but an alert is posted, unsigned without a secret
+	c.Secret = ""
+	n, err = newWebhookNotifier(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report.finish(errors.New("Error downloading file: NoSuchKey"), time.Now())
+	err = n.alert(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests, bodies = hook.posts()
+	if len(requests) != 2 || requests[1].Header.Get("X-Signature-256") != "" {
+		t.Fatalf("Expected an unsigned alert; got %d posts", len(requests))
+	}
+	payload = WebhookData{}
+	json.Unmarshal(bodies[1], &payload)
+	if payload.Error != "Error downloading file: NoSuchKey" || !strings.Contains(payload.Text, "rotation failed: Error downloading file") {
+		t.Fatalf("Expected the error in the alert; got %+v", payload)
+	}
+
+	// never posts nothing
+	c.Notify = notifyNever
+	n, err = newWebhookNotifier(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.notify(f, report)
+	n.alert(report)
+	if requests, _ := hook.posts(); len(requests) != 2 {
+		t.Fatalf("Expected no posts when notify is never; got %d", len(requests))
+	}
+}
+
+func TestWebhookPayloadTemplate(t *testing.T) {
+	hook := newFakeWebhook(t)
+	report := newRunReport("run1", time.Now())
+	report.add(ReportRecord{Environment: val, User: "val-user", Action: actionAdded})
+
+	c := webhookConfig(hook.URL)
+	c.PayloadTemplate = writeConfig(t, "payload.json", `{"content": {{json .Text}}, "users": {{len .Users}}}`)
+	n, err := newWebhookNotifier(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.notify(nil, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bodies := hook.posts()
+	expected := `{"content": "` + mailSubject + `: val 0 rotated, 0 recovered, 1 added, 0 deleted, 0 failed", "users": 1}`
+	if len(bodies) != 1 || string(bodies[0]) != expected {
+		t.Fatalf("Expected payload %s; got %q", expected, bodies)
+	}
+
+	for source, problem := range map[string]string{
+		`{"text": {{.Text}}`:     "does not render JSON",
+		`{{json .Password}}`:     "can't evaluate field Password",
+		`{"text": {{json .Text}`: "Error parsing payload template",
+	} {
+		_, err = parseWebhookTemplate(source)
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Fatalf("Expected %q for template %s; got %v", problem, source, err)
+		}
+	}
+}
+
+func TestNotifyRun(t *testing.T) {
+	up := newFakeWebhook(t)
+	down := newFakeWebhook(t)
+	down.Status = http.StatusNotFound
+	closed := newFakeWebhook(t)
+	closed.Close()
+
+	input := &Input{}
+	for name, url := range map[string]string{"down": down.URL + "/secret-token", "closed": closed.URL + "/secret-token", "up": up.URL} {
+		c := webhookConfig(url)
+		c.Name = name
+		n, err := newWebhookNotifier(c, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input.Notifiers = append(input.Notifiers, n)
+	}
+
+	// every notifier is tried
+	err := notifyRun(nil, input, newRunReport("run1", time.Now()))
+	if err == nil {
+		t.Fatal("Expected an error from the failing webhooks")
+	}
+	if requests, _ := up.posts(); len(requests) != 1 {
+		t.Fatalf("Expected the working webhook to be posted to; got %d posts", len(requests))
+	}
+	if !strings.Contains(err.Error(), "webhook down: webhook responded 404 Not Found: no such channel") ||
+		!strings.Contains(err.Error(), "webhook closed: Error posting to webhook") || strings.Contains(err.Error(), "secret-token") {
+		t.Fatalf("Expected both failures without the URLs; got %s", err)
+	}
+}